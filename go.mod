@@ -1,5 +1,19 @@
 module iperf3-go
 
-go 1.21
+go 1.23
 
-require github.com/ishidawataru/sctp v0.0.0-20250602134719-805d8b81dda5 // indirect
+require (
+	github.com/ishidawataru/sctp v0.0.0-20230406120618-7ff4192f6ff2
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/term v0.23.0
+)
+
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,166 @@
+// Package acl decides which source networks may run tests on a server, from
+// lists of allowed and denied CIDR prefixes.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// List holds the allowed and denied networks. An address in a denied
+// network is rejected; otherwise it is permitted if Allow is empty or holds
+// one of its networks.
+type List struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Empty reports whether the list permits every address
+func (l *List) Empty() bool {
+	return l == nil || len(l.Allow) == 0 && len(l.Deny) == 0
+}
+
+// Permits reports whether addr may connect. Addresses other than IP ones,
+// such as Unix socket paths, are always permitted.
+func (l *List) Permits(addr net.Addr) bool {
+	if l.Empty() {
+		return true
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+
+	for _, p := range l.Deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.Allow) == 0 {
+		return true
+	}
+	for _, p := range l.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge returns a list with the networks of both l and other
+func (l *List) Merge(other *List) *List {
+	merged := &List{}
+	for _, src := range []*List{l, other} {
+		if src != nil {
+			merged.Allow = append(merged.Allow, src.Allow...)
+			merged.Deny = append(merged.Deny, src.Deny...)
+		}
+	}
+	return merged
+}
+
+// addrIP returns the IP address of a TCP, UDP, IP or SCTP address
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	case nil:
+		return netip.Addr{}, false
+	default:
+		if !strings.HasPrefix(addr.Network(), "sctp") {
+			return netip.Addr{}, false
+		}
+		// SCTP addresses read "host1/host2:port", listing every address
+		// of the peer with the primary one first
+		s := addr.String()
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			s = s[:i]
+		}
+		s, _, _ = strings.Cut(s, "/")
+		parsed, err := netip.ParseAddr(strings.Trim(s, "[]"))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		return parsed.Unmap(), true
+	}
+
+	parsed, ok := netip.AddrFromSlice(ip)
+	return parsed.Unmap(), ok
+}
+
+// ParsePrefix parses a CIDR prefix such as "192.0.2.0/24"; a bare address
+// stands for itself alone
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network '%s'", s)
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network '%s'", s)
+	}
+	return p.Masked(), nil
+}
+
+// Parse reads a list with one "allow <network>" or "deny <network>" rule
+// per line. Blank lines and lines starting with '#' are ignored.
+func Parse(r io.Reader) (*List, error) {
+	l := &List{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"allow <network>\" or \"deny <network>\"", n)
+		}
+		p, err := ParsePrefix(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			l.Allow = append(l.Allow, p)
+		case "deny":
+			l.Deny = append(l.Deny, p)
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule '%s'", n, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Load reads a list from a file in the format of Parse
+func Load(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access control list: %w", err)
+	}
+	defer f.Close()
+
+	l, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access control list %s: %w", path, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,73 @@
+package acl
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// sctpAddr stands in for an SCTP address, which lists all the peer's hosts
+type sctpAddr string
+
+func (sctpAddr) Network() string  { return "sctp" }
+func (a sctpAddr) String() string { return string(a) }
+
+func TestPermits(t *testing.T) {
+	list, err := Parse(strings.NewReader(`
+# lab networks
+allow 192.0.2.0/24
+allow 2001:db8::/32
+deny  192.0.2.128/25
+deny  192.0.2.7
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5201}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5201}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 5201}, false},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5201}, false},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5201}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5201}, true},
+		{sctpAddr("192.0.2.1/198.51.100.1:5201"), true},
+		{sctpAddr("198.51.100.1/192.0.2.1:5201"), false},
+		{&net.UnixAddr{Name: "/run/iperf3.sock", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		if got := list.Permits(tt.addr); got != tt.want {
+			t.Errorf("Permits(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// Without allow rules, everything not denied is permitted
+	denyOnly := &List{Deny: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	if !denyOnly.Permits(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) || denyOnly.Permits(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("unexpected result for a deny-only list")
+	}
+	if !(*List)(nil).Permits(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("Expected a nil list to permit everything")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"allow", "line 1: expected"},
+		{"\npermit 10.0.0.0/8", "line 2: unknown rule"},
+		{"deny 10.0.0.0/33", "invalid network"},
+		{"allow example.com", "invalid network"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package auth implements iperf3's authentication: the client sends its
+// username, password and the time, encrypted with the server's RSA public
+// key, and the server checks them against its authorized users file of
+// salted SHA256 password hashes.
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSkewThreshold is how far the client's clock may be from the
+// server's, as with iperf3's --time-skew-threshold
+const DefaultSkewThreshold = 10 * time.Second
+
+// ErrAccessDenied is returned when a client's credentials are rejected
+var ErrAccessDenied = errors.New("access denied")
+
+// Credentials are what a client authenticates with
+type Credentials struct {
+	Username string
+	Password string
+	// Time is when the client sent them, which limits replays
+	Time time.Time
+}
+
+// Token encrypts the credentials for the server holding key's private key,
+// in iperf3's format
+func Token(key *rsa.PublicKey, creds Credentials) (string, error) {
+	plain := fmt.Sprintf("user: %s\npwd:  %s\nts:   %d", creds.Username, creds.Password, creds.Time.Unix())
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, []byte(plain), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt credentials: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// Decode decrypts a token made by Token. PKCS1 selects PKCS #1 v1.5 padding
+// instead of OAEP, for clients that use it.
+func Decode(key *rsa.PrivateKey, token string, pkcs1 bool) (*Credentials, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token: %w", err)
+	}
+	var plain []byte
+	if pkcs1 {
+		plain, err = rsa.DecryptPKCS1v15(nil, key, encrypted)
+	} else {
+		plain, err = rsa.DecryptOAEP(sha1.New(), nil, key, encrypted, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	creds := &Credentials{}
+	var ts string
+	// The labels are padded to line up, as in iperf3; the values are kept
+	// as sent, spaces included, with only the line terminator removed
+	fields := map[string]*string{"user: ": &creds.Username, "pwd:  ": &creds.Password, "ts:   ": &ts}
+	for _, line := range strings.Split(string(plain), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		for label, field := range fields {
+			if value, ok := strings.CutPrefix(line, label); ok {
+				*field = value
+				delete(fields, label)
+				break
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return nil, errors.New("malformed token")
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token time: %w", err)
+	}
+	creds.Time = time.Unix(secs, 0)
+	return creds, nil
+}
+
+// Hash is the authorized users file hash of a password: the hex SHA256 of
+// the password salted with "{username}"
+func Hash(username, password string) string {
+	sum := sha256.Sum256([]byte("{" + username + "}" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticator checks the tokens of clients on the server
+type Authenticator struct {
+	Key *rsa.PrivateKey
+	// UsersPath is the authorized users file, with one "username,hash" line
+	// per user and '#' comments. It is read on every check, so users can
+	// be changed while the server runs.
+	UsersPath string
+	// SkewThreshold defaults to DefaultSkewThreshold
+	SkewThreshold time.Duration
+	// PKCS1 decrypts tokens with PKCS #1 v1.5 padding rather than OAEP
+	PKCS1 bool
+}
+
+// Check authenticates a token sent at now, returning the username. Rejected
+// credentials give an error wrapping ErrAccessDenied.
+func (a *Authenticator) Check(token string, now time.Time) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: no credentials given", ErrAccessDenied)
+	}
+	creds, err := Decode(a.Key, token, a.PKCS1)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAccessDenied, err)
+	}
+
+	skew := a.SkewThreshold
+	if skew <= 0 {
+		skew = DefaultSkewThreshold
+	}
+	if d := now.Sub(creds.Time); d > skew || d < -skew {
+		return creds.Username, fmt.Errorf("%w: time skew of %v for user %s", ErrAccessDenied, d.Round(time.Second), creds.Username)
+	}
+
+	hashes, err := LoadUsers(a.UsersPath)
+	if err != nil {
+		return creds.Username, err
+	}
+	want, ok := hashes[creds.Username]
+	got := Hash(creds.Username, creds.Password)
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(got)) != 1 {
+		return creds.Username, fmt.Errorf("%w: bad credentials for user %s", ErrAccessDenied, creds.Username)
+	}
+	return creds.Username, nil
+}
+
+// LoadUsers reads an authorized users file into a map of username to hash
+func LoadUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open authorized users file: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ",")
+		if !ok {
+			continue
+		}
+		users[strings.TrimSpace(username)] = strings.ToLower(strings.TrimSpace(hash))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read authorized users file: %w", err)
+	}
+	return users, nil
+}
+
+// LoadPublicKey reads a PEM RSA public key, as made by
+// "openssl rsa -pubout"
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+	return rsaKey, nil
+}
+
+// LoadPrivateKey reads an unencrypted PEM RSA private key, in PKCS #1 or
+// PKCS #8 form
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA private key", path)
+	}
+	return rsaKey, nil
+}
+
+// readPEM reads the first PEM block of a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
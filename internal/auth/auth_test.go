@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHash(t *testing.T) {
+	// The example from iperf3's documentation: echo -n "{mario}rossi" | sha256sum
+	want := "bf7a49a846d44b454a5d11e7acfaf13d138bbe0b7483aa3e050879700572709b"
+	if got := Hash("mario", "rossi"); got != want {
+		t.Errorf("Hash = %s, want %s", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	users := filepath.Join(t.TempDir(), "users.csv")
+	data := "# username,sha256\nmario," + Hash("mario", "rossi") + "\n"
+	if err := os.WriteFile(users, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := &Authenticator{Key: key, UsersPath: users}
+	now := time.Now()
+
+	token, err := Token(&key.PublicKey, Credentials{Username: "mario", Password: "rossi", Time: now})
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if username, err := a.Check(token, now.Add(time.Second)); err != nil || username != "mario" {
+		t.Errorf("Check = %q, %v; want mario", username, err)
+	}
+
+	tests := []struct {
+		creds Credentials
+		want  string
+	}{
+		{Credentials{Username: "mario", Password: "bianchi", Time: now}, "bad credentials"},
+		{Credentials{Username: "luigi", Password: "rossi", Time: now}, "bad credentials"},
+		{Credentials{Username: "mario", Password: "rossi", Time: now.Add(-time.Minute)}, "time skew"},
+	}
+	for _, tt := range tests {
+		token, err := Token(&key.PublicKey, tt.creds)
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		_, err = a.Check(token, now)
+		if !errors.Is(err, ErrAccessDenied) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Check(%+v) error = %v, want %q", tt.creds, err, tt.want)
+		}
+	}
+	if _, err := a.Check("", now); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected access denied without a token, got %v", err)
+	}
+
+	// Spaces are part of the password
+	token, err = Token(&key.PublicKey, Credentials{Username: "mario", Password: " rossi ", Time: now})
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if creds, err := Decode(key, token, false); err != nil || creds.Password != " rossi " {
+		t.Errorf("Decode = %+v, %v; want the password as sent", creds, err)
+	}
+	if _, err := a.Check(token, now); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected a padded password to be rejected, got %v", err)
+	}
+}
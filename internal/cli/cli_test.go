@@ -0,0 +1,272 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"iperf3-go/internal/client"
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/server"
+)
+
+func TestGetoptForms(t *testing.T) {
+	options := []Option{
+		{Long: "udp", Short: 'u'},
+		{Long: "reverse", Short: 'R'},
+		{Long: "port", Short: 'p', Arg: RequiredArgument},
+		{Long: "timestamps", Arg: OptionalArgument},
+	}
+
+	set, err := Getopt(options, []string{"-uRp5201", "--port=5202", "--po", "5203", "--timestamps", "-p", "5204", "--", "-u"})
+	if err != nil {
+		t.Fatalf("Getopt failed: %v", err)
+	}
+
+	var got []string
+	for _, v := range set.Values {
+		got = append(got, v.Option.Long+"="+v.Arg)
+	}
+	want := "udp= reverse= port=5201 port=5202 port=5203 timestamps= port=5204"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Values = %q, want %q", strings.Join(got, " "), want)
+	}
+	if len(set.Args) != 1 || set.Args[0] != "-u" {
+		t.Errorf("Args = %v, want [-u]", set.Args)
+	}
+	if v, _ := set.Lookup("port"); v.Arg != "5204" {
+		t.Errorf("Lookup(port) = %q, want last value 5204", v.Arg)
+	}
+
+	for _, args := range [][]string{{"-x"}, {"--nope"}, {"--udp=1"}, {"-p"}, {"--port"}} {
+		if _, err := Getopt(options, args); err == nil {
+			t.Errorf("Getopt(%v) expected error", args)
+		}
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	cfg, err := Parse([]string{"-c", "example.net", "-uR", "-b", "10M/5", "-P4", "--title", "circuit-7", "-f", "m", "--get-server-output", "--retry", "90"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	c := cfg.Client
+	if c == nil || cfg.Server != nil {
+		t.Fatalf("expected a client config, got %+v", cfg)
+	}
+	if c.Host != "example.net" || c.Port != 5201 || c.Time != 10 {
+		t.Errorf("unexpected host/port/time: %s %d %d", c.Host, c.Port, c.Time)
+	}
+	if c.Protocol != "udp" || !c.Reverse || c.Parallel != 4 {
+		t.Errorf("unexpected protocol/reverse/parallel: %s %v %d", c.Protocol, c.Reverse, c.Parallel)
+	}
+	if c.Bandwidth != 10000000 || c.Burst != 5 {
+		t.Errorf("unexpected bitrate: %d/%d", c.Bandwidth, c.Burst)
+	}
+	if c.Retry != 90*time.Second {
+		t.Errorf("unexpected retry: %v", c.Retry)
+	}
+	if c.Length != 1460 {
+		t.Errorf("expected UDP default length 1460, got %d", c.Length)
+	}
+
+	// As in iperf3, UDP defaults to 1 Mbit/s and -b 0 is unlimited
+	cfg, err = Parse([]string{"-c", "host", "-u"})
+	if err != nil || cfg.Client.Bandwidth != 1000000 {
+		t.Errorf("expected UDP default bitrate 1M, got %+v (%v)", cfg, err)
+	}
+	cfg, err = Parse([]string{"-c", "host", "-u", "-b", "0"})
+	if err != nil || cfg.Client.Bandwidth != 0 {
+		t.Errorf("expected unlimited bitrate for -b 0, got %+v (%v)", cfg, err)
+	}
+	if c.Title != "circuit-7" || c.Units != 'm' || !c.GetServerOutput {
+		t.Errorf("unexpected title/units/server output: %q %c %v", c.Title, c.Units, c.GetServerOutput)
+	}
+
+	cfg, err = Parse([]string{"-c", "192.0.2.1/198.51.100.1", "--sctp", "--nstreams", "8", "-X", "192.0.2.10", "-X", "198.51.100.10", "-N", "-M", "1200"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	c = cfg.Client
+	if c.Protocol != "sctp" || c.NStreams != 8 {
+		t.Errorf("unexpected SCTP config: %s %d", c.Protocol, c.NStreams)
+	}
+	if strings.Join(c.XBind, ",") != "192.0.2.10,198.51.100.10" || !c.NoDelay || c.MSS != 1200 {
+		t.Errorf("unexpected SCTP options: %v %v %d", c.XBind, c.NoDelay, c.MSS)
+	}
+
+	cfg, err = Parse([]string{"-c", "host", "--quic", "--nstreams", "4"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if c = cfg.Client; c.Protocol != "quic" || c.NStreams != 4 {
+		t.Errorf("unexpected QUIC config: %s %d", c.Protocol, c.NStreams)
+	}
+
+	cfg, err = Parse([]string{"-c", "host", "--tls", "--tls-max-version", "1.2", "--tls-ciphers", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if tc := cfg.Client.TLS; tc == nil || !tc.InsecureSkipVerify || tc.MaxVersion != tls.VersionTLS12 || len(tc.CipherSuites) != 1 {
+		t.Errorf("unexpected TLS config: %+v", tc)
+	}
+
+	cfg, err = Parse([]string{"-c", "host", "--cntl-ka=30//4", "--peer-timeout", "20"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	wantKA := net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: -1, Count: 4}
+	if c = cfg.Client; c.KeepAlive != wantKA || c.PeerTimeout != 20*time.Second {
+		t.Errorf("unexpected keepalive/peer timeout: %+v %v", c.KeepAlive, c.PeerTimeout)
+	}
+	cfg, err = Parse([]string{"-c", "host", "-u", "--cntl-ka"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if ka := cfg.Client.KeepAlive; !ka.Enable || ka.Idle != -1 || ka.Count != -1 {
+		t.Errorf("expected the system's keepalive defaults, got %+v", ka)
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	cfg, err := Parse([]string{"-s", "-1", "-J", "--output-format", "csv"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Server == nil || !cfg.Server.OneOff || cfg.Server.Format != "json" {
+		t.Errorf("unexpected server config: %+v", cfg.Server)
+	}
+
+	cfg, err = Parse([]string{"-s", "--allow", "192.0.2.0/24", "--allow", "2001:db8::1", "--deny", "192.0.2.7"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if fmt.Sprint(cfg.Server.Allow) != "[192.0.2.0/24 2001:db8::1/128]" || fmt.Sprint(cfg.Server.Deny) != "[192.0.2.7/32]" {
+		t.Errorf("unexpected access control lists: allow %v, deny %v", cfg.Server.Allow, cfg.Server.Deny)
+	}
+
+	cfg, err = Parse([]string{"-s", "--server-bitrate-limit", "100M/10", "--server-max-duration", "60", "--server-max-parallel", "4", "--server-max-length", "64K"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := server.Limits{Duration: time.Minute, Parallel: 4, Bitrate: 100000000, BitrateInterval: 10 * time.Second, Length: 65536}
+	if cfg.Server.Limits != want {
+		t.Errorf("Limits = %+v, want %+v", cfg.Server.Limits, want)
+	}
+
+	cfg, err = Parse([]string{"-s", "--max-tests", "2", "--queue-length", "8"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Server.MaxTests != 2 || cfg.Server.QueueLength != 8 {
+		t.Errorf("unexpected server config: %+v", cfg.Server)
+	}
+
+	cfg, err = Parse([]string{"-s", "--peer-timeout", "0"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Server.PeerTimeout >= 0 {
+		t.Errorf("unexpected server config: %+v", cfg.Server)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "must either be a client"},
+		{[]string{"-s", "-c", "host"}, "both server and client"},
+		{[]string{"-s", "-R"}, "only valid in client mode"},
+		{[]string{"-c", "host", "-1"}, "only valid in server mode"},
+		{[]string{"-c", "host", "--zerocopy"}, "not supported"},
+		{[]string{"-c", "host", "-R", "--bidir"}, "cannot be used together"},
+		{[]string{"-c", "host", "-t", "0"}, "out of range"},
+		{[]string{"-c", "host", "-f", "x"}, "invalid report format"},
+		{[]string{"-c", "host", "extra"}, "unexpected argument"},
+		{[]string{"-c", "host", "--nstreams", "4"}, "requires --sctp or --quic"},
+		{[]string{"-c", "host", "-X", "192.0.2.10"}, "requires --sctp"},
+		{[]string{"-c", "host", "-u", "-N"}, "requires TCP or SCTP"},
+		{[]string{"-s", "-X", "192.0.2.10"}, "requires --sctp"},
+		{[]string{"-c", "host1/host2"}, "require --sctp"},
+		{[]string{"-c", "host", "-u", "-m"}, "requires TCP"},
+		{[]string{"-s", "--unix"}, "requires a socket path"},
+		{[]string{"-c", "host", "--tls-ca", "ca.pem"}, "requires --tls"},
+		{[]string{"-c", "host", "--tls", "--quic"}, "requires a stream protocol"},
+		{[]string{"-c", "host", "--tls", "--tls-min-version", "1.4"}, "unknown TLS version"},
+		{[]string{"-c", "host", "--tls", "--tls-ciphers", "TLS_AES_128_GCM_SHA256"}, "cannot be chosen"},
+		{[]string{"-s", "--tls", "--tls-cert", "cert.pem"}, "must be given together"},
+		{[]string{"-c", "host", "--username", "mario"}, "must be given together"},
+		{[]string{"-s", "--use-pkcs1-padding"}, "require --rsa-private-key-path"},
+		{[]string{"-s", "--allow", "10.0.0.0/33"}, "invalid network"},
+		{[]string{"-c", "host", "--deny", "10.0.0.0/8"}, "only valid in server mode"},
+		{[]string{"-s", "--acl-file", "/nonexistent/acl"}, "option '--acl-file'"},
+		{[]string{"-s", "--server-bitrate-limit", "100M/0"}, "invalid averaging interval"},
+		{[]string{"-s", "--server-max-parallel", "0"}, "out of range"},
+		{[]string{"-s", "--queue-length", "4"}, "requires --max-tests"},
+		{[]string{"-s", "--retry", "60"}, "only valid in client mode"},
+		{[]string{"-c", "host", "--cntl-ka=30/5/3/1"}, "invalid keepalive settings"},
+		{[]string{"-c", "host", "--cntl-ka=x"}, "invalid keepalive settings"},
+		{[]string{"-c", "host", "--sctp", "--cntl-ka"}, "requires TCP or UDP"},
+		{[]string{"-s", "--cntl-ka"}, "only valid in client mode"},
+		{[]string{"-c", "host", "--peer-timeout", "1"}, "out of range"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%v) error = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var buf bytes.Buffer
+	Usage(&buf)
+	out := buf.String()
+
+	for _, want := range []string{"Server specific:", "-c, --client <host>", "    --get-server-output"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("usage missing %q", want)
+		}
+	}
+	if strings.Contains(out, "--zerocopy") {
+		t.Error("usage should not list unsupported options")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	serverErr := func(code protocol.ErrorCode, retryable bool) error {
+		return fmt.Errorf("failed to read test start ack: %w", &client.ServerError{
+			ErrorMessage: protocol.ErrorMessage{Code: code, Message: "the server is busy running a test", Retryable: retryable},
+		})
+	}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("connection refused"), ExitFailure},
+		{fmt.Errorf("%w: interrupt", client.ErrInterrupted), ExitFailure},
+		{serverErr(protocol.ErrorCodeBusy, false), ExitBusy},
+		{serverErr(protocol.ErrorCodeAborted, true), ExitBusy},
+		{serverErr(protocol.ErrorCodeAccessDenied, false), ExitAccessDenied},
+		{serverErr(protocol.ErrorCodeInvalidParameter, false), ExitInvalidParameter},
+		{serverErr("", false), ExitServerError},
+	}
+	for _, tt := range tests {
+		if got := ExitStatus(tt.err); got != tt.want {
+			t.Errorf("ExitStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+
+	if text := ServerErrorText(serverErr(protocol.ErrorCodeBusy, true)); !strings.HasSuffix(text, "the server is busy running a test; try again later") {
+		t.Errorf("unexpected text %q", text)
+	}
+	if text := ServerErrorText(errors.New("connection refused")); text != "" {
+		t.Errorf("unexpected text %q for a local error", text)
+	}
+}
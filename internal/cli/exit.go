@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"iperf3-go/internal/client"
+	"iperf3-go/internal/protocol"
+)
+
+// Exit statuses of the command. As in iperf3, failures exit with 1, but
+// errors reported by the server get their own statuses so that scripts can
+// tell a busy server from a refused test.
+const (
+	ExitFailure          = 1
+	ExitServerError      = 2
+	ExitBusy             = 3
+	ExitAccessDenied     = 4
+	ExitInvalidParameter = 5
+)
+
+// ExitStatus returns the exit status for a client failure
+func ExitStatus(err error) int {
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) {
+		return ExitFailure
+	}
+	switch {
+	case serverErr.Code == protocol.ErrorCodeBusy || serverErr.Retryable:
+		return ExitBusy
+	case serverErr.Code == protocol.ErrorCodeAccessDenied:
+		return ExitAccessDenied
+	case serverErr.Code == protocol.ErrorCodeInvalidParameter:
+		return ExitInvalidParameter
+	}
+	return ExitServerError
+}
+
+// ServerErrorText describes an error reported by the server for the user,
+// or returns "" if err is not one
+func ServerErrorText(err error) string {
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) {
+		return ""
+	}
+
+	text := fmt.Sprintf("%s: error - the server refused the test: %s", ProgramName, serverErr.Message)
+	if code := strings.ReplaceAll(string(serverErr.Code), "_", " "); code != "" && !strings.Contains(serverErr.Message, code) {
+		text += fmt.Sprintf(" (%s)", code)
+	}
+	if serverErr.Retryable || serverErr.Code == protocol.ErrorCodeBusy {
+		text += "; try again later"
+	}
+	return text
+}
@@ -0,0 +1,213 @@
+// Package cli implements iperf3's command line: GNU getopt_long style
+// parsing of short and long options, and the iperf3 option table.
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ArgKind says whether an option takes an argument
+type ArgKind int
+
+const (
+	NoArgument ArgKind = iota
+	RequiredArgument
+	// OptionalArgument options only take an argument in the --name=value
+	// form, as with getopt_long
+	OptionalArgument
+)
+
+// Role restricts an option to one side of the test
+type Role int
+
+const (
+	Common Role = iota
+	ServerOnly
+	ClientOnly
+)
+
+// Option describes a command line option
+type Option struct {
+	Long  string
+	Short byte
+	Arg   ArgKind
+	// ArgName is shown in the usage text, e.g. "#" or "<host>"
+	ArgName string
+	Role    Role
+	Usage   string
+	// Unsupported options are recognised, so they are not reported as
+	// unknown, but rejected when used
+	Unsupported bool
+}
+
+// name returns the option as the user would write it
+func (o *Option) name() string {
+	if o.Long != "" {
+		return "--" + o.Long
+	}
+	return "-" + string(o.Short)
+}
+
+// Value is an option found on the command line
+type Value struct {
+	Option *Option
+	Arg    string
+	// HasArg distinguishes "--opt=" from "--opt" for optional arguments
+	HasArg bool
+}
+
+// Set holds the result of parsing a command line
+type Set struct {
+	// Values are the options in command line order
+	Values []Value
+	// Args are the remaining non-option arguments
+	Args []string
+}
+
+// Lookup returns the last occurrence of the option with the given long name
+func (s *Set) Lookup(long string) (Value, bool) {
+	for i := len(s.Values) - 1; i >= 0; i-- {
+		if s.Values[i].Option.Long == long {
+			return s.Values[i], true
+		}
+	}
+	return Value{}, false
+}
+
+// Has reports whether the option with the given long name was given
+func (s *Set) Has(long string) bool {
+	_, ok := s.Lookup(long)
+	return ok
+}
+
+// Getopt parses args (without the program name) against options. Short
+// options may be clustered ("-uR") and take their argument attached
+// ("-p5201") or as the next word; long options take "--name=value" or
+// "--name value" and may be abbreviated to any unique prefix. "--" ends
+// option parsing.
+func Getopt(options []Option, args []string) (*Set, error) {
+	set := &Set{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--":
+			set.Args = append(set.Args, args[i+1:]...)
+			return set, nil
+
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			opt, err := lookupLong(options, name)
+			if err != nil {
+				return nil, err
+			}
+
+			v := Value{Option: opt, Arg: value, HasArg: hasValue}
+			switch opt.Arg {
+			case NoArgument:
+				if hasValue {
+					return nil, fmt.Errorf("option '--%s' doesn't allow an argument", opt.Long)
+				}
+			case RequiredArgument:
+				if !hasValue {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("option '--%s' requires an argument", opt.Long)
+					}
+					i++
+					v.Arg, v.HasArg = args[i], true
+				}
+			}
+			set.Values = append(set.Values, v)
+
+		case len(arg) > 1 && arg[0] == '-':
+			for j := 1; j < len(arg); j++ {
+				opt := lookupShort(options, arg[j])
+				if opt == nil {
+					return nil, fmt.Errorf("invalid option -- '%c'", arg[j])
+				}
+
+				if opt.Arg == NoArgument {
+					set.Values = append(set.Values, Value{Option: opt})
+					continue
+				}
+
+				// The rest of the word is the argument; a required one may
+				// also be the next word
+				v := Value{Option: opt}
+				if j+1 < len(arg) {
+					v.Arg, v.HasArg = arg[j+1:], true
+				} else if opt.Arg == RequiredArgument {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("option requires an argument -- '%c'", opt.Short)
+					}
+					i++
+					v.Arg, v.HasArg = args[i], true
+				}
+				set.Values = append(set.Values, v)
+				break
+			}
+
+		default:
+			set.Args = append(set.Args, arg)
+		}
+	}
+
+	return set, nil
+}
+
+// flags returns the option's spelling for the usage text
+func (o *Option) flags() string {
+	s := "    "
+	if o.Short != 0 {
+		s = "-" + string(o.Short) + ", "
+	}
+	if o.Long != "" {
+		s += "--" + o.Long
+	}
+	if o.ArgName != "" {
+		if o.Arg == OptionalArgument {
+			s += "[=" + o.ArgName + "]"
+		} else {
+			s += " " + o.ArgName
+		}
+	}
+	return s
+}
+
+// lookupLong finds a long option by exact name or unique prefix
+func lookupLong(options []Option, name string) (*Option, error) {
+	var match *Option
+	var candidates []string
+
+	for i := range options {
+		opt := &options[i]
+		if opt.Long == "" || !strings.HasPrefix(opt.Long, name) || name == "" {
+			continue
+		}
+		if opt.Long == name {
+			return opt, nil
+		}
+		match = opt
+		candidates = append(candidates, "'--"+opt.Long+"'")
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("unrecognized option '--%s'", name)
+	case 1:
+		return match, nil
+	}
+	return nil, fmt.Errorf("option '--%s' is ambiguous; possibilities: %s", name, strings.Join(candidates, " "))
+}
+
+// lookupShort finds an option by its short letter
+func lookupShort(options []Option, c byte) *Option {
+	for i := range options {
+		if options[i].Short == c {
+			return &options[i]
+		}
+	}
+	return nil
+}
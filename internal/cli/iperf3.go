@@ -0,0 +1,612 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"iperf3-go/internal/acl"
+	"iperf3-go/internal/auth"
+	"iperf3-go/internal/client"
+	"iperf3-go/internal/server"
+	"iperf3-go/internal/stream"
+	"iperf3-go/internal/units"
+)
+
+// ProgramName is the name used in usage and error messages
+const ProgramName = "iperf3-go"
+
+// Options is iperf3's option set. Options iperf3-go does not implement yet
+// are listed as unsupported so they are rejected with a clear message
+// rather than as unknown.
+var Options = []Option{
+	// Server or client
+	{Long: "port", Short: 'p', Arg: RequiredArgument, ArgName: "#", Usage: "server port to listen on/connect to"},
+	{Long: "format", Short: 'f', Arg: RequiredArgument, ArgName: "[kmgtKMGT]", Usage: "format to report: Kbits, Mbits, Gbits, Tbits"},
+	{Long: "interval", Short: 'i', Arg: RequiredArgument, ArgName: "#", Unsupported: true},
+	{Long: "pidfile", Short: 'I', Arg: RequiredArgument, ArgName: "file", Unsupported: true},
+	{Long: "file", Short: 'F', Arg: RequiredArgument, ArgName: "name", Unsupported: true},
+	{Long: "affinity", Short: 'A', Arg: RequiredArgument, ArgName: "n[,m]", Unsupported: true},
+	{Long: "bind", Short: 'B', Arg: RequiredArgument, ArgName: "<host>", Usage: "bind to the interface associated with the address <host>"},
+	{Long: "bind-dev", Arg: RequiredArgument, ArgName: "<dev>", Unsupported: true},
+	{Long: "udp", Short: 'u', Usage: "use UDP rather than TCP"},
+	{Long: "sctp", Usage: "use SCTP rather than TCP"},
+	{Long: "unix", Usage: "use Unix domain stream sockets (socket path in -c or -B)"},
+	{Long: "unixpacket", Usage: "use Unix domain seqpacket sockets (socket path in -c or -B)"},
+	{Long: "quic", Usage: "use QUIC rather than TCP"},
+	{Long: "xbind", Short: 'X', Arg: RequiredArgument, ArgName: "<name>", Usage: "bind SCTP association to links"},
+	{Long: "mptcp", Short: 'm', Usage: "use MPTCP rather than plain TCP"},
+	{Long: "tls", Usage: "wrap the control connection and data streams in TLS"},
+	{Long: "tls-cert", Arg: RequiredArgument, ArgName: "<file>", Usage: "PEM certificate to present (default: self-signed on the server)"},
+	{Long: "tls-key", Arg: RequiredArgument, ArgName: "<file>", Usage: "PEM private key of --tls-cert"},
+	{Long: "tls-ca", Arg: RequiredArgument, ArgName: "<file>", Usage: "PEM CA certificates to verify the peer with"},
+	{Long: "tls-ciphers", Arg: RequiredArgument, ArgName: "<list>", Usage: "comma-separated TLS 1.2 cipher suites to allow"},
+	{Long: "tls-min-version", Arg: RequiredArgument, ArgName: "<ver>", Usage: "oldest TLS version to allow (1.0, 1.1, 1.2 or 1.3)"},
+	{Long: "tls-max-version", Arg: RequiredArgument, ArgName: "<ver>", Usage: "newest TLS version to allow (1.0, 1.1, 1.2 or 1.3)"},
+	{Long: "verbose", Short: 'V', Usage: "more detailed output"},
+	{Long: "json", Short: 'J', Usage: "output in JSON format"},
+	{Long: "json-stream", Usage: "output in line-delimited JSON format"},
+	{Long: "output-format", Arg: RequiredArgument, ArgName: "<fmt>", Usage: "report format: text, json, json-stream, csv or influx"},
+	{Long: "logfile", Arg: RequiredArgument, ArgName: "f", Unsupported: true},
+	{Long: "forceflush", Unsupported: true},
+	{Long: "timestamps", Arg: OptionalArgument, ArgName: "<format>", Unsupported: true},
+	{Long: "rcv-timeout", Arg: RequiredArgument, ArgName: "#", Unsupported: true},
+	{Long: "snd-timeout", Arg: RequiredArgument, ArgName: "#", Unsupported: true},
+	{Long: "peer-timeout", Arg: RequiredArgument, ArgName: "#", Usage: "seconds without word from the peer before aborting the test (default 10, 0 to never)"},
+	{Long: "debug", Short: 'd', Unsupported: true},
+	{Long: "version", Short: 'v', Usage: "show version information and quit"},
+	{Long: "help", Short: 'h', Usage: "show this message and quit"},
+
+	// Server specific
+	{Long: "server", Short: 's', Role: ServerOnly, Usage: "run in server mode"},
+	{Long: "daemon", Short: 'D', Role: ServerOnly, Usage: "run the server as a daemon"},
+	{Long: "one-off", Short: '1', Role: ServerOnly, Usage: "handle one client connection then exit"},
+	{Long: "server-bitrate-limit", Arg: RequiredArgument, ArgName: "#[KMG][/#]", Role: ServerOnly, Usage: "server's total bit rate limit, averaged over /# seconds (default 5)"},
+	{Long: "server-max-duration", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Usage: "longest test in seconds a client may run (default no limit)"},
+	{Long: "server-max-parallel", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Usage: "most parallel streams a test may use (default no limit)"},
+	{Long: "server-max-length", Arg: RequiredArgument, ArgName: "#[KMG]", Role: ServerOnly, Usage: "largest block length a test may use (default no limit)"},
+	{Long: "max-tests", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Usage: "most tests to run at once, refusing others as busy (default no limit)"},
+	{Long: "queue-length", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Usage: "tests over --max-tests to queue rather than refuse"},
+	{Long: "idle-timeout", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Unsupported: true},
+	{Long: "rsa-private-key-path", Arg: RequiredArgument, ArgName: "<path>", Role: ServerOnly, Usage: "path to the RSA private key used to decrypt authentication credentials"},
+	{Long: "authorized-users-path", Arg: RequiredArgument, ArgName: "<path>", Role: ServerOnly, Usage: "path to the configuration file containing user credentials"},
+	{Long: "time-skew-threshold", Arg: RequiredArgument, ArgName: "#", Role: ServerOnly, Usage: "time skew threshold (in seconds) between the server and client during the authentication process"},
+	{Long: "use-pkcs1-padding", Role: ServerOnly, Usage: "use PKCS #1 v1.5 padding to decrypt authentication credentials"},
+	{Long: "allow", Arg: RequiredArgument, ArgName: "<cidr>", Role: ServerOnly, Usage: "only accept tests from this network (repeatable)"},
+	{Long: "deny", Arg: RequiredArgument, ArgName: "<cidr>", Role: ServerOnly, Usage: "reject tests from this network (repeatable)"},
+	{Long: "acl-file", Arg: RequiredArgument, ArgName: "<path>", Role: ServerOnly, Usage: "file of allow/deny rules, reloaded on SIGHUP"},
+
+	// Client specific
+	{Long: "client", Short: 'c', Arg: RequiredArgument, ArgName: "<host>", Role: ClientOnly, Usage: "run in client mode, connecting to <host>"},
+	{Long: "nstreams", Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Usage: "number of SCTP or QUIC streams"},
+	{Long: "connect-timeout", Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Unsupported: true},
+	{Long: "bitrate", Short: 'b', Arg: RequiredArgument, ArgName: "#[KMG][/#]", Role: ClientOnly, Usage: "target bitrate in bits/sec (0 for unlimited, default 1 Mbit/sec for UDP, unlimited for TCP), optional slash and packet count for burst mode"},
+	{Long: "bandwidth", Arg: RequiredArgument, ArgName: "#[KMG][/#]", Role: ClientOnly},
+	{Long: "pacing-timer", Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Unsupported: true},
+	{Long: "fq-rate", Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Unsupported: true},
+	{Long: "time", Short: 't', Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Usage: "time in seconds to transmit for (default 10 secs)"},
+	{Long: "bytes", Short: 'n', Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Unsupported: true},
+	{Long: "blockcount", Short: 'k', Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Unsupported: true},
+	{Long: "length", Short: 'l', Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Usage: "length of buffer to read or write (default 128 KB for TCP, 1460 for UDP)"},
+	{Long: "cport", Arg: RequiredArgument, ArgName: "<port>", Role: ClientOnly, Unsupported: true},
+	{Long: "parallel", Short: 'P', Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Usage: "number of parallel client streams to run"},
+	{Long: "reverse", Short: 'R', Role: ClientOnly, Usage: "run in reverse mode (server sends, client receives)"},
+	{Long: "bidir", Role: ClientOnly, Usage: "run in bidirectional mode (client and server send and receive data)"},
+	{Long: "window", Short: 'w', Arg: RequiredArgument, ArgName: "#[KMG]", Role: ClientOnly, Usage: "set send/receive socket buffer sizes"},
+	{Long: "congestion", Short: 'C', Arg: RequiredArgument, ArgName: "<algo>", Role: ClientOnly, Unsupported: true},
+	{Long: "set-mss", Short: 'M', Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Usage: "set TCP/SCTP maximum segment size"},
+	{Long: "no-delay", Short: 'N', Role: ClientOnly, Usage: "set TCP/SCTP no delay, disabling Nagle's Algorithm"},
+	{Long: "version4", Short: '4', Role: ClientOnly, Unsupported: true},
+	{Long: "version6", Short: '6', Role: ClientOnly, Unsupported: true},
+	{Long: "tos", Short: 'S', Arg: RequiredArgument, ArgName: "N", Role: ClientOnly, Unsupported: true},
+	{Long: "dscp", Arg: RequiredArgument, ArgName: "N", Role: ClientOnly, Unsupported: true},
+	{Long: "flowlabel", Short: 'L', Arg: RequiredArgument, ArgName: "N", Role: ClientOnly, Unsupported: true},
+	{Long: "zerocopy", Short: 'Z', Role: ClientOnly, Unsupported: true},
+	{Long: "skip-rx-copy", Role: ClientOnly, Unsupported: true},
+	{Long: "omit", Short: 'O', Arg: RequiredArgument, ArgName: "N", Role: ClientOnly, Unsupported: true},
+	{Long: "title", Short: 'T', Arg: RequiredArgument, ArgName: "<str>", Role: ClientOnly, Usage: "prefix every output line with this string"},
+	{Long: "extra-data", Arg: RequiredArgument, ArgName: "<str>", Role: ClientOnly, Usage: "data string to include in client and server JSON"},
+	{Long: "retry", Arg: RequiredArgument, ArgName: "#", Role: ClientOnly, Usage: "keep retrying a busy server, with backoff, for up to # seconds"},
+	{Long: "get-server-output", Role: ClientOnly, Usage: "get results from server"},
+	{Long: "udp-counters-64bit", Role: ClientOnly, Unsupported: true},
+	{Long: "repeating-payload", Role: ClientOnly, Unsupported: true},
+	{Long: "dont-fragment", Role: ClientOnly, Unsupported: true},
+	{Long: "username", Arg: RequiredArgument, ArgName: "<username>", Role: ClientOnly, Usage: "username for authentication"},
+	{Long: "rsa-public-key-path", Arg: RequiredArgument, ArgName: "<path>", Role: ClientOnly, Usage: "path to the RSA public key used to encrypt authentication credentials"},
+	{Long: "cntl-ka", Arg: OptionalArgument, ArgName: "#/#/#", Role: ClientOnly, Usage: "use TCP keepalive on the control connection: idle secs/probe interval secs/probe count"},
+}
+
+// Default values for the client, as in iperf3
+const (
+	defaultPort = 5201
+	defaultTime = 10
+	maxMSS      = 9 * 1024
+)
+
+// sctpOptions only apply to SCTP tests
+var sctpOptions = []string{"xbind"}
+
+// requireSCTP rejects SCTP options given for another protocol
+func requireSCTP(set *Set, protocol string) error {
+	if protocol == "sctp" {
+		return nil
+	}
+	for _, name := range sctpOptions {
+		if set.Has(name) {
+			return fmt.Errorf("option '--%s' requires --sctp", name)
+		}
+	}
+	return nil
+}
+
+// requireStreams rejects --nstreams for protocols without multiple streams
+// per connection
+func requireStreams(set *Set, protocol string) error {
+	if set.Has("nstreams") && protocol != "sctp" && protocol != "quic" {
+		return fmt.Errorf("option '--nstreams' requires --sctp or --quic")
+	}
+	return nil
+}
+
+// isUnix reports whether protocol is one of the Unix domain socket transports
+func isUnix(protocol string) bool {
+	return protocol == "unix" || protocol == "unixpacket"
+}
+
+// segmentOptions only apply to TCP and SCTP tests
+var segmentOptions = []string{"set-mss", "no-delay"}
+
+// requireTCP rejects --mptcp for protocols other than TCP, and the segment
+// options for protocols other than TCP and SCTP
+func requireTCP(set *Set, protocol string) error {
+	if set.Has("mptcp") && protocol != "tcp" {
+		return fmt.Errorf("option '--mptcp' requires TCP")
+	}
+	if protocol == "tcp" || protocol == "sctp" {
+		return nil
+	}
+	for _, name := range segmentOptions {
+		if set.Has(name) {
+			return fmt.Errorf("option '--%s' requires TCP or SCTP", name)
+		}
+	}
+	return nil
+}
+
+// Config is the outcome of parsing an iperf3 command line: help or version
+// requests, or the configuration for exactly one of client and server
+type Config struct {
+	Help    bool
+	Version bool
+	Client  *client.Config
+	Server  *server.Config
+}
+
+// Parse parses an iperf3 command line (without the program name)
+func Parse(args []string) (*Config, error) {
+	set, err := Getopt(Options, args)
+	if err != nil {
+		return nil, err
+	}
+	return build(set)
+}
+
+// build validates the parsed options and turns them into a Config
+func build(set *Set) (*Config, error) {
+	cfg := &Config{Help: set.Has("help"), Version: set.Has("version")}
+	if cfg.Help || cfg.Version {
+		return cfg, nil
+	}
+
+	if len(set.Args) > 0 {
+		return nil, fmt.Errorf("unexpected argument '%s'", set.Args[0])
+	}
+
+	var role Role
+	switch {
+	case set.Has("client") && set.Has("server"):
+		return nil, fmt.Errorf("cannot be both server and client")
+	case set.Has("client"):
+		role = ClientOnly
+	case set.Has("server"):
+		role = ServerOnly
+	default:
+		return nil, fmt.Errorf("must either be a client (-c) or server (-s)")
+	}
+
+	for _, v := range set.Values {
+		opt := v.Option
+		if opt.Role != Common && opt.Role != role {
+			mode := "client"
+			if opt.Role == ServerOnly {
+				mode = "server"
+			}
+			return nil, fmt.Errorf("option '%s' is only valid in %s mode", opt.name(), mode)
+		}
+		if opt.Unsupported {
+			return nil, fmt.Errorf("option '%s' is not supported by %s", opt.name(), ProgramName)
+		}
+	}
+
+	var err error
+	if role == ClientOnly {
+		cfg.Client, err = buildClient(set)
+	} else {
+		cfg.Server, err = buildServer(set)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// buildClient applies the options, in command line order, to a client config
+func buildClient(set *Set) (*client.Config, error) {
+	c := &client.Config{
+		Port:     defaultPort,
+		Time:     defaultTime,
+		Parallel: 1,
+		Protocol: "tcp",
+	}
+
+	for _, v := range set.Values {
+		var err error
+		switch v.Option.Long {
+		case "port":
+			c.Port, err = intArg(v, 1, 65535)
+		case "format":
+			c.Units, err = unitArg(v)
+		case "bind":
+			c.Bind = v.Arg
+		case "xbind":
+			c.XBind = append(c.XBind, v.Arg)
+		case "mptcp":
+			c.MPTCP = true
+		case "verbose":
+			c.Verbose = true
+		case "json":
+			c.JSON = true
+		case "json-stream":
+			c.JSONStream = true
+		case "output-format":
+			c.Format = v.Arg
+		case "client":
+			c.Host = v.Arg
+		case "udp", "sctp", "unix", "unixpacket", "quic":
+			// The option is named after the transport
+			c.Protocol = v.Option.Long
+		case "bitrate", "bandwidth":
+			c.Bandwidth, c.Burst, err = units.ParseRateBurst(v.Arg)
+		case "time":
+			c.Time, err = intArg(v, 1, 86400)
+		case "length":
+			c.Length, err = sizeArg(v)
+		case "parallel":
+			c.Parallel, err = intArg(v, 1, 128)
+		case "reverse":
+			c.Reverse = true
+		case "bidir":
+			c.Bidir = true
+		case "window":
+			c.Window, err = sizeArg(v)
+		case "title":
+			c.Title = v.Arg
+		case "extra-data":
+			c.ExtraData = v.Arg
+		case "retry":
+			var secs int
+			secs, err = intArg(v, 1, 86400)
+			c.Retry = time.Duration(secs) * time.Second
+		case "cntl-ka":
+			c.KeepAlive, err = keepAliveArg(v)
+		case "peer-timeout":
+			c.PeerTimeout, err = peerTimeoutArg(v)
+		case "get-server-output":
+			c.GetServerOutput = true
+		case "nstreams":
+			c.NStreams, err = intArg(v, 1, 65535)
+		case "set-mss":
+			c.MSS, err = intArg(v, 1, maxMSS)
+		case "no-delay":
+			c.NoDelay = true
+		case "username":
+			c.Username = v.Arg
+		case "rsa-public-key-path":
+			c.RSAPublicKey, err = auth.LoadPublicKey(v.Arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("option '%s': %w", v.Option.name(), err)
+		}
+	}
+
+	if c.Reverse && c.Bidir {
+		return nil, fmt.Errorf("options '--reverse' and '--bidir' cannot be used together")
+	}
+	if err := requireSCTP(set, c.Protocol); err != nil {
+		return nil, err
+	}
+	if err := requireTCP(set, c.Protocol); err != nil {
+		return nil, err
+	}
+	if err := requireStreams(set, c.Protocol); err != nil {
+		return nil, err
+	}
+	tlsConf, err := tlsConfig(set, c.Protocol, ClientOnly)
+	if err != nil {
+		return nil, err
+	}
+	c.TLS = tlsConf
+	if set.Has("username") != set.Has("rsa-public-key-path") {
+		return nil, fmt.Errorf("options '--username' and '--rsa-public-key-path' must be given together")
+	}
+	if c.Username != "" {
+		// Without the variable, the password is asked for (see Password)
+		c.Password = os.Getenv(PasswordEnv)
+	}
+	if set.Has("cntl-ka") && c.Protocol != "tcp" && c.Protocol != "udp" {
+		// Only TCP and UDP tests have a TCP control connection
+		return nil, fmt.Errorf("option '--cntl-ka' requires TCP or UDP")
+	}
+	if strings.Contains(c.Host, "/") && c.Protocol != "sctp" && !isUnix(c.Protocol) {
+		return nil, fmt.Errorf("multiple server addresses require --sctp")
+	}
+
+	if c.Length == 0 {
+		c.Length = stream.DefaultLength(c.Protocol)
+	}
+	if !set.Has("bitrate") && !set.Has("bandwidth") {
+		c.Bandwidth = stream.DefaultBitrate(c.Protocol)
+	}
+
+	return c, nil
+}
+
+// buildServer applies the options, in command line order, to a server config
+func buildServer(set *Set) (*server.Config, error) {
+	s := &server.Config{
+		Port:     defaultPort,
+		Protocol: "tcp",
+	}
+
+	var jsonOutput, jsonStream bool
+	authenticator := &auth.Authenticator{}
+	for _, v := range set.Values {
+		var err error
+		switch v.Option.Long {
+		case "port":
+			s.Port, err = intArg(v, 1, 65535)
+		case "format":
+			s.Units, err = unitArg(v)
+		case "bind":
+			s.Bind = v.Arg
+		case "xbind":
+			s.XBind = append(s.XBind, v.Arg)
+		case "mptcp":
+			s.MPTCP = true
+		case "verbose":
+			s.Verbose = true
+		case "json":
+			jsonOutput = true
+		case "json-stream":
+			jsonStream = true
+		case "output-format":
+			s.Format = v.Arg
+		case "udp", "sctp", "unix", "unixpacket", "quic":
+			// The option is named after the transport
+			s.Protocol = v.Option.Long
+		case "daemon":
+			s.Daemon = true
+		case "one-off":
+			s.OneOff = true
+		case "rsa-private-key-path":
+			authenticator.Key, err = auth.LoadPrivateKey(v.Arg)
+		case "authorized-users-path":
+			authenticator.UsersPath = v.Arg
+			_, err = auth.LoadUsers(v.Arg)
+		case "time-skew-threshold":
+			var secs int
+			secs, err = intArg(v, 1, 86400)
+			authenticator.SkewThreshold = time.Duration(secs) * time.Second
+		case "use-pkcs1-padding":
+			authenticator.PKCS1 = true
+		case "allow", "deny":
+			var p netip.Prefix
+			p, err = acl.ParsePrefix(v.Arg)
+			if v.Option.Long == "allow" {
+				s.Allow = append(s.Allow, p)
+			} else {
+				s.Deny = append(s.Deny, p)
+			}
+		case "acl-file":
+			s.ACLFile = v.Arg
+			_, err = acl.Load(v.Arg)
+		case "server-bitrate-limit":
+			s.Limits.Bitrate, s.Limits.BitrateInterval, err = bitrateLimitArg(v)
+		case "server-max-duration":
+			var secs int
+			secs, err = intArg(v, 1, 86400)
+			s.Limits.Duration = time.Duration(secs) * time.Second
+		case "server-max-parallel":
+			s.Limits.Parallel, err = intArg(v, 1, 128)
+		case "server-max-length":
+			s.Limits.Length, err = sizeArg(v)
+		case "max-tests":
+			s.MaxTests, err = intArg(v, 1, 1024)
+		case "queue-length":
+			s.QueueLength, err = intArg(v, 1, 65536)
+		case "peer-timeout":
+			s.PeerTimeout, err = peerTimeoutArg(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("option '%s': %w", v.Option.name(), err)
+		}
+	}
+
+	if err := requireSCTP(set, s.Protocol); err != nil {
+		return nil, err
+	}
+	if err := requireTCP(set, s.Protocol); err != nil {
+		return nil, err
+	}
+	tlsConf, err := tlsConfig(set, s.Protocol, ServerOnly)
+	if err != nil {
+		return nil, err
+	}
+	s.TLS = tlsConf
+	if authenticator.Key != nil || authenticator.UsersPath != "" {
+		if authenticator.Key == nil || authenticator.UsersPath == "" {
+			return nil, fmt.Errorf("options '--rsa-private-key-path' and '--authorized-users-path' must be given together")
+		}
+		s.Auth = authenticator
+	} else if set.Has("time-skew-threshold") || set.Has("use-pkcs1-padding") {
+		return nil, fmt.Errorf("authentication options require --rsa-private-key-path and --authorized-users-path")
+	}
+	if isUnix(s.Protocol) && s.Bind == "" {
+		return nil, fmt.Errorf("option '--%s' requires a socket path given with -B", s.Protocol)
+	}
+	if s.QueueLength > 0 && s.MaxTests == 0 {
+		return nil, fmt.Errorf("option '--queue-length' requires --max-tests")
+	}
+
+	// -J and --json-stream take precedence over --output-format
+	if jsonStream {
+		s.Format = "json-stream"
+	} else if jsonOutput {
+		s.Format = "json"
+	}
+
+	return s, nil
+}
+
+// intArg parses an integer argument within [lo, hi]
+func intArg(v Value, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(v.Arg)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number '%s'", v.Arg)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", n, lo, hi)
+	}
+	return n, nil
+}
+
+// sizeArg parses a byte count with an optional K/M/G/T suffix
+func sizeArg(v Value) (int, error) {
+	n, err := units.ParseSize(v.Arg)
+	if err != nil {
+		return 0, err
+	}
+	if n > int64(^uint32(0)>>1) {
+		return 0, fmt.Errorf("size %s too large", v.Arg)
+	}
+	return int(n), nil
+}
+
+// bitrateLimitArg parses iperf3's "rate[/secs]" form of
+// --server-bitrate-limit, where secs is the period the rate is averaged over
+func bitrateLimitArg(v Value) (int64, time.Duration, error) {
+	rateStr, secsStr, hasSecs := strings.Cut(v.Arg, "/")
+	rate, err := units.ParseRate(rateStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	var period time.Duration
+	if hasSecs {
+		secs, err := strconv.Atoi(secsStr)
+		if err != nil || secs <= 0 || secs > 3600 {
+			return 0, 0, fmt.Errorf("invalid averaging interval '%s'", secsStr)
+		}
+		period = time.Duration(secs) * time.Second
+	}
+	return rate, period, nil
+}
+
+// keepAliveArg parses the --cntl-ka idle/interval/count argument, where
+// missing values keep the system's defaults, as in iperf3
+func keepAliveArg(v Value) (net.KeepAliveConfig, error) {
+	ka := net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+	if v.Arg == "" {
+		return ka, nil
+	}
+	fields := strings.Split(v.Arg, "/")
+	if len(fields) > 3 {
+		return ka, fmt.Errorf("invalid keepalive settings '%s'", v.Arg)
+	}
+	values := []int{-1, -1, -1}
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 || n > 86400 {
+			return ka, fmt.Errorf("invalid keepalive settings '%s'", v.Arg)
+		}
+		values[i] = n
+	}
+	if values[0] > 0 {
+		ka.Idle = time.Duration(values[0]) * time.Second
+	}
+	if values[1] > 0 {
+		ka.Interval = time.Duration(values[1]) * time.Second
+	}
+	ka.Count = values[2]
+	return ka, nil
+}
+
+// peerTimeoutArg parses the --peer-timeout seconds, where 0 turns the
+// check off
+func peerTimeoutArg(v Value) (time.Duration, error) {
+	if v.Arg == "0" {
+		return -1, nil
+	}
+	// Heartbeats come every second, so anything shorter than two would
+	// abort healthy tests
+	secs, err := intArg(v, 2, 86400)
+	return time.Duration(secs) * time.Second, err
+}
+
+// unitArg parses the -f report unit
+func unitArg(v Value) (byte, error) {
+	if len(v.Arg) != 1 || !units.ValidFormat(v.Arg[0]) {
+		return 0, fmt.Errorf("invalid report format '%s'", v.Arg)
+	}
+	return v.Arg[0], nil
+}
+
+// Usage writes iperf3-style help listing the supported options
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [-s|-c host] [options]\n", ProgramName)
+	fmt.Fprintf(w, "       %s [-h|--help] [-v|--version]\n", ProgramName)
+
+	sections := []struct {
+		title string
+		role  Role
+	}{
+		{"Server or Client:", Common},
+		{"Server specific:", ServerOnly},
+		{"Client specific:", ClientOnly},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(w, "\n%s\n", section.title)
+		for i := range Options {
+			opt := &Options[i]
+			if opt.Role != section.role || opt.Unsupported || opt.Usage == "" {
+				continue
+			}
+			fmt.Fprintf(w, "  %-30s %s\n", opt.flags(), opt.Usage)
+		}
+	}
+
+	fmt.Fprintf(w, "\n[KMG] indicates options that support a K/M/G suffix for kilo-, mega-, or giga-\n")
+}
+
+// ShortUsage writes the brief usage shown after a parameter error
+func ShortUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [-s|-c host] [options]\n", ProgramName)
+	fmt.Fprintf(w, "Try `%s --help' for more information.\n", ProgramName)
+}
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// PasswordEnv is the environment variable the client's password is taken
+// from, as in iperf3
+const PasswordEnv = "IPERF3_PASSWORD"
+
+// Password asks for the client's password on in, without echoing it if in
+// is a terminal
+func Password(in *os.File, out io.Writer) (string, error) {
+	fmt.Fprint(out, "Password: ")
+	defer fmt.Fprintln(out)
+
+	if term.IsTerminal(int(in.Fd())) {
+		password, err := term.ReadPassword(int(in.Fd()))
+		if err != nil {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return string(password), nil
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
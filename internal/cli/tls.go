@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tlsVersions maps the --tls-min-version and --tls-max-version arguments to
+// TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the TLS configuration of a client or server from the
+// --tls options, or returns nil without --tls
+func tlsConfig(set *Set, protocol string, role Role) (*tls.Config, error) {
+	if !set.Has("tls") {
+		for _, v := range set.Values {
+			if strings.HasPrefix(v.Option.Long, "tls-") {
+				return nil, fmt.Errorf("option '--%s' requires --tls", v.Option.Long)
+			}
+		}
+		return nil, nil
+	}
+	switch {
+	case protocol == "udp" || protocol == "quic":
+		return nil, fmt.Errorf("option '--tls' requires a stream protocol: TCP, SCTP or Unix sockets")
+	case set.Has("nstreams"):
+		return nil, fmt.Errorf("option '--tls' cannot be used with --nstreams")
+	}
+
+	config := &tls.Config{}
+	if v, ok := set.Lookup("tls-min-version"); ok {
+		if config.MinVersion, ok = tlsVersions[v.Arg]; !ok {
+			return nil, fmt.Errorf("option '--tls-min-version': unknown TLS version '%s'", v.Arg)
+		}
+	}
+	if v, ok := set.Lookup("tls-max-version"); ok {
+		if config.MaxVersion, ok = tlsVersions[v.Arg]; !ok {
+			return nil, fmt.Errorf("option '--tls-max-version': unknown TLS version '%s'", v.Arg)
+		}
+	}
+	if config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("option '--tls-min-version' is newer than --tls-max-version")
+	}
+	if v, ok := set.Lookup("tls-ciphers"); ok {
+		suites, err := cipherSuites(v.Arg)
+		if err != nil {
+			return nil, fmt.Errorf("option '--tls-ciphers': %w", err)
+		}
+		config.CipherSuites = suites
+	}
+
+	cert, hasCert := set.Lookup("tls-cert")
+	key, hasKey := set.Lookup("tls-key")
+	if hasCert != hasKey {
+		return nil, fmt.Errorf("options '--tls-cert' and '--tls-key' must be given together")
+	}
+	if hasCert {
+		pair, err := tls.LoadX509KeyPair(cert.Arg, key.Arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	// The client verifies the server against --tls-ca, and skips
+	// verification without it; the server then requires client certificates
+	var pool *x509.CertPool
+	if v, ok := set.Lookup("tls-ca"); ok {
+		pem, err := os.ReadFile(v.Arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA certificates: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", v.Arg)
+		}
+	}
+	switch {
+	case role == ClientOnly && pool == nil:
+		config.InsecureSkipVerify = true
+	case role == ClientOnly:
+		config.RootCAs = pool
+	case pool != nil:
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// cipherSuites parses a comma-separated list of cipher suite names, as
+// named by the IANA, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func cipherSuites(list string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		suite, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		// Go always enables all the TLS 1.3 suites
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite '%s' cannot be chosen", suite.Name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
@@ -1,97 +1,305 @@
 package client
 
 import (
-	"encoding/binary"
+	"cmp"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"iperf3-go/internal/auth"
 	"iperf3-go/internal/protocol"
-
-	"github.com/ishidawataru/sctp"
+	"iperf3-go/internal/report"
+	"iperf3-go/internal/stream"
+	"iperf3-go/internal/sysstat"
+	"iperf3-go/internal/transport"
 )
 
 // Config holds client configuration
 type Config struct {
-	Host      string
-	Port      int
-	Time      int
-	Parallel  int
+	// Host is the server; for SCTP it may list several of the server's
+	// addresses as "host1/host2", and for Unix sockets it is the socket path
+	Host     string
+	Port     int
+	Time     int
+	Parallel int
+	// Reverse has the server send and the client receive, as with iperf3's
+	// -R; Bidir has data run both ways at once, over Parallel streams each
+	// way, as with --bidir. A test cannot be both.
 	Reverse   bool
+	Bidir     bool
 	JSON      bool
 	Verbose   bool
 	Window    int
 	Length    int
 	Bandwidth int64
 	Protocol  string
+	Title     string
+	ExtraData string
+	// Burst is the number of UDP packets sent back to back per pacing tick
+	Burst int
+	// Bind is the local address to send from, as with iperf3's -B
+	Bind string
+	// XBind lists further local addresses SCTP associations are bound to,
+	// as with iperf3's -X
+	XBind []string
+	// NoDelay disables Nagle's algorithm on TCP and SCTP streams, as with
+	// iperf3's -N
+	NoDelay bool
+	// MSS is the TCP or SCTP maximum segment size, as with iperf3's -M
+	MSS int
+	// MPTCP opens the TCP data streams with Multipath TCP, falling back to
+	// TCP if either end lacks it, as with iperf3's -m
+	MPTCP bool
+	// TLS, if set, wraps the control connection and data streams in TLS
+	// with this configuration; the server must use TLS too
+	TLS *tls.Config
+	// Username and Password authenticate the client to a server that
+	// requires it, encrypted with the server's RSAPublicKey, as with
+	// iperf3's --username and --rsa-public-key-path
+	Username     string
+	Password     string
+	RSAPublicKey *rsa.PublicKey
+	// NStreams is the number of SCTP or QUIC streams each data stream
+	// spreads its data over, as with iperf3's --nstreams
+	NStreams int
+	// Retry, if positive, is how long to keep trying again when the server
+	// refuses the test as busy, waiting longer after each attempt
+	Retry time.Duration
+	// KeepAlive, if enabled, tunes TCP keepalive on the control connection,
+	// as with iperf3's --cntl-ka; unset values keep the system's defaults
+	KeepAlive net.KeepAliveConfig
+	// PeerTimeout is how long the test goes without hearing from the server
+	// before it is taken for gone and the test aborted. The client sends
+	// heartbeats so that the server can do the same. Zero means 10 seconds;
+	// negative disables the check.
+	PeerTimeout time.Duration
+	// GetServerOutput asks the server to send back its own report at test end
+	GetServerOutput bool
+	// JSONStream emits one JSON object per line for each test event (implies JSON)
+	JSONStream bool
+	// Format names the report format ("text", "json", "json-stream", "csv"
+	// or a registered one); JSON and JSONStream take precedence
+	Format string
+	// Units is the -f unit for reported bitrates (see report.Options)
+	Units byte
+	// Reporter, if set, receives the test events instead of a built-in format
+	Reporter report.Reporter
+	// Dial, if set, opens the connections to the server, the control
+	// connection and each data stream, instead of the built-in dialers;
+	// network is "tcp", "udp", "sctp", "unix" or "unixpacket"; QUIC cannot use it
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Control, if set, is called on the built-in dialers' sockets before
+	// they connect, e.g. to set socket options
+	Control func(network, address string, c syscall.RawConn) error
 }
 
+// serverEndTimeout bounds how long the client waits for the server's results
+// once it has finished sending
+const serverEndTimeout = 5 * time.Second
+
+// streamDrainTimeout bounds the wait for the data still in flight from the
+// server once it has sent its results
+const streamDrainTimeout = time.Second
+
+// minPartialInterval is the shortest trailing interval reported when a test
+// is interrupted
+const minPartialInterval = 0.01
+
+// heartbeatInterval is how often the client tells the server it is still
+// there during the test; the server's interval reports do the same for it
+const heartbeatInterval = time.Second
+
+// defaultPeerTimeout is the PeerTimeout used when none is given
+const defaultPeerTimeout = 10 * time.Second
+
+// The wait before retrying a busy server starts at minRetryDelay and doubles
+// after each attempt up to maxRetryDelay, plus up to half as much again at
+// random so that clients turned away together do not all come back together
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// ErrInterrupted is returned, along with the partial results, when a test
+// ends before its configured duration
+var ErrInterrupted = errors.New("test interrupted")
+
 // Client represents an iperf3 client
 type Client struct {
 	config *Config
+	out    io.Writer
 }
 
 // New creates a new iperf3 client
 func New(config *Config) *Client {
 	return &Client{
 		config: config,
+		out:    os.Stdout,
 	}
 }
 
+// format returns the name of the configured report format
+func (c *Client) format() string {
+	switch {
+	case c.config.JSONStream:
+		return "json-stream"
+	case c.config.JSON:
+		return "json"
+	case c.config.Format == "":
+		return "text"
+	}
+	return c.config.Format
+}
+
+// newReporter returns the reporter selected by the configuration
+func (c *Client) newReporter() (report.Reporter, error) {
+	if c.config.Reporter != nil {
+		return c.config.Reporter, nil
+	}
+	return report.New(c.format(), c.out, report.Options{Units: c.config.Units, Title: c.config.Title})
+}
+
 // Run starts the iperf3 client test
-func (c *Client) Run() error {
-	if c.config.Verbose {
-		log.Printf("Connecting to host %s, port %d", c.config.Host, c.config.Port)
+func (c *Client) Run(ctx context.Context) error {
+	_, err := c.RunTest(ctx)
+	return err
+}
+
+// RunTest runs the test, reporting it as configured, and returns its
+// results. Cancelling ctx stops the test early: the elapsed portion is still
+// reported and returned, along with an error wrapping ErrInterrupted.
+func (c *Client) RunTest(ctx context.Context) (*protocol.TestResults, error) {
+	rep, err := c.newReporter()
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Reverse && c.config.Bidir {
+		err := errors.New("a test cannot be both reverse and bidirectional")
+		report.ReportError(rep, err)
+		return nil, err
 	}
 
-	// Determine protocol type
-	protocolType := c.config.Protocol
-	if protocolType == "" {
-		protocolType = "tcp"
+	results, err := c.run(ctx, rep)
+	giveUp := time.Now().Add(c.config.Retry)
+	for delay := minRetryDelay; results == nil && retryable(err); delay = min(2*delay, maxRetryDelay) {
+		wait := delay + rand.N(delay/2)
+		if time.Now().Add(wait).After(giveUp) {
+			break
+		}
+		report.ReportRetrying(rep, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			err = fmt.Errorf("test aborted: %w", ctx.Err())
+			report.ReportError(rep, err)
+			return nil, err
+		}
+		results, err = c.run(ctx, rep)
 	}
 
-	// Connect to server
-	addr := fmt.Sprintf("%s:%d", c.config.Host, c.config.Port)
-	var conn net.Conn
-	var err error
-
-	switch protocolType {
-	case "udp":
-		conn, err = net.Dial("udp", addr)
-	case "sctp":
-		conn, err = sctp.DialSCTP("sctp", nil, &sctp.SCTPAddr{
-			IPAddrs: []net.IPAddr{{IP: net.ParseIP(c.config.Host)}},
-			Port:    c.config.Port,
-		})
-	default: // tcp
-		conn, err = net.Dial("tcp", addr)
+	if err != nil && results == nil {
+		report.ReportError(rep, err)
+	}
+	return results, err
+}
+
+// retryable reports whether err is the server refusing a test that may run
+// if tried again later
+func retryable(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr) && serverErr.Retryable
+}
+
+// run connects to the server and runs the test
+func (c *Client) run(ctx context.Context, rep report.Reporter) (*protocol.TestResults, error) {
+	t, err := transport.Lookup(c.config.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.TLS != nil {
+		t = transport.WithTLS(t, c.config.TLS)
+	}
+
+	if c.config.Verbose {
+		log.Printf("Connecting to host %s, port %d", c.config.Host, c.config.Port)
 	}
 
+	// Connect to server
+	addr := net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+	opts := transport.DialOptions{
+		Bind:    c.config.Bind,
+		XBind:   c.config.XBind,
+		Control: c.config.Control,
+		Dial:    c.config.Dial,
+		Streams: c.config.NStreams,
+		MPTCP:   c.config.MPTCP,
+	}
+	controlOpts := opts
+	controlOpts.KeepAlive = c.config.KeepAlive
+	conn, err := t.DialControl(ctx, addr, controlOpts)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 	defer conn.Close()
 
+	// Cancelling the context aborts the handshake; the test itself is
+	// stopped gracefully by runTest
+	stopHandshake := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopHandshake()
+
 	if c.config.Verbose {
 		log.Printf("Connected to %s", conn.RemoteAddr())
 	}
 
 	// Send test configuration
 	testConfig := &protocol.TestConfig{
-		Protocol:  protocolType,
+		Protocol:  t.Name(),
 		Time:      c.config.Time,
 		Parallel:  c.config.Parallel,
 		Reverse:   c.config.Reverse,
+		Bidir:     c.config.Bidir,
 		Window:    c.config.Window,
-		Length:    c.config.Length,
+		Length:    c.length(),
 		Bandwidth: c.config.Bandwidth,
+		Burst:     c.config.Burst,
+		Title:     c.config.Title,
+		ExtraData: c.config.ExtraData,
+		NoDelay:   c.config.NoDelay,
+		MSS:       c.config.MSS,
+		MPTCP:     c.config.MPTCP,
+		Heartbeat: int(heartbeatInterval / time.Millisecond),
+
+		GetServerOutput: c.config.GetServerOutput,
+		JSON:            strings.HasPrefix(c.format(), "json"),
+	}
+	if c.config.Username != "" {
+		if c.config.RSAPublicKey == nil {
+			return nil, errors.New("authentication requires the server's RSA public key")
+		}
+		creds := auth.Credentials{Username: c.config.Username, Password: c.config.Password, Time: time.Now()}
+		testConfig.AuthToken, err = auth.Token(c.config.RSAPublicKey, creds)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	configData, err := json.Marshal(testConfig)
 	if err != nil {
-		return fmt.Errorf("failed to marshal test config: %w", err)
+		return nil, fmt.Errorf("failed to marshal test config: %w", err)
 	}
 
 	startMsg := &protocol.Message{
@@ -100,282 +308,623 @@ func (c *Client) Run() error {
 	}
 
 	if err := protocol.WriteMessage(conn, startMsg); err != nil {
-		return fmt.Errorf("failed to send test start: %w", err)
+		return nil, fmt.Errorf("failed to send test start: %w", err)
 	}
 
-	// Wait for acknowledgment
-	ackMsg, err := protocol.ReadMessage(conn)
+	// Wait for acknowledgment, which a busy server precedes with the test's
+	// place in its queue as it moves up
+	ackMsg, err := readReply(conn, protocol.MessageTypeTestStartAck, protocol.MessageTypeQueued)
+	for err == nil && ackMsg.Type == protocol.MessageTypeQueued {
+		var queued protocol.QueuePosition
+		if err := json.Unmarshal(ackMsg.Data, &queued); err != nil {
+			return nil, fmt.Errorf("failed to parse queue position: %w", err)
+		}
+		if c.config.Verbose {
+			log.Printf("Test queued at position %d", queued.Position)
+		}
+		report.ReportQueued(rep, queued.Position)
+		ackMsg, err = readReply(conn, protocol.MessageTypeTestStartAck, protocol.MessageTypeQueued)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read test start ack: %w", err)
+		return nil, fmt.Errorf("failed to read test start ack: %w", err)
+	}
+
+	var ack protocol.TestStartAck
+	if len(ackMsg.Data) > 0 {
+		if err := json.Unmarshal(ackMsg.Data, &ack); err != nil {
+			return nil, fmt.Errorf("failed to parse test start ack: %w", err)
+		}
+	}
+
+	// Open the data streams, then tell the server to start measuring
+	streams := make([]*stream.Stream, 0, testConfig.Streams())
+	defer func() {
+		for _, st := range streams {
+			st.Conn.Close()
+		}
+	}()
+	for id := 1; id <= cap(streams); id++ {
+		streamConn, err := c.openStream(ctx, t, addr, opts, ack.Cookie, id)
+		if err != nil {
+			// Tell the server the test is off rather than leave it waiting
+			sendError(conn, &protocol.ErrorMessage{Code: protocol.ErrorCodeInternal, Message: err.Error()})
+			return nil, err
+		}
+		reversed := testConfig.Reversed(id)
+		streams = append(streams, &stream.Stream{ID: id, Conn: streamConn, Sender: !reversed, Reverse: reversed})
 	}
 
-	if ackMsg.Type != protocol.MessageTypeTestStartAck {
-		return fmt.Errorf("unexpected message type: %d", ackMsg.Type)
+	running := &protocol.Message{Type: protocol.MessageTypeTestRunning}
+	if err := protocol.WriteMessage(conn, running); err != nil {
+		return nil, fmt.Errorf("failed to send test running: %w", err)
 	}
 
 	if c.config.Verbose {
 		log.Printf("Test started")
 	}
 
+	if !stopHandshake() {
+		return nil, fmt.Errorf("test aborted: %w", ctx.Err())
+	}
+
 	// Run the test
-	return c.runTest(conn, protocolType)
+	return c.runTest(ctx, t, conn, streams, ack.Cookie, rep)
+}
+
+// streamStartTimeout bounds the handshake on a new data stream, whose
+// first message may be lost on a datagram transport
+const streamStartTimeout = 5 * time.Second
+
+// openStream opens data stream id and attaches it to the test
+func (c *Client) openStream(ctx context.Context, t transport.Transport, addr string, opts transport.DialOptions, cookie string, id int) (net.Conn, error) {
+	conn, err := t.OpenStream(ctx, addr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream %d: %w", id, err)
+	}
+	sockOpts := transport.SocketOptions{Window: c.config.Window, NoDelay: c.config.NoDelay, MSS: c.config.MSS}
+	if err := t.SetOptions(conn, sockOpts); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set options on stream %d: %w", id, err)
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, streamStartTimeout)
+	defer cancel()
+	stop := context.AfterFunc(handshakeCtx, func() { conn.Close() })
+	defer stop()
+
+	start := &protocol.Message{
+		Type: protocol.MessageTypeStreamStart,
+		Data: mustMarshal(protocol.StreamStart{Cookie: cookie, ID: id}),
+	}
+	err = protocol.WriteMessage(conn, start)
+	if err == nil {
+		_, err = readReply(conn, protocol.MessageTypeStreamStartAck)
+	}
+	if !stop() {
+		err = handshakeCtx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start stream %d: %w", id, err)
+	}
+	return conn, nil
+}
+
+// readReply reads the server's reply, of one of the types in want, turning
+// an error message from the server into an error
+func readReply(conn net.Conn, want ...int) (*protocol.Message, error) {
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case slices.Contains(want, msg.Type):
+		return msg, nil
+	case msg.Type == protocol.MessageTypeError:
+		var errMsg protocol.ErrorMessage
+		if err := json.Unmarshal(msg.Data, &errMsg); err != nil {
+			return nil, fmt.Errorf("failed to parse server error: %w", err)
+		}
+		return nil, &ServerError{ErrorMessage: errMsg}
+	default:
+		return nil, fmt.Errorf("unexpected message type: %d", msg.Type)
+	}
+}
+
+// ServerError is an error the server replied with, e.g. on refusing a test
+// that goes over one of its limits or on stopping a test
+type ServerError struct {
+	protocol.ErrorMessage
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// sendError tells the server why the client is stopping or abandoning a test
+func sendError(conn net.Conn, errMsg *protocol.ErrorMessage) error {
+	msg := &protocol.Message{
+		Type: protocol.MessageTypeError,
+		Data: mustMarshal(errMsg),
+	}
+	if err := protocol.WriteMessage(conn, msg); err != nil {
+		return fmt.Errorf("failed to send error: %w", err)
+	}
+	return nil
 }
 
 // runTest runs the actual performance test
-func (c *Client) runTest(conn net.Conn, protocolType string) error {
+func (c *Client) runTest(ctx context.Context, t transport.Transport, conn net.Conn, streams []*stream.Stream, cookie string, rep report.Reporter) (*protocol.TestResults, error) {
 	duration := time.Duration(c.config.Time) * time.Second
 	if duration == 0 {
 		duration = 10 * time.Second // default
 	}
 
+	results := c.newResults(t, streams, cookie, duration)
+	cpuStart := sysstat.SampleCPU()
+	rep.Start(results)
+
 	startTime := time.Now()
-	var totalBytes int64
-	buffer := make([]byte, 128*1024) // 128KB buffer
 
-	// Fill buffer with test data
-	for i := range buffer {
-		buffer[i] = byte(i % 256)
-	}
+	// The server reports over the control connection while we send; if it
+	// stops the test, serverStop says why once its results are received
+	serverEnd := make(chan *protocol.TestResults, 1)
+	var serverStop *protocol.ErrorMessage
+	var lastHeard atomic.Int64
+	lastHeard.Store(startTime.UnixNano())
+	go c.readServerMessages(conn, serverEnd, &serverStop, &lastHeard)
+
+	// Heartbeats tell the server we are still there, until the final
+	// messages of the test are due
+	heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		c.sendHeartbeats(heartbeatCtx, conn)
+	}()
 
-	if !c.config.JSON {
-		if protocolType == "udp" {
-			fmt.Printf("Connecting to host %s, port %d\n", c.config.Host, c.config.Port)
-			fmt.Printf("[  4] local %s port %d connected to %s port %d\n",
-				conn.LocalAddr().String(), getPort(conn.LocalAddr()),
-				conn.RemoteAddr().String(), getPort(conn.RemoteAddr()))
-			fmt.Printf("[ ID] Interval           Transfer     Bitrate         Jitter    Lost/Total Datagrams\n")
+	// Send data and collect interval results
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	intervalStart := 0.0
+
+	// Sending stops at the end of the test or when the test is interrupted;
+	// the streams the server sends on are received until it is done
+	sendCtx, stopSending := context.WithTimeout(ctx, duration)
+	defer stopSending()
+	params := stream.Params{Length: c.length(), Bitrate: c.config.Bandwidth, Burst: c.config.Burst}
+	var senders, receivers []*stream.Stream
+	for _, st := range streams {
+		st.Start(sendCtx, t.Datagram(), params)
+		if st.Sender {
+			senders = append(senders, st)
 		} else {
-			fmt.Printf("Connecting to host %s, port %d\n", c.config.Host, c.config.Port)
-			fmt.Printf("[  4] local %s port %d connected to %s port %d\n",
-				conn.LocalAddr().String(), getPort(conn.LocalAddr()),
-				conn.RemoteAddr().String(), getPort(conn.RemoteAddr()))
-			fmt.Printf("[ ID] Interval           Transfer     Bitrate\n")
+			receivers = append(receivers, st)
 		}
 	}
 
-	// Send data and collect interval results
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	// emitInterval reports the interval ending at elapsed seconds
+	emitInterval := func(elapsed float64) {
+		interval := stream.Report(t, streams, intervalStart, elapsed, c.config.Bidir)
+		results.Intervals = append(results.Intervals, interval)
 
-	intervalBytes := int64(0)
-	intervalNum := 0
+		rep.Interval(&interval)
 
-	// UDP-specific statistics
-	var totalPackets int64
-	intervalPackets := int64(0)
+		intervalStart = elapsed
+	}
 
-	// Start sending data in a goroutine
-	go func() {
-		if protocolType == "udp" {
-			// For UDP, send packets at controlled rate with sequence numbers
-			packetSize := c.config.Length
-			if packetSize == 0 {
-				packetSize = 1470 // Default UDP payload size
+	// Report intervals until the test is over, interrupted, or stopped by
+	// the server
+	var serverResults *protocol.TestResults
+	serverDone := false
+	// serverLost is set when the server stops responding
+	serverLost := false
+	peerTimeout := c.peerTimeout()
+	deadline := time.NewTimer(duration + 2*time.Second)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			silent := time.Since(time.Unix(0, lastHeard.Load()))
+			if peerTimeout > 0 && silent > peerTimeout {
+				serverLost = true
+				results.Interrupted = true
+				results.Error = fmt.Sprintf("the server stopped responding: nothing heard for %.0f seconds", silent.Seconds())
+				// Unblock a heartbeat stuck writing to the gone server
+				conn.SetWriteDeadline(time.Now())
+				goto testComplete
 			}
-
-			// Reserve space for UDP packet header (16 bytes)
-			headerSize := 16
-			payloadSize := packetSize - headerSize
-			if payloadSize < 0 {
-				payloadSize = packetSize
-				headerSize = 0
+			elapsed := time.Since(startTime).Seconds()
+			emitInterval(elapsed)
+			if elapsed >= duration.Seconds() {
+				goto testComplete
 			}
 
-			udpBuffer := make([]byte, packetSize)
-			if headerSize > 0 {
-				// Fill payload portion with test data
-				copy(udpBuffer[headerSize:], buffer[:min(len(buffer), payloadSize)])
-			} else {
-				copy(udpBuffer, buffer[:min(len(buffer), packetSize)])
-			}
+		case <-deadline.C:
+			goto testComplete
+
+		case <-ctx.Done():
+			results.Interrupted = true
+			results.Error = "interrupt - the client has terminated"
+			goto testComplete
 
-			// Calculate target rate
-			targetBandwidth := c.config.Bandwidth
-			if targetBandwidth == 0 {
-				targetBandwidth = 1000000 // 1 Mbps default for UDP
+		case serverResults = <-serverEnd:
+			serverDone = true
+			results.Interrupted = true
+			results.Error = "the server has terminated"
+			if serverResults != nil && serverResults.Error != "" {
+				results.Error = serverResults.Error
 			}
+			goto testComplete
+		}
+	}
 
-			packetInterval := time.Duration(float64(packetSize*8) / float64(targetBandwidth) * float64(time.Second))
-			ticker := time.NewTicker(packetInterval)
-			defer ticker.Stop()
-
-			var sequenceNum uint32 = 0
-			const magicNumber uint32 = 0x12345678 // iperf3 magic number
-
-			for time.Since(startTime) < duration {
-				select {
-				case <-ticker.C:
-					// Add UDP packet header with sequence and timestamp
-					if headerSize > 0 {
-						binary.BigEndian.PutUint32(udpBuffer[0:4], sequenceNum)
-						binary.BigEndian.PutUint64(udpBuffer[4:12], uint64(time.Now().UnixNano()))
-						binary.BigEndian.PutUint32(udpBuffer[12:16], magicNumber)
-					}
-
-					n, err := conn.Write(udpBuffer)
-					if err != nil {
-						return
-					}
-					totalBytes += int64(n)
-					intervalBytes += int64(n)
-					totalPackets++
-					intervalPackets++
-					sequenceNum++
-				}
+testComplete:
+	elapsed := time.Since(startTime).Seconds()
+	cpuEnd := sysstat.SampleCPU()
+
+	// Stop the senders, unblocking any stuck in a write; the heartbeats
+	// stop too, leaving the control connection to the final messages
+	stopHeartbeats()
+	<-heartbeatDone
+	stopSending()
+	for _, st := range senders {
+		st.Stop()
+	}
+
+	if results.Interrupted && elapsed-intervalStart >= minPartialInterval {
+		emitInterval(elapsed)
+	}
+
+	if !serverDone && !serverLost {
+		// Let the server read what is still in flight, then tell it the
+		// test is over, or why it was cut short
+		for _, st := range senders {
+			if cw, ok := st.Conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
 			}
-		} else {
-			// TCP - send as fast as possible
-			for time.Since(startTime) < duration {
-				n, err := conn.Write(buffer)
-				if err != nil {
-					return
-				}
-				totalBytes += int64(n)
-				intervalBytes += int64(n)
+		}
+		end := &protocol.Message{Type: protocol.MessageTypeTestEnd}
+		if results.Interrupted {
+			end = &protocol.Message{
+				Type: protocol.MessageTypeError,
+				Data: mustMarshal(protocol.ErrorMessage{Code: protocol.ErrorCodeAborted, Message: results.Error}),
 			}
 		}
-	}()
+		if err := protocol.WriteMessage(conn, end); err != nil && c.config.Verbose {
+			log.Printf("Failed to send test end: %v", err)
+		}
 
-	// Read interval messages from server
-	for {
+		// Wait for the server's end-of-test results
 		select {
-		case <-ticker.C:
-			intervalNum++
-			elapsed := time.Since(startTime).Seconds()
+		case serverResults = <-serverEnd:
+		case <-time.After(serverEndTimeout):
+			if c.config.Verbose {
+				log.Printf("Timed out waiting for server results")
+			}
+		}
+	}
+
+	// The server has stopped sending by the time its results arrive, so
+	// read what it sent before them
+	if serverResults != nil && !t.Datagram() {
+		stream.Drain(receivers, streamDrainTimeout)
+	}
+	for _, st := range receivers {
+		st.Stop()
+	}
+
+	c.fillEnd(results, t, streams, serverResults, elapsed)
+	results.End.CPUUtilizationPercent.HostTotal, results.End.CPUUtilizationPercent.HostUser,
+		results.End.CPUUtilizationPercent.HostSystem = sysstat.CPUUtilization(cpuStart, cpuEnd)
+
+	if serverResults != nil {
+		results.ServerOutputJSON = serverResults.ServerOutputJSON
+		if len(results.ServerOutputJSON) == 0 {
+			results.ServerOutputText = serverResults.ServerOutputText
+		}
+	}
+
+	for i := range results.End.Streams {
+		rep.StreamEnd(&results.End.Streams[i])
+	}
+	rep.Summary(results)
+
+	if results.Interrupted {
+		if ctx.Err() != nil {
+			return results, fmt.Errorf("%w: %w", ErrInterrupted, ctx.Err())
+		}
+		if serverDone && serverStop != nil {
+			return results, fmt.Errorf("%w: %w", ErrInterrupted, &ServerError{ErrorMessage: *serverStop})
+		}
+		return results, fmt.Errorf("%w: %s", ErrInterrupted, results.Error)
+	}
+	return results, nil
+}
+
+// length returns the block length of the test
+func (c *Client) length() int {
+	if c.config.Length > 0 {
+		return c.config.Length
+	}
+	return stream.DefaultLength(c.config.Protocol)
+}
+
+// newResults builds the results skeleton with the start section filled in
+func (c *Client) newResults(t transport.Transport, streams []*stream.Stream, cookie string, duration time.Duration) *protocol.TestResults {
+	reverse, bidir := 0, 0
+	if c.config.Reverse {
+		reverse = 1
+	}
+	if c.config.Bidir {
+		bidir = 1
+	}
+
+	results := &protocol.TestResults{
+		Start: protocol.TestStart{
+			Version:    "iperf3-go 1.0.0",
+			SystemInfo: sysstat.SystemInfo(),
+			Timestamp:  protocol.NewTimestamp(time.Now()),
+			ConnectingTo: &protocol.ConnectingTo{
+				Host: c.config.Host,
+				Port: c.config.Port,
+			},
+			Cookie:        cookie,
+			TargetBitrate: c.config.Bandwidth,
+			SockBufsize:   c.config.Window,
+			TestStart: protocol.TestParameters{
+				Protocol:      strings.ToUpper(t.Name()),
+				NumStreams:    len(streams),
+				Blksize:       c.length(),
+				Duration:      int(duration / time.Second),
+				Reverse:       reverse,
+				Bidir:         bidir,
+				TargetBitrate: c.config.Bandwidth,
+				Interval:      1,
+				MPTCP:         c.config.MPTCP,
+			},
+		},
+		Intervals: []protocol.IntervalReport{},
+		Title:     c.config.Title,
+		ExtraData: c.config.ExtraData,
+	}
+
+	for _, st := range streams {
+		results.Start.Connected = append(results.Start.Connected, protocol.Connection{
+			Socket:     st.ID,
+			LocalHost:  getHost(st.Conn.LocalAddr()),
+			LocalPort:  getPort(st.Conn.LocalAddr()),
+			RemoteHost: getHost(st.Conn.RemoteAddr()),
+			RemotePort: getPort(st.Conn.RemoteAddr()),
+			MPTCP:      transport.UsingMPTCP(st.Conn),
+			TLS:        transport.TLSInfo(st.Conn),
+		})
+	}
+
+	first := streams[0].Conn
+	if stats, err := t.Stats(first); err == nil {
+		results.Start.TCPMSSDefault = stats.SndMSS
+	}
+	if sndbuf, rcvbuf, err := sysstat.SocketBuffers(transport.Unwrap(first)); err == nil {
+		results.Start.SNDBufActual = sndbuf
+		results.Start.RCVBufActual = rcvbuf
+	}
 
-			if !c.config.JSON {
-				transfer := float64(intervalBytes) / (1024 * 1024)  // MB
-				bitrate := float64(intervalBytes*8) / (1024 * 1024) // Mbits/sec
-
-				if protocolType == "udp" {
-					// For UDP, show additional statistics (jitter and packet loss would come from server)
-					fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec   0.000 ms  %3d/%3d (0%%)\n",
-						elapsed-1, elapsed, transfer, bitrate, 0, intervalPackets)
-				} else {
-					fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec\n",
-						elapsed-1, elapsed, transfer, bitrate)
+	return results
+}
+
+// fillEnd fills in the end section from our side of each stream and the
+// other side's results the server sent back
+func (c *Client) fillEnd(results *protocol.TestResults, t transport.Transport, streams []*stream.Stream,
+	serverResults *protocol.TestResults, elapsed float64) {
+	// The server reports each stream under the ID we gave it
+	remote := make(map[int]*protocol.StreamResult)
+	if serverResults != nil {
+		for _, end := range serverResults.End.Streams {
+			for _, res := range []*protocol.StreamResult{end.Sender, end.Receiver, end.UDP} {
+				if res != nil {
+					remote[res.Socket] = res
 				}
 			}
+		}
+	}
 
-			intervalBytes = 0
-			intervalPackets = 0
+	// The streams of a bidirectional test that run from the server to the
+	// client are summed apart
+	var sent, received, udp [2][]protocol.StreamResult
+	for _, st := range streams {
+		local := st.Result(t, elapsed)
 
-			if elapsed >= duration.Seconds() {
-				goto testComplete
+		// Without the server's numbers the best we can report is our side
+		other := local
+		if res, ok := remote[st.ID]; ok && res.Seconds > 0 {
+			other = *res
+		}
+		other.Sender = !local.Sender
+		sender, receiver := local, other
+		if !local.Sender {
+			sender, receiver = other, local
+		}
+
+		dir := 0
+		if c.config.Bidir && st.Reverse {
+			dir = 1
+		}
+		sent[dir] = append(sent[dir], sender)
+		received[dir] = append(received[dir], receiver)
+
+		if t.Datagram() {
+			// The UDP entry is our side's, with the receiver's loss when we
+			// are the sender
+			entry := local
+			if local.Sender {
+				entry.Jitter = receiver.Jitter
+				entry.LostPackets = receiver.LostPackets
+				entry.OutOfOrder = receiver.OutOfOrder
+				if entry.Packets > 0 {
+					entry.LostPercent = float64(entry.LostPackets) * 100 / float64(entry.Packets)
+				}
 			}
+			udp[dir] = append(udp[dir], entry)
+			results.End.Streams = append(results.End.Streams, protocol.StreamEnd{UDP: &entry})
+			continue
+		}
+		results.End.Streams = append(results.End.Streams, protocol.StreamEnd{Sender: &sender, Receiver: &receiver})
+	}
 
-		case <-time.After(duration + 2*time.Second):
-			goto testComplete
+	results.End.SumSent = protocol.SumResults(sent[0], elapsed)
+	results.End.SumReceived = protocol.SumResults(received[0], elapsed)
+	if t.Datagram() {
+		sum := protocol.SumResults(udp[0], elapsed)
+		results.End.Sum = &sum
+	}
+	if c.config.Bidir {
+		sumSent := protocol.SumResults(sent[1], elapsed)
+		sumReceived := protocol.SumResults(received[1], elapsed)
+		results.End.SumSentBidirReverse, results.End.SumReceivedBidirReverse = &sumSent, &sumReceived
+		if t.Datagram() {
+			sum := protocol.SumResults(udp[1], elapsed)
+			results.End.SumBidirReverse = &sum
 		}
 	}
 
-testComplete:
-	elapsed := time.Since(startTime).Seconds()
+	if !t.Datagram() {
+		// Each side knows the congestion control of its own sockets
+		if stats, err := t.Stats(streams[0].Conn); err == nil {
+			if streams[0].Sender {
+				results.End.SenderTCPCongestion = stats.Congestion
+			} else {
+				results.End.ReceiverTCPCongestion = stats.Congestion
+			}
+		}
+		if serverResults != nil {
+			results.End.SenderTCPCongestion = cmp.Or(results.End.SenderTCPCongestion, serverResults.End.SenderTCPCongestion)
+			results.End.ReceiverTCPCongestion = cmp.Or(results.End.ReceiverTCPCongestion, serverResults.End.ReceiverTCPCongestion)
+		}
+	}
 
-	if c.config.JSON {
-		// Output JSON results
-		results := map[string]interface{}{
-			"start": map[string]interface{}{
-				"connected": []map[string]interface{}{
-					{
-						"socket":      4,
-						"local_host":  conn.LocalAddr().String(),
-						"local_port":  getPort(conn.LocalAddr()),
-						"remote_host": conn.RemoteAddr().String(),
-						"remote_port": getPort(conn.RemoteAddr()),
-					},
-				},
-				"version":     "iperf3-go 1.0.0",
-				"system_info": "Go implementation",
-				"timestamp": map[string]interface{}{
-					"time":     time.Now().Unix(),
-					"timesecs": time.Now().Unix(),
-				},
-			},
-			"end": map[string]interface{}{
-				"streams": []map[string]interface{}{
-					func() map[string]interface{} {
-						stream := map[string]interface{}{
-							"socket":          4,
-							"start":           0,
-							"end":             elapsed,
-							"seconds":         elapsed,
-							"bytes":           totalBytes,
-							"bits_per_second": float64(totalBytes*8) / elapsed,
-							"sender":          true,
-						}
-						if protocolType == "udp" {
-							stream["packets"] = totalPackets
-							stream["lost_packets"] = 0
-							stream["lost_percent"] = 0.0
-							stream["jitter_ms"] = 0.0
-							stream["out_of_order"] = 0
-						}
-						return stream
-					}(),
-				},
-				"sum_sent": map[string]interface{}{
-					"start":           0,
-					"end":             elapsed,
-					"seconds":         elapsed,
-					"bytes":           totalBytes,
-					"bits_per_second": float64(totalBytes*8) / elapsed,
-					"sender":          true,
-				},
-				"sum_received": map[string]interface{}{
-					"start":           0,
-					"end":             elapsed,
-					"seconds":         elapsed,
-					"bytes":           totalBytes,
-					"bits_per_second": float64(totalBytes*8) / elapsed,
-					"sender":          false,
-				},
-			},
+	if serverResults != nil {
+		remote := serverResults.End.CPUUtilizationPercent
+		results.End.CPUUtilizationPercent.RemoteTotal = remote.HostTotal
+		results.End.CPUUtilizationPercent.RemoteUser = remote.HostUser
+		results.End.CPUUtilizationPercent.RemoteSystem = remote.HostSystem
+	}
+}
+
+// readServerMessages reads the interval and end-of-test messages the server
+// writes on the control connection. The server's final results are delivered
+// on end; end is closed without a value if the connection fails first. If
+// the server stops the test, stop is set to its error before end is written.
+// heard is set to the time of each message, in Unix nanoseconds.
+func (c *Client) readServerMessages(conn net.Conn, end chan<- *protocol.TestResults, stop **protocol.ErrorMessage, heard *atomic.Int64) {
+	var serverErr string
+	for {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			// Without results, pass on the reason the server gave, if any
+			if serverErr != "" {
+				end <- &protocol.TestResults{Interrupted: true, Error: serverErr}
+			}
+			close(end)
+			return
+		}
+		heard.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case protocol.MessageTypeInterval:
+			if c.config.Verbose {
+				var interval protocol.IntervalReport
+				if err := json.Unmarshal(msg.Data, &interval); err == nil {
+					log.Printf("Server interval %.2f-%.2f: %d bytes", interval.Sum.Start, interval.Sum.End, interval.Sum.Bytes)
+				}
+			}
+		case protocol.MessageTypeError:
+			// The server is stopping the test; its partial results follow
+			var errMsg protocol.ErrorMessage
+			if err := json.Unmarshal(msg.Data, &errMsg); err == nil {
+				serverErr = errMsg.Message
+				*stop = &errMsg
+				if c.config.Verbose {
+					log.Printf("Server error: %s", serverErr)
+				}
+			}
+		case protocol.MessageTypeTestEnd:
+			var results protocol.TestResults
+			if err := json.Unmarshal(msg.Data, &results); err != nil {
+				log.Printf("Failed to parse server results: %v", err)
+				close(end)
+				return
+			}
+			end <- &results
+			return
 		}
+	}
+}
 
-		jsonData, _ := json.MarshalIndent(results, "", "  ")
-		fmt.Println(string(jsonData))
-	} else {
-		// Output standard format
-		fmt.Printf("- - - - - - - - - - - - - - - - - - - - - - - - -\n")
-
-		transfer := float64(totalBytes) / (1024 * 1024)            // MB
-		bitrate := float64(totalBytes*8) / (1024 * 1024) / elapsed // Mbits/sec
-
-		if protocolType == "udp" {
-			fmt.Printf("[ ID] Interval           Transfer     Bitrate         Jitter    Lost/Total Datagrams\n")
-			fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec   0.000 ms  %3d/%3d (0%%)                  sender\n",
-				0.0, elapsed, transfer, bitrate, 0, totalPackets)
-			fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec   0.000 ms  %3d/%3d (0%%)                  receiver\n",
-				0.0, elapsed, transfer, bitrate, 0, totalPackets)
-		} else {
-			fmt.Printf("[ ID] Interval           Transfer     Bitrate\n")
-			fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec                  sender\n",
-				0.0, elapsed, transfer, bitrate)
-			fmt.Printf("[  4] %7.2f-%7.2f sec  %7.2f MBytes  %7.2f Mbits/sec                  receiver\n",
-				0.0, elapsed, transfer, bitrate)
+// sendHeartbeats tells the server on conn that the client is still there
+// every heartbeatInterval until ctx is done
+func (c *Client) sendHeartbeats(ctx context.Context, conn net.Conn) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	heartbeat := &protocol.Message{Type: protocol.MessageTypeHeartbeat}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := protocol.WriteMessage(conn, heartbeat); err != nil {
+			if c.config.Verbose {
+				log.Printf("Failed to send heartbeat: %v", err)
+			}
+			return
 		}
-		fmt.Printf("\niperf Done.\n")
 	}
+}
 
-	return nil
+// peerTimeout returns how long the test may go without hearing from the
+// server, or 0 if the server is not watched
+func (c *Client) peerTimeout() time.Duration {
+	switch {
+	case c.config.PeerTimeout < 0:
+		return 0
+	case c.config.PeerTimeout == 0:
+		return defaultPeerTimeout
+	}
+	return c.config.PeerTimeout
 }
 
 // Helper function to get port from address
 func getPort(addr net.Addr) int {
-	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-		return tcpAddr.Port
+	if addr == nil {
+		return 0
 	}
-	if udpAddr, ok := addr.(*net.UDPAddr); ok {
-		return udpAddr.Port
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
 	}
-	return 0
+	n, _ := strconv.Atoi(port)
+	return n
 }
 
-// Helper function to get minimum of two integers
-func min(a, b int) int {
-	if a < b {
-		return a
+// Helper function to get host from address
+func getHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
 	}
-	return b
+	return data
 }
@@ -1,7 +1,18 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/report"
 )
 
 func TestClientConfig(t *testing.T) {
@@ -47,3 +58,93 @@ func TestGetPort(t *testing.T) {
 		t.Errorf("Expected port 0 for nil address, got %d", port)
 	}
 }
+
+func TestClientFormat(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   string
+	}{
+		{Config{}, "text"},
+		{Config{Format: "csv"}, "csv"},
+		{Config{JSON: true, Format: "csv"}, "json"},
+		{Config{JSON: true, JSONStream: true}, "json-stream"},
+	}
+
+	for _, tt := range tests {
+		client := New(&tt.config)
+		if got := client.format(); got != tt.want {
+			t.Errorf("format() for %+v = %s, want %s", tt.config, got, tt.want)
+		}
+	}
+
+	client := New(&Config{Format: "no-such-format"})
+	if _, err := client.newReporter(); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// A server that starts the test, then never reports back
+	var heartbeats atomic.Int32
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		var config protocol.TestConfig
+		if json.Unmarshal(msg.Data, &config); config.Heartbeat <= 0 {
+			t.Errorf("expected the client to announce heartbeats, got %+v", config)
+		}
+		protocol.WriteMessage(conn, &protocol.Message{Type: protocol.MessageTypeTestStartAck, Data: mustMarshal(protocol.TestStartAck{Cookie: "cookie"})})
+
+		st, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer st.Close()
+		protocol.ReadMessage(st)
+		protocol.WriteMessage(st, &protocol.Message{Type: protocol.MessageTypeStreamStartAck})
+		go io.Copy(io.Discard, st)
+
+		for {
+			msg, err := protocol.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg.Type == protocol.MessageTypeHeartbeat {
+				heartbeats.Add(1)
+			}
+		}
+	}()
+
+	c := New(&Config{
+		Host:        "127.0.0.1",
+		Port:        ln.Addr().(*net.TCPAddr).Port,
+		Time:        30,
+		Protocol:    "tcp",
+		PeerTimeout: 2 * time.Second,
+		Reporter:    report.Multi(),
+	})
+	start := time.Now()
+	res, err := c.RunTest(context.Background())
+	if !errors.Is(err, ErrInterrupted) || res == nil || !strings.Contains(res.Error, "the server stopped responding") {
+		t.Fatalf("expected the test to be aborted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to notice the server was gone", elapsed)
+	}
+	if heartbeats.Load() == 0 {
+		t.Error("expected the client to send heartbeats")
+	}
+}
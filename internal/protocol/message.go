@@ -15,6 +15,17 @@ const (
 	MessageTypeTestEnd      = 4
 	MessageTypeInterval     = 5
 	MessageTypeError        = 6
+	// A data stream opens with MessageTypeStreamStart, naming the test it
+	// belongs to, and the server answers with MessageTypeStreamStartAck
+	MessageTypeStreamStart    = 7
+	MessageTypeStreamStartAck = 8
+	// A server running as many tests as it may can queue a new one,
+	// answering MessageTypeTestStart with MessageTypeQueued, and again each
+	// time the test moves up, until it sends MessageTypeTestStartAck
+	MessageTypeQueued = 9
+	// A client that sets TestConfig.Heartbeat sends MessageTypeHeartbeat
+	// on the control connection at that interval while the test runs
+	MessageTypeHeartbeat = 10
 )
 
 // Message represents an iperf3 protocol message
@@ -34,6 +45,9 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	if length > 1024*1024 { // 1MB limit
 		return nil, fmt.Errorf("message too large: %d bytes", length)
 	}
+	if length < 4 {
+		return nil, fmt.Errorf("message too short: %d bytes", length)
+	}
 
 	// Read message type (4 bytes, big endian)
 	var msgType uint32
@@ -53,25 +67,18 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	}, nil
 }
 
-// WriteMessage writes an iperf3 message to a connection
+// WriteMessage writes an iperf3 message to a connection. The message goes
+// out in a single write, so on a datagram socket it is a single datagram.
 func WriteMessage(conn net.Conn, msg *Message) error {
-	// Calculate total length (4 bytes for type + data length)
-	totalLength := uint32(4 + len(msg.Data))
-
-	// Write message length
-	if err := binary.Write(conn, binary.BigEndian, totalLength); err != nil {
-		return fmt.Errorf("failed to write message length: %w", err)
-	}
+	// Length covers the type field and the data
+	buf := make([]byte, 8+len(msg.Data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(4+len(msg.Data)))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(msg.Type))
+	copy(buf[8:], msg.Data)
 
-	// Write message type
-	if err := binary.Write(conn, binary.BigEndian, uint32(msg.Type)); err != nil {
-		return fmt.Errorf("failed to write message type: %w", err)
-	}
-
-	// Write message data
-	if _, err := conn.Write(msg.Data); err != nil {
-		return fmt.Errorf("failed to write message data: %w", err)
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -1,5 +1,12 @@
 package protocol
 
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
 // TestConfig represents the test configuration sent by the client
 type TestConfig struct {
 	Protocol        string `json:"protocol,omitempty"`
@@ -18,31 +25,71 @@ type TestConfig struct {
 	Title           string `json:"title,omitempty"`
 	ExtraData       string `json:"extra_data,omitempty"`
 	GetServerOutput bool   `json:"get_server_output,omitempty"`
+	JSON            bool   `json:"json,omitempty"`
 	UDPCountersMode bool   `json:"udp_counters_64bit,omitempty"`
 	ZeroCopy        bool   `json:"zerocopy,omitempty"`
 	OmitSec         int    `json:"omit,omitempty"`
 	Duration        int    `json:"duration,omitempty"`
 	Blockcount      int64  `json:"blockcount,omitempty"`
+	NoDelay         bool   `json:"nodelay,omitempty"`
+	MSS             int    `json:"MSS,omitempty"`
+	MPTCP           bool   `json:"mptcp,omitempty"`
+	// AuthToken carries the client's encrypted credentials, as in iperf3
+	AuthToken string `json:"authtoken,omitempty"`
+	// Heartbeat is the interval in milliseconds at which the client sends
+	// MessageTypeHeartbeat during the test, so the server can tell when it
+	// is gone; zero means it sends none
+	Heartbeat int `json:"heartbeat,omitempty"`
+}
+
+// Streams returns the number of data streams the test opens: Parallel, in
+// each direction of a bidirectional test
+func (c *TestConfig) Streams() int {
+	if c.Bidir {
+		return 2 * max(c.Parallel, 1)
+	}
+	return max(c.Parallel, 1)
+}
+
+// Reversed reports whether data stream id carries data from the server to
+// the client: every stream of a reverse test, and those a bidirectional test
+// opens after the first Parallel
+func (c *TestConfig) Reversed(id int) bool {
+	return c.Reverse || c.Bidir && id > max(c.Parallel, 1)
 }
 
-// TestResults represents the complete test results
+// TestResults represents the complete test results, laid out like iperf3's JSON output
 type TestResults struct {
-	Start TestStart `json:"start"`
-	End   TestEnd   `json:"end"`
+	Start     TestStart        `json:"start"`
+	Intervals []IntervalReport `json:"intervals"`
+	End       TestEnd          `json:"end"`
+	Title     string           `json:"title,omitempty"`
+	ExtraData string           `json:"extra_data,omitempty"`
+
+	// Server report returned to the client when it set GetServerOutput
+	ServerOutputText string          `json:"server_output_text,omitempty"`
+	ServerOutputJSON json.RawMessage `json:"server_output_json,omitempty"`
+
+	// Interrupted is set when the test ended before its configured duration;
+	// Error then says why, worded as in iperf3
+	Interrupted bool   `json:"interrupted,omitempty"`
+	Error       string `json:"error,omitempty"`
 }
 
 // TestStart represents the test start information
 type TestStart struct {
-	Connected     []Connection `json:"connected"`
-	Version       string       `json:"version"`
-	SystemInfo    string       `json:"system_info"`
-	Timestamp     Timestamp    `json:"timestamp"`
-	ConnectingTo  ConnectingTo `json:"connecting_to"`
-	Cookie        string       `json:"cookie"`
-	TCPMSSDefault int          `json:"tcp_mss_default,omitempty"`
-	SockBufsize   int          `json:"sock_bufsize,omitempty"`
-	SNDBufActual  int          `json:"sndbuf_actual,omitempty"`
-	RCVBufActual  int          `json:"rcvbuf_actual,omitempty"`
+	Connected     []Connection   `json:"connected"`
+	Version       string         `json:"version"`
+	SystemInfo    string         `json:"system_info"`
+	Timestamp     Timestamp      `json:"timestamp"`
+	ConnectingTo  *ConnectingTo  `json:"connecting_to,omitempty"`
+	Cookie        string         `json:"cookie"`
+	TCPMSSDefault int            `json:"tcp_mss_default,omitempty"`
+	TargetBitrate int64          `json:"target_bitrate"`
+	SockBufsize   int            `json:"sock_bufsize"`
+	SNDBufActual  int            `json:"sndbuf_actual"`
+	RCVBufActual  int            `json:"rcvbuf_actual"`
+	TestStart     TestParameters `json:"test_start"`
 }
 
 // Connection represents a connection info
@@ -52,12 +99,36 @@ type Connection struct {
 	LocalPort  int    `json:"local_port"`
 	RemoteHost string `json:"remote_host"`
 	RemotePort int    `json:"remote_port"`
+	// MPTCP is set when the connection runs Multipath TCP
+	MPTCP bool `json:"mptcp,omitempty"`
+	// TLS describes the connection's TLS session, if it runs over TLS
+	TLS *TLSInfo `json:"tls,omitempty"`
+}
+
+// TLSInfo describes the TLS session of a connection
+type TLSInfo struct {
+	// Version is the negotiated TLS version, e.g. "TLS 1.3"
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	// HandshakeMS is the time the handshake took, in milliseconds
+	HandshakeMS float64 `json:"handshake_ms"`
 }
 
 // Timestamp represents a timestamp
 type Timestamp struct {
-	Time     int64 `json:"time"`
-	Timesecs int64 `json:"timesecs"`
+	Time     string `json:"time"`
+	Timesecs int64  `json:"timesecs"`
+}
+
+// TimestampFormat is the layout iperf3 uses for Timestamp.Time
+const TimestampFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// NewTimestamp returns the Timestamp for t
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{
+		Time:     t.UTC().Format(TimestampFormat),
+		Timesecs: t.Unix(),
+	}
 }
 
 // ConnectingTo represents connection target info
@@ -66,14 +137,75 @@ type ConnectingTo struct {
 	Port int    `json:"port"`
 }
 
+// TestParameters represents the "test_start" section describing the test setup
+type TestParameters struct {
+	Protocol      string  `json:"protocol"`
+	NumStreams    int     `json:"num_streams"`
+	Blksize       int     `json:"blksize"`
+	Omit          int     `json:"omit"`
+	Duration      int     `json:"duration"`
+	Bytes         int64   `json:"bytes"`
+	Blocks        int64   `json:"blocks"`
+	Reverse       int     `json:"reverse"`
+	TOS           int     `json:"tos"`
+	TargetBitrate int64   `json:"target_bitrate"`
+	Bidir         int     `json:"bidir"`
+	Fqrate        int64   `json:"fqrate"`
+	Interval      float64 `json:"interval"`
+	// MPTCP is set when the client asked for Multipath TCP
+	MPTCP bool `json:"mptcp,omitempty"`
+}
+
+// Reversed reports whether data stream id carries data from the server to
+// the client, as TestConfig.Reversed does for the test's configuration
+func (p *TestParameters) Reversed(id int) bool {
+	return p.Reverse != 0 || p.Bidir != 0 && id > p.NumStreams/2
+}
+
 // TestEnd represents the test end results
 type TestEnd struct {
-	Streams               []StreamResult `json:"streams"`
-	SumSent               StreamResult   `json:"sum_sent"`
-	SumReceived           StreamResult   `json:"sum_received"`
-	CPUUtilizationPercent CPUUtilization `json:"cpu_utilization_percent"`
-	SenderTCPCongestion   string         `json:"sender_tcp_congestion,omitempty"`
-	ReceiverTCPCongestion string         `json:"receiver_tcp_congestion,omitempty"`
+	Streams     []StreamEnd   `json:"streams"`
+	Sum         *StreamResult `json:"sum,omitempty"` // UDP only
+	SumSent     StreamResult  `json:"sum_sent"`
+	SumReceived StreamResult  `json:"sum_received"`
+	// The streams of a bidirectional test that run from the server to the
+	// client are summed apart
+	SumBidirReverse         *StreamResult  `json:"sum_bidir_reverse,omitempty"` // UDP only
+	SumSentBidirReverse     *StreamResult  `json:"sum_sent_bidir_reverse,omitempty"`
+	SumReceivedBidirReverse *StreamResult  `json:"sum_received_bidir_reverse,omitempty"`
+	CPUUtilizationPercent   CPUUtilization `json:"cpu_utilization_percent"`
+	SenderTCPCongestion     string         `json:"sender_tcp_congestion,omitempty"`
+	ReceiverTCPCongestion   string         `json:"receiver_tcp_congestion,omitempty"`
+}
+
+// StreamEnd holds the final results of one stream. TCP and SCTP streams
+// report both sides of the transfer; UDP streams report a single udp entry.
+type StreamEnd struct {
+	Sender   *StreamResult `json:"sender,omitempty"`
+	Receiver *StreamResult `json:"receiver,omitempty"`
+	UDP      *StreamResult `json:"udp,omitempty"`
+}
+
+// NewCount returns a count of n, for counts reported even when zero
+func NewCount(n int) *int {
+	return &n
+}
+
+// CountValue returns the value of count c, 0 if it is not reported
+func CountValue(c *int) int {
+	if c == nil {
+		return 0
+	}
+	return *c
+}
+
+// AddCounts returns the sum of counts a and b, which is not reported if
+// neither of them is
+func AddCounts(a, b *int) *int {
+	if a == nil && b == nil {
+		return nil
+	}
+	return NewCount(CountValue(a) + CountValue(b))
 }
 
 // StreamResult represents results for a single stream
@@ -84,13 +216,114 @@ type StreamResult struct {
 	Seconds       float64 `json:"seconds"`
 	Bytes         int64   `json:"bytes"`
 	BitsPerSecond float64 `json:"bits_per_second"`
-	Retransmits   int     `json:"retransmits,omitempty"`
-	SndCwnd       int     `json:"snd_cwnd,omitempty"`
-	RTT           int     `json:"rtt,omitempty"`
-	RTTVar        int     `json:"rttvar,omitempty"`
-	PMTU          int     `json:"pmtu,omitempty"`
-	Omitted       bool    `json:"omitted,omitempty"`
-	Sender        bool    `json:"sender,omitempty"`
+	// Retransmits is reported by senders that count them, zero included
+	// as iperf3 does for TCP, and left out by others
+	Retransmits *int `json:"retransmits,omitempty"`
+	MaxSndCwnd  int  `json:"max_snd_cwnd,omitempty"`
+	MaxRTT      int  `json:"max_rtt,omitempty"`
+	MinRTT      int  `json:"min_rtt,omitempty"`
+	MeanRTT     int  `json:"mean_rtt,omitempty"`
+	// UDP-specific fields
+	Jitter      float64 `json:"jitter_ms,omitempty"`
+	LostPackets int64   `json:"lost_packets,omitempty"`
+	Packets     int64   `json:"packets,omitempty"`
+	LostPercent float64 `json:"lost_percent,omitempty"`
+	OutOfOrder  int64   `json:"out_of_order,omitempty"`
+	Sender      bool    `json:"sender"`
+	// Substreams splits the stream's bytes by substream when it spreads its
+	// data over several, as SCTP streams within an association do
+	Substreams []SubstreamResult `json:"substreams,omitempty"`
+	// Paths splits the stream's bytes by the network path that carried
+	// them, for multi-homed transports such as SCTP
+	Paths []PathResult `json:"paths,omitempty"`
+}
+
+// SumResults adds up the results of streams carrying data the same way, over
+// a test of elapsed seconds or the longest of theirs
+func SumResults(results []StreamResult, elapsed float64) StreamResult {
+	sum := StreamResult{End: elapsed, Seconds: elapsed}
+	for _, res := range results {
+		sum.End = max(sum.End, res.End)
+		sum.Seconds = max(sum.Seconds, res.Seconds)
+		sum.Bytes += res.Bytes
+		sum.Retransmits = AddCounts(sum.Retransmits, res.Retransmits)
+		sum.Packets += res.Packets
+		sum.LostPackets += res.LostPackets
+		sum.OutOfOrder += res.OutOfOrder
+		sum.Jitter += res.Jitter / float64(len(results))
+		sum.Sender = res.Sender
+	}
+	if sum.Seconds > 0 {
+		sum.BitsPerSecond = float64(sum.Bytes*8) / sum.Seconds
+	}
+	if sum.Packets > 0 {
+		sum.LostPercent = float64(sum.LostPackets) * 100 / float64(sum.Packets)
+	}
+	return sum
+}
+
+// SubstreamResult is the part of a stream's data carried by one substream
+type SubstreamResult struct {
+	ID            int     `json:"id"`
+	Bytes         int64   `json:"bytes"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+// SubstreamResults returns the bytes each substream carried between two
+// counts keyed by substream ID, ordered by ID
+func SubstreamResults(start, end map[int]int64, seconds float64) []SubstreamResult {
+	var results []SubstreamResult
+	for id, bytes := range end {
+		bytes -= start[id]
+		if bytes <= 0 {
+			continue
+		}
+		res := SubstreamResult{ID: id, Bytes: bytes}
+		if seconds > 0 {
+			res.BitsPerSecond = float64(bytes*8) / seconds
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results
+}
+
+// PathResult is the part of a stream's data carried over one path, from
+// the first interval it was the primary path until the path changed
+type PathResult struct {
+	Address       string  `json:"address"`
+	Start         float64 `json:"start"`
+	End           float64 `json:"end"`
+	Seconds       float64 `json:"seconds"`
+	Bytes         int64   `json:"bytes"`
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+// PathResults groups a stream's consecutive intervals by path, in time
+// order. An interval counts towards the path it was reported on, so a path
+// switch shows up at interval granularity.
+func PathResults(intervals []Interval) []PathResult {
+	var results []PathResult
+	for _, iv := range intervals {
+		if iv.Path == "" {
+			continue
+		}
+		if n := len(results); n > 0 && results[n-1].Address == iv.Path {
+			results[n-1].End = iv.End
+			results[n-1].Bytes += iv.Bytes
+			continue
+		}
+		results = append(results, PathResult{Address: iv.Path, Start: iv.Start, End: iv.End, Bytes: iv.Bytes})
+	}
+
+	for i := range results {
+		res := &results[i]
+		res.Seconds = res.End - res.Start
+		if res.Seconds > 0 {
+			res.BitsPerSecond = float64(res.Bytes*8) / res.Seconds
+		}
+	}
+	return results
 }
 
 // CPUUtilization represents CPU utilization statistics
@@ -103,20 +336,54 @@ type CPUUtilization struct {
 	RemoteSystem float64 `json:"remote_system"`
 }
 
+// IntervalReport represents one reporting interval: a measurement per stream plus their sum
+type IntervalReport struct {
+	Streams []Interval `json:"streams"`
+	Sum     Interval   `json:"sum"`
+	// SumBidirReverse sums the streams of a bidirectional test that run
+	// from the server to the client
+	SumBidirReverse *Interval `json:"sum_bidir_reverse,omitempty"`
+}
+
+// SumIntervals adds up the measurements of streams carrying data the same
+// way over the interval from start to end seconds
+func SumIntervals(intervals []Interval, start, end float64) Interval {
+	sum := Interval{Start: start, End: end, Seconds: end - start}
+	for _, iv := range intervals {
+		sum.Bytes += iv.Bytes
+		sum.Retransmits = AddCounts(sum.Retransmits, iv.Retransmits)
+		sum.Packets += iv.Packets
+		sum.LostPackets += iv.LostPackets
+		sum.OutOfOrder += iv.OutOfOrder
+		sum.Jitter += iv.Jitter / float64(len(intervals))
+		sum.Sender = iv.Sender
+	}
+	sum.BitsPerSecond = float64(sum.Bytes*8) / sum.Seconds
+	if sum.Packets > 0 {
+		sum.LostPercent = float64(sum.LostPackets) * 100 / float64(sum.Packets)
+	}
+	return sum
+}
+
 // Interval represents an interval measurement
 type Interval struct {
-	Socket        int     `json:"socket"`
+	Socket        int     `json:"socket,omitempty"`
 	Start         float64 `json:"start"`
 	End           float64 `json:"end"`
 	Seconds       float64 `json:"seconds"`
 	Bytes         int64   `json:"bytes"`
 	BitsPerSecond float64 `json:"bits_per_second"`
-	Retransmits   int     `json:"retransmits,omitempty"`
-	SndCwnd       int     `json:"snd_cwnd,omitempty"`
-	RTT           int     `json:"rtt,omitempty"`
-	RTTVar        int     `json:"rttvar,omitempty"`
-	PMTU          int     `json:"pmtu,omitempty"`
-	Omitted       bool    `json:"omitted"`
+	// Retransmits is reported by senders that count them, as in StreamResult
+	Retransmits *int `json:"retransmits,omitempty"`
+	SndCwnd     int  `json:"snd_cwnd,omitempty"`
+	RTT         int  `json:"rtt,omitempty"`
+	RTTVar      int  `json:"rttvar,omitempty"`
+	PMTU        int  `json:"pmtu,omitempty"`
+	Omitted     bool `json:"omitted"`
+	Sender      bool `json:"sender"`
+	// Path is the remote address of the path that carried the data, for
+	// multi-homed transports
+	Path string `json:"path,omitempty"`
 	// UDP-specific fields
 	Packets     int64   `json:"packets,omitempty"`
 	LostPackets int64   `json:"lost_packets,omitempty"`
@@ -125,6 +392,62 @@ type Interval struct {
 	OutOfOrder  int64   `json:"out_of_order,omitempty"`
 }
 
+// TestStartAck is the payload of the server's MessageTypeTestStartAck
+type TestStartAck struct {
+	Cookie string `json:"cookie"`
+}
+
+// QueuePosition is the payload of MessageTypeQueued
+type QueuePosition struct {
+	// Position is the test's place in the server's queue, from 1 for the
+	// next test to run
+	Position int `json:"position"`
+}
+
+// ErrorMessage is the payload of MessageTypeError, sent when a side stops a
+// test or cannot run it
+type ErrorMessage struct {
+	// Code classifies the error; peers that predate it leave it empty
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message"`
+	// Retryable is set when the same test may succeed if tried again later
+	Retryable bool `json:"retryable,omitempty"`
+	// Parameter and Limit are set when the server refuses or stops a test
+	// for going over one of its limits: the TestConfig field at fault, by
+	// its JSON name, and the largest value the server allows
+	Parameter string `json:"parameter,omitempty"`
+	Limit     int64  `json:"limit,omitempty"`
+}
+
+// ErrorCode classifies an ErrorMessage
+type ErrorCode string
+
+// Error codes sent in ErrorMessage
+const (
+	// ErrorCodeProtocol is for malformed or unexpected messages
+	ErrorCodeProtocol ErrorCode = "protocol_error"
+	// ErrorCodeBusy is for a server that cannot run the test now
+	ErrorCodeBusy ErrorCode = "busy"
+	// ErrorCodeAccessDenied is for a client that failed to authenticate
+	ErrorCodeAccessDenied ErrorCode = "access_denied"
+	// ErrorCodeInvalidParameter is for a test the server does not run, or
+	// that goes over one of its limits
+	ErrorCodeInvalidParameter ErrorCode = "invalid_parameter"
+	// ErrorCodeAborted is for a test stopped early, e.g. on interrupt
+	ErrorCodeAborted ErrorCode = "aborted"
+	// ErrorCodeInternal is for a local failure, e.g. of a socket call
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// StreamStart is the payload of MessageTypeStreamStart, sent first on each
+// data stream to attach it to the test started on the control connection
+type StreamStart struct {
+	Cookie string `json:"cookie"`
+	// ID numbers the stream within the test, from 1; both sides report the
+	// stream under this ID
+	ID int `json:"id"`
+}
+
 // UDPPacketHeader represents the header for UDP packets with sequence and timing info
 type UDPPacketHeader struct {
 	Sequence  uint32 `json:"sequence"`
@@ -132,14 +455,71 @@ type UDPPacketHeader struct {
 	Magic     uint32 `json:"magic"`     // Magic number to identify iperf3 packets
 }
 
+// UDPHeaderSize is the size of the UDPPacketHeader at the start of each datagram
+const UDPHeaderSize = 16
+
+// UDPMagic is the UDPPacketHeader magic number
+const UDPMagic uint32 = 0x12345678
+
+// Put writes the header to the start of b, which must hold UDPHeaderSize bytes
+func (h *UDPPacketHeader) Put(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], h.Sequence)
+	binary.BigEndian.PutUint64(b[4:12], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(b[12:16], h.Magic)
+}
+
+// ParseUDPPacketHeader reads the header at the start of a datagram; ok is
+// false if the datagram does not start with one
+func ParseUDPPacketHeader(b []byte) (h UDPPacketHeader, ok bool) {
+	if len(b) < UDPHeaderSize {
+		return h, false
+	}
+	h.Sequence = binary.BigEndian.Uint32(b[0:4])
+	h.Timestamp = int64(binary.BigEndian.Uint64(b[4:12]))
+	h.Magic = binary.BigEndian.Uint32(b[12:16])
+	return h, h.Magic == UDPMagic
+}
+
 // UDPStats represents UDP-specific statistics
 type UDPStats struct {
 	TotalPackets    int64
 	LostPackets     int64
 	OutOfOrder      int64
 	LastSequence    uint32
-	JitterSum       float64
-	JitterCount     int64
+	Jitter          float64 // milliseconds
 	LastArrivalTime int64
 	LastTransitTime float64
 }
+
+// Add accounts for a datagram with header h arriving at arrival. Loss is
+// inferred from gaps in the sequence numbers and jitter is smoothed as in
+// RFC 1889: J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16.
+func (s *UDPStats) Add(h UDPPacketHeader, arrival time.Time) {
+	transit := float64(arrival.UnixNano()-h.Timestamp) / float64(time.Millisecond)
+
+	s.TotalPackets++
+	switch expected := s.LastSequence + 1; {
+	case s.TotalPackets == 1:
+		s.LostPackets += int64(h.Sequence)
+		s.LastSequence = h.Sequence
+	case h.Sequence >= expected:
+		s.LostPackets += int64(h.Sequence - expected)
+		s.LastSequence = h.Sequence
+	default:
+		// A late packet was counted as lost when the gap was seen
+		s.OutOfOrder++
+		if s.LostPackets > 0 {
+			s.LostPackets--
+		}
+	}
+
+	if s.TotalPackets > 1 {
+		d := transit - s.LastTransitTime
+		if d < 0 {
+			d = -d
+		}
+		s.Jitter += (d - s.Jitter) / 16
+	}
+	s.LastTransitTime = transit
+	s.LastArrivalTime = arrival.UnixNano()
+}
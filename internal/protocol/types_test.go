@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTestResultsJSONLayout(t *testing.T) {
+	results := TestResults{
+		Start: TestStart{
+			Timestamp: NewTimestamp(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+			TestStart: TestParameters{Protocol: "UDP", NumStreams: 1},
+		},
+		Intervals: []IntervalReport{{
+			Streams: []Interval{{Socket: 4, Bytes: 1000, Sender: true}},
+			Sum:     Interval{Bytes: 1000, Sender: true},
+		}},
+		End: TestEnd{
+			Streams: []StreamEnd{{UDP: &StreamResult{Socket: 4, Packets: 10, Sender: true}}},
+			Sum:     &StreamResult{Packets: 10, Sender: true},
+		},
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	start := decoded["start"].(map[string]interface{})
+	if _, ok := start["test_start"]; !ok {
+		t.Error("Expected start.test_start section")
+	}
+	timestamp := start["timestamp"].(map[string]interface{})
+	if timestamp["time"] != "Tue, 02 Jan 2024 03:04:05 GMT" {
+		t.Errorf("Unexpected timestamp format: %v", timestamp["time"])
+	}
+
+	intervals := decoded["intervals"].([]interface{})
+	interval := intervals[0].(map[string]interface{})
+	if _, ok := interval["sum"].(map[string]interface{})["socket"]; ok {
+		t.Error("Expected interval sum without a socket")
+	}
+
+	end := decoded["end"].(map[string]interface{})
+	stream := end["streams"].([]interface{})[0].(map[string]interface{})
+	if _, ok := stream["udp"]; !ok {
+		t.Error("Expected UDP stream results under end.streams[].udp")
+	}
+	if _, ok := end["sum"]; !ok {
+		t.Error("Expected end.sum for UDP")
+	}
+}
+
+func TestRetransmitsJSON(t *testing.T) {
+	// A TCP sender reports its retransmits even when there were none
+	sender, _ := json.Marshal(StreamResult{Retransmits: NewCount(0), Sender: true})
+	receiver, _ := json.Marshal(StreamResult{})
+	var decoded map[string]interface{}
+	json.Unmarshal(sender, &decoded)
+	if decoded["retransmits"] != 0.0 {
+		t.Errorf("Expected retransmits 0 for the sender, got %s", sender)
+	}
+	decoded = nil
+	json.Unmarshal(receiver, &decoded)
+	if _, ok := decoded["retransmits"]; ok {
+		t.Errorf("Expected no retransmits for the receiver, got %s", receiver)
+	}
+
+	if sum := AddCounts(nil, NewCount(2)); CountValue(sum) != 2 || AddCounts(nil, nil) != nil {
+		t.Errorf("Unexpected sums of counts")
+	}
+}
+
+func TestUDPStats(t *testing.T) {
+	var stats UDPStats
+	start := time.Unix(1700000000, 0)
+
+	// Packets 0, 1, 3, 2, 4: one gap, filled late
+	for i, seq := range []uint32{0, 1, 3, 2, 4} {
+		header := UDPPacketHeader{Sequence: seq, Timestamp: start.UnixNano(), Magic: UDPMagic}
+		buf := make([]byte, UDPHeaderSize)
+		header.Put(buf)
+		parsed, ok := ParseUDPPacketHeader(buf)
+		if !ok || parsed != header {
+			t.Fatalf("Header did not round trip: %+v", parsed)
+		}
+		// Every packet takes 1ms longer than the one before
+		stats.Add(parsed, start.Add(time.Duration(i+1)*time.Millisecond))
+	}
+
+	if stats.TotalPackets != 5 || stats.LostPackets != 0 || stats.OutOfOrder != 1 || stats.LastSequence != 4 {
+		t.Errorf("Unexpected counters: %+v", stats)
+	}
+	// Four 1ms transit differences smoothed from zero
+	want := 1 - 15.0*15*15*15/(16*16*16*16)
+	if diff := stats.Jitter - want; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("Expected jitter %.6f ms, got %.6f ms", want, stats.Jitter)
+	}
+
+	if _, ok := ParseUDPPacketHeader(make([]byte, UDPHeaderSize)); ok {
+		t.Error("Expected a header without the magic number to be rejected")
+	}
+}
+
+func TestSubstreamResults(t *testing.T) {
+	start := map[int]int64{0: 100}
+	end := map[int]int64{2: 1000, 0: 600, 1: 0}
+
+	results := SubstreamResults(start, end, 2)
+	want := []SubstreamResult{{ID: 0, Bytes: 500, BitsPerSecond: 2000}, {ID: 2, Bytes: 1000, BitsPerSecond: 4000}}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want[i], results[i])
+		}
+	}
+}
+
+func TestPathResults(t *testing.T) {
+	intervals := []Interval{
+		{Start: 0, End: 1, Bytes: 100, Path: "192.0.2.1"},
+		{Start: 1, End: 2, Bytes: 100, Path: "192.0.2.1"},
+		{Start: 2, End: 3, Bytes: 50, Path: "198.51.100.1"},
+		{Start: 3, End: 4, Bytes: 100},
+	}
+
+	results := PathResults(intervals)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 paths, got %v", results)
+	}
+	if p := results[0]; p.Address != "192.0.2.1" || p.Start != 0 || p.End != 2 || p.Bytes != 200 || p.BitsPerSecond != 800 {
+		t.Errorf("Unexpected first path: %+v", p)
+	}
+	if p := results[1]; p.Address != "198.51.100.1" || p.Start != 2 || p.End != 3 || p.Bytes != 50 {
+		t.Errorf("Unexpected second path: %+v", p)
+	}
+}
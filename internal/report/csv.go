@@ -0,0 +1,84 @@
+package report
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// CSVHeader lists the columns of the CSV format. The set and order of the
+// columns is the same for every protocol; fields that do not apply are zero.
+var CSVHeader = []string{
+	"time", "title", "host", "port", "protocol", "direction", "stream", "type",
+	"start", "end", "seconds", "bytes", "bits_per_second",
+	"retransmits", "snd_cwnd", "rtt", "jitter_ms", "lost_packets", "packets", "lost_percent",
+}
+
+// csvReporter writes one row per stream and interval, and per stream and
+// summary at the end of the test
+type csvReporter struct {
+	w             *csv.Writer
+	opts          Options
+	tags          testTags
+	base          time.Time
+	headerWritten bool
+}
+
+// NewCSV creates a reporter producing comma-separated values
+func NewCSV(w io.Writer, opts Options) Reporter {
+	return &csvReporter{w: csv.NewWriter(w), opts: opts}
+}
+
+func (r *csvReporter) Start(results *protocol.TestResults) {
+	r.tags = newTestTags(results, r.opts)
+	r.base = startTime(results)
+
+	if !r.headerWritten {
+		r.w.Write(CSVHeader)
+		r.headerWritten = true
+	}
+	r.w.Flush()
+}
+
+func (r *csvReporter) Interval(interval *protocol.IntervalReport) {
+	r.write(intervalRecords(r.base, interval))
+}
+
+func (r *csvReporter) StreamEnd(stream *protocol.StreamEnd) {
+	r.write(streamEndRecords(r.base, stream))
+}
+
+func (r *csvReporter) Summary(results *protocol.TestResults) {
+	r.write(summaryRecords(r.base, &results.End))
+}
+
+func (r *csvReporter) write(records []record) {
+	for _, rec := range records {
+		r.w.Write([]string{
+			rec.time.UTC().Format(time.RFC3339Nano),
+			r.tags.title,
+			r.tags.host,
+			r.tags.port,
+			r.tags.protocol,
+			rec.direction,
+			rec.stream,
+			rec.kind,
+			strconv.FormatFloat(rec.start, 'f', 3, 64),
+			strconv.FormatFloat(rec.end, 'f', 3, 64),
+			strconv.FormatFloat(rec.seconds, 'f', 3, 64),
+			strconv.FormatInt(rec.bytes, 10),
+			strconv.FormatFloat(rec.bitsPerSecond, 'f', 0, 64),
+			strconv.Itoa(rec.retransmits),
+			strconv.Itoa(rec.sndCwnd),
+			strconv.Itoa(rec.rtt),
+			strconv.FormatFloat(rec.jitter, 'f', 3, 64),
+			strconv.FormatInt(rec.lostPackets, 10),
+			strconv.FormatInt(rec.packets, 10),
+			strconv.FormatFloat(rec.lostPercent, 'f', 2, 64),
+		})
+	}
+	r.w.Flush()
+}
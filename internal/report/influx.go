@@ -0,0 +1,100 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// InfluxMeasurement is the measurement name of the InfluxDB format
+const InfluxMeasurement = "iperf3"
+
+// influxReporter writes InfluxDB line protocol, one point per stream and
+// interval and per stream and summary at the end of the test
+type influxReporter struct {
+	w    io.Writer
+	opts Options
+	tags testTags
+	base time.Time
+}
+
+// NewInflux creates a reporter producing InfluxDB line protocol
+func NewInflux(w io.Writer, opts Options) Reporter {
+	return &influxReporter{w: w, opts: opts}
+}
+
+func (r *influxReporter) Start(results *protocol.TestResults) {
+	r.tags = newTestTags(results, r.opts)
+	r.base = startTime(results)
+}
+
+func (r *influxReporter) Interval(interval *protocol.IntervalReport) {
+	r.write(intervalRecords(r.base, interval))
+}
+
+func (r *influxReporter) StreamEnd(stream *protocol.StreamEnd) {
+	r.write(streamEndRecords(r.base, stream))
+}
+
+func (r *influxReporter) Summary(results *protocol.TestResults) {
+	r.write(summaryRecords(r.base, &results.End))
+}
+
+func (r *influxReporter) write(records []record) {
+	for _, rec := range records {
+		fmt.Fprintln(r.w, r.line(rec))
+	}
+}
+
+// line formats one point. Tags are sorted by key and empty tags left out,
+// as InfluxDB rejects empty tag values.
+func (r *influxReporter) line(rec record) string {
+	var b strings.Builder
+	b.WriteString(InfluxMeasurement)
+
+	for _, tag := range [][2]string{
+		{"direction", rec.direction},
+		{"host", r.tags.host},
+		{"port", r.tags.port},
+		{"protocol", r.tags.protocol},
+		{"stream", rec.stream},
+		{"title", r.tags.title},
+		{"type", rec.kind},
+	} {
+		if tag[1] != "" {
+			fmt.Fprintf(&b, ",%s=%s", tag[0], influxEscape(tag[1]))
+		}
+	}
+
+	fmt.Fprintf(&b, " bits_per_second=%s,bytes=%di,end=%s,jitter_ms=%s,lost_packets=%di,lost_percent=%s,packets=%di,retransmits=%di,rtt=%di,seconds=%s,snd_cwnd=%di,start=%s",
+		influxFloat(rec.bitsPerSecond), rec.bytes, influxFloat(rec.end), influxFloat(rec.jitter),
+		rec.lostPackets, influxFloat(rec.lostPercent), rec.packets, rec.retransmits, rec.rtt,
+		influxFloat(rec.seconds), rec.sndCwnd, influxFloat(rec.start))
+
+	fmt.Fprintf(&b, " %d", rec.time.UnixNano())
+	return b.String()
+}
+
+// influxEscaper escapes tag values in one pass, so escaped backslashes are
+// not escaped again. Line protocol has no escape for line breaks, so they
+// become spaces.
+var influxEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+
+// influxEscape escapes a tag value
+func influxEscape(s string) string {
+	return influxEscaper.Replace(s)
+}
+
+// influxFloat formats a float field. InfluxDB rejects the whole batch on an
+// infinite or NaN value, as from a zero-length interval, so those are 0.
+func influxFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,103 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// jsonReporter writes the complete results as one JSON document at the end
+type jsonReporter struct {
+	w io.Writer
+}
+
+// NewJSON creates a reporter producing iperf3's -J output
+func NewJSON(w io.Writer, opts Options) Reporter {
+	return &jsonReporter{w: w}
+}
+
+func (r *jsonReporter) Start(results *protocol.TestResults)        {}
+func (r *jsonReporter) Interval(interval *protocol.IntervalReport) {}
+func (r *jsonReporter) StreamEnd(stream *protocol.StreamEnd)       {}
+
+func (r *jsonReporter) Summary(results *protocol.TestResults) {
+	r.write(results)
+}
+
+func (r *jsonReporter) Error(err error) {
+	r.write(map[string]string{"error": err.Error()})
+}
+
+func (r *jsonReporter) write(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("Failed to marshal JSON output: %v", err)
+		return
+	}
+	fmt.Fprintln(r.w, string(data))
+}
+
+// jsonStreamReporter writes one JSON object per line for each event, using
+// the event names of iperf3's --json-stream
+type jsonStreamReporter struct {
+	w io.Writer
+}
+
+// NewJSONStream creates a reporter producing iperf3's --json-stream output
+func NewJSONStream(w io.Writer, opts Options) Reporter {
+	return &jsonStreamReporter{w: w}
+}
+
+func (r *jsonStreamReporter) Start(results *protocol.TestResults) {
+	r.emit("start", results.Start)
+}
+
+func (r *jsonStreamReporter) Interval(interval *protocol.IntervalReport) {
+	r.emit("interval", interval)
+}
+
+func (r *jsonStreamReporter) StreamEnd(stream *protocol.StreamEnd) {}
+
+func (r *jsonStreamReporter) Summary(results *protocol.TestResults) {
+	r.emit("end", results.End)
+	// Partial results are followed by why the test stopped early
+	if results.Error != "" {
+		r.emit("error", results.Error)
+	}
+	if len(results.ServerOutputJSON) > 0 {
+		r.emit("server_output_json", results.ServerOutputJSON)
+	} else if results.ServerOutputText != "" {
+		r.emit("server_output_text", results.ServerOutputText)
+	}
+}
+
+func (r *jsonStreamReporter) Error(err error) {
+	r.emit("error", err.Error())
+}
+
+func (r *jsonStreamReporter) Queued(position int) {
+	r.emit("queued", protocol.QueuePosition{Position: position})
+}
+
+func (r *jsonStreamReporter) Retrying(err error, delay time.Duration) {
+	r.emit("retrying", struct {
+		Error string  `json:"error"`
+		Delay float64 `json:"delay"`
+	}{err.Error(), delay.Seconds()})
+}
+
+func (r *jsonStreamReporter) emit(event string, data interface{}) {
+	line, err := json.Marshal(struct {
+		Event string      `json:"event"`
+		Data  interface{} `json:"data"`
+	}{event, data})
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", event, err)
+		return
+	}
+	fmt.Fprintln(r.w, string(line))
+}
@@ -0,0 +1,186 @@
+package report
+
+import (
+	"strconv"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// testTags identify the test a measurement belongs to
+type testTags struct {
+	title    string
+	host     string
+	port     string
+	protocol string
+}
+
+// newTestTags extracts the tags of a test: the peer host, the server port,
+// the protocol and the title
+func newTestTags(results *protocol.TestResults, opts Options) testTags {
+	tags := testTags{
+		title:    results.Title,
+		protocol: results.Start.TestStart.Protocol,
+	}
+
+	if opts.Server {
+		if len(results.Start.Connected) > 0 {
+			conn := results.Start.Connected[0]
+			tags.host = conn.RemoteHost
+			tags.port = strconv.Itoa(conn.LocalPort)
+		}
+	} else if results.Start.ConnectingTo != nil {
+		tags.host = results.Start.ConnectingTo.Host
+		tags.port = strconv.Itoa(results.Start.ConnectingTo.Port)
+	}
+
+	return tags
+}
+
+// record is one flat measurement, shared by the CSV and InfluxDB formats
+type record struct {
+	time          time.Time
+	kind          string // interval, stream or sum
+	direction     string // sender or receiver
+	stream        string // socket number or SUM
+	start         float64
+	end           float64
+	seconds       float64
+	bytes         int64
+	bitsPerSecond float64
+	retransmits   int
+	sndCwnd       int
+	rtt           int
+	jitter        float64
+	lostPackets   int64
+	packets       int64
+	lostPercent   float64
+}
+
+func direction(sender bool) string {
+	if sender {
+		return "sender"
+	}
+	return "receiver"
+}
+
+func streamID(socket int) string {
+	if socket == 0 {
+		return "SUM"
+	}
+	return strconv.Itoa(socket)
+}
+
+// sumBidirReverse identifies the sums of the streams of a bidirectional test
+// that run from the server to the client
+const sumBidirReverse = "SUM_BIDIR_REVERSE"
+
+// intervalRecord flattens an interval measurement; base is the test start time
+func intervalRecord(base time.Time, iv *protocol.Interval) record {
+	return record{
+		time:          base.Add(time.Duration(iv.End * float64(time.Second))),
+		kind:          "interval",
+		direction:     direction(iv.Sender),
+		stream:        streamID(iv.Socket),
+		start:         iv.Start,
+		end:           iv.End,
+		seconds:       iv.Seconds,
+		bytes:         iv.Bytes,
+		bitsPerSecond: iv.BitsPerSecond,
+		retransmits:   protocol.CountValue(iv.Retransmits),
+		sndCwnd:       iv.SndCwnd,
+		rtt:           iv.RTT,
+		jitter:        iv.Jitter,
+		lostPackets:   iv.LostPackets,
+		packets:       iv.Packets,
+		lostPercent:   iv.LostPercent,
+	}
+}
+
+// resultRecord flattens the final results of a stream or of the whole test
+func resultRecord(base time.Time, kind string, res *protocol.StreamResult) record {
+	return record{
+		time:          base.Add(time.Duration(res.End * float64(time.Second))),
+		kind:          kind,
+		direction:     direction(res.Sender),
+		stream:        streamID(res.Socket),
+		start:         res.Start,
+		end:           res.End,
+		seconds:       res.Seconds,
+		bytes:         res.Bytes,
+		bitsPerSecond: res.BitsPerSecond,
+		retransmits:   protocol.CountValue(res.Retransmits),
+		sndCwnd:       res.MaxSndCwnd,
+		rtt:           res.MeanRTT,
+		jitter:        res.Jitter,
+		lostPackets:   res.LostPackets,
+		packets:       res.Packets,
+		lostPercent:   res.LostPercent,
+	}
+}
+
+// intervalRecords flattens an interval report: every stream, plus the sum
+// when there is more than one stream, and the sum of the streams running
+// the other way in a bidirectional test
+func intervalRecords(base time.Time, interval *protocol.IntervalReport) []record {
+	var records []record
+	for i := range interval.Streams {
+		records = append(records, intervalRecord(base, &interval.Streams[i]))
+	}
+	if len(interval.Streams) > 1 {
+		sum := interval.Sum
+		sum.Socket = 0
+		records = append(records, intervalRecord(base, &sum))
+	}
+	if interval.SumBidirReverse != nil {
+		rec := intervalRecord(base, interval.SumBidirReverse)
+		rec.stream = sumBidirReverse
+		records = append(records, rec)
+	}
+	return records
+}
+
+// streamEndRecords flattens the final results of one stream
+func streamEndRecords(base time.Time, stream *protocol.StreamEnd) []record {
+	var records []record
+	for _, res := range []*protocol.StreamResult{stream.Sender, stream.Receiver, stream.UDP} {
+		if res != nil {
+			records = append(records, resultRecord(base, "stream", res))
+		}
+	}
+	return records
+}
+
+// summaryRecords flattens the test totals, those of the streams running
+// from the server to the client in a bidirectional test included
+func summaryRecords(base time.Time, end *protocol.TestEnd) []record {
+	records := sumRecords(base, "SUM", end.Sum, &end.SumSent, &end.SumReceived)
+	return append(records, sumRecords(base, sumBidirReverse, end.SumBidirReverse, end.SumSentBidirReverse, end.SumReceivedBidirReverse)...)
+}
+
+// sumRecords flattens the totals of the streams running one way: the UDP
+// sum if there is one, and otherwise those of the sending and receiving ends
+func sumRecords(base time.Time, stream string, udp, sent, received *protocol.StreamResult) []record {
+	var records []record
+	if udp != nil {
+		rec := resultRecord(base, "sum", udp)
+		rec.stream = stream
+		return append(records, rec)
+	}
+	for _, res := range []*protocol.StreamResult{sent, received} {
+		if res != nil && res.Seconds > 0 {
+			rec := resultRecord(base, "sum", res)
+			rec.stream = stream
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// startTime returns the wall-clock start of a test
+func startTime(results *protocol.TestResults) time.Time {
+	if results.Start.Timestamp.Timesecs == 0 {
+		return time.Now()
+	}
+	return time.Unix(results.Start.Timestamp.Timesecs, 0)
+}
@@ -0,0 +1,177 @@
+// Package report renders test events in the output formats supported by
+// the client and the server: iperf3 text, JSON, JSON stream, CSV and
+// InfluxDB line protocol.
+// Additional formats can be plugged in with Register.
+package report
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// Reporter receives the events of a test as it runs and renders them.
+// The results passed to Start are filled in further as the test progresses;
+// by the time Summary is called they are complete.
+type Reporter interface {
+	// Start is called once the connections are set up and the test begins
+	Start(results *protocol.TestResults)
+	// Interval is called at the end of each reporting interval
+	Interval(interval *protocol.IntervalReport)
+	// StreamEnd is called with the final results of each stream
+	StreamEnd(stream *protocol.StreamEnd)
+	// Summary is called with the complete results once the test is over
+	Summary(results *protocol.TestResults)
+}
+
+// ErrorReporter is implemented by reporters that render test failures
+type ErrorReporter interface {
+	Error(err error)
+}
+
+// WaitReporter is implemented by reporters that show the client waiting for
+// a busy server before the test starts
+type WaitReporter interface {
+	// Queued is called when the server queues the test, and again each
+	// time it moves up; position 1 is next in line
+	Queued(position int)
+	// Retrying is called when the server refused the test as busy, before
+	// trying again after delay
+	Retrying(err error, delay time.Duration)
+}
+
+// Options configures a reporter
+type Options struct {
+	// Server selects the server's point of view: it receives the data and
+	// reports accepted connections rather than the host it connects to
+	Server bool
+
+	// Units is the -f unit for bitrates: k/m/g/t for bits, K/M/G/T for
+	// bytes, 'a' or 'A' (or zero) to pick one adaptively
+	Units byte
+
+	// Title is the test's -T title, prefixed on text output lines from the
+	// first, including those printed while waiting for the server
+	Title string
+}
+
+// Factory creates a reporter writing to w
+type Factory func(w io.Writer, opts Options) Reporter
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		"text":        NewText,
+		"json":        NewJSON,
+		"json-stream": NewJSONStream,
+		"csv":         NewCSV,
+		"influx":      NewInflux,
+	}
+)
+
+// Register makes a reporter format available by name, replacing any
+// existing format of the same name
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// New creates a reporter for the named format
+func New(name string, w io.Writer, opts Options) (Reporter, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output format: %s", name)
+	}
+	return factory(w, opts), nil
+}
+
+// Formats returns the names of the registered formats
+func Formats() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReportError passes err to r if it renders errors
+func ReportError(r Reporter, err error) {
+	if er, ok := r.(ErrorReporter); ok {
+		er.Error(err)
+	}
+}
+
+// ReportQueued passes the test's place in the server's queue to r if it
+// shows waiting
+func ReportQueued(r Reporter, position int) {
+	if wr, ok := r.(WaitReporter); ok {
+		wr.Queued(position)
+	}
+}
+
+// ReportRetrying passes a retry of a busy server to r if it shows waiting
+func ReportRetrying(r Reporter, err error, delay time.Duration) {
+	if wr, ok := r.(WaitReporter); ok {
+		wr.Retrying(err, delay)
+	}
+}
+
+// Multi returns a reporter that forwards every event to all of reporters
+func Multi(reporters ...Reporter) Reporter {
+	return multiReporter(reporters)
+}
+
+type multiReporter []Reporter
+
+func (m multiReporter) Start(results *protocol.TestResults) {
+	for _, r := range m {
+		r.Start(results)
+	}
+}
+
+func (m multiReporter) Interval(interval *protocol.IntervalReport) {
+	for _, r := range m {
+		r.Interval(interval)
+	}
+}
+
+func (m multiReporter) StreamEnd(stream *protocol.StreamEnd) {
+	for _, r := range m {
+		r.StreamEnd(stream)
+	}
+}
+
+func (m multiReporter) Summary(results *protocol.TestResults) {
+	for _, r := range m {
+		r.Summary(results)
+	}
+}
+
+func (m multiReporter) Error(err error) {
+	for _, r := range m {
+		ReportError(r, err)
+	}
+}
+
+func (m multiReporter) Queued(position int) {
+	for _, r := range m {
+		ReportQueued(r, position)
+	}
+}
+
+func (m multiReporter) Retrying(err error, delay time.Duration) {
+	for _, r := range m {
+		ReportRetrying(r, err, delay)
+	}
+}
@@ -0,0 +1,234 @@
+package report
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+func testResults() *protocol.TestResults {
+	return &protocol.TestResults{
+		Start: protocol.TestStart{
+			Connected: []protocol.Connection{{
+				Socket: 4, LocalHost: "192.0.2.2", LocalPort: 40000, RemoteHost: "192.0.2.1", RemotePort: 5201,
+			}},
+			ConnectingTo: &protocol.ConnectingTo{Host: "192.0.2.1", Port: 5201},
+			TestStart:    protocol.TestParameters{Protocol: "TCP", NumStreams: 1},
+		},
+		Title: "circuit-42",
+	}
+}
+
+func TestTextTitlePrefix(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewText(&buf, Options{Title: "circuit-42"})
+
+	// Lines printed while waiting for the server are prefixed too
+	ReportQueued(rep, 1)
+	rep.Start(testResults())
+
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "circuit-42:  ") {
+			t.Errorf("Expected title prefix on %q", line)
+		}
+	}
+	if !strings.Contains(buf.String(), "Connecting to host 192.0.2.1, port 5201") {
+		t.Errorf("Expected client connecting line, got %q", buf.String())
+	}
+}
+
+func TestTextServerStreamEnd(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewText(&buf, Options{Server: true})
+
+	results := testResults()
+	results.Title = ""
+	rep.Start(results)
+	rep.StreamEnd(&protocol.StreamEnd{Receiver: &protocol.StreamResult{Socket: 1, End: 10, Seconds: 10, Bytes: 1 << 20}})
+	rep.Summary(results)
+
+	out := buf.String()
+	if !strings.Contains(out, "Accepted connection from 192.0.2.1, port 5201") {
+		t.Errorf("Expected accepted connection line, got %q", out)
+	}
+	if !strings.Contains(out, "receiver") || strings.Contains(out, "iperf Done.") {
+		t.Errorf("Unexpected server summary: %q", out)
+	}
+}
+
+func TestTextPathChange(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewText(&buf, Options{})
+
+	results := testResults()
+	results.Title = ""
+	rep.Start(results)
+	for i, path := range []string{"192.0.2.1", "198.51.100.1"} {
+		iv := protocol.Interval{Socket: 1, Start: float64(i), End: float64(i + 1), Seconds: 1, Bytes: 1 << 20, Sender: true, Path: path}
+		rep.Interval(&protocol.IntervalReport{Streams: []protocol.Interval{iv}, Sum: iv})
+	}
+	rep.StreamEnd(&protocol.StreamEnd{Sender: &protocol.StreamResult{
+		Socket: 1, End: 2, Seconds: 2, Bytes: 2 << 20, Sender: true,
+		Paths: []protocol.PathResult{
+			{Address: "192.0.2.1", End: 1, Seconds: 1, Bytes: 1 << 20},
+			{Address: "198.51.100.1", Start: 1, End: 2, Seconds: 1, Bytes: 1 << 20},
+		},
+	}})
+
+	out := buf.String()
+	if !strings.Contains(out, "primary path changed from 192.0.2.1 to 198.51.100.1") {
+		t.Errorf("Expected path change line, got %q", out)
+	}
+	if !strings.Contains(out, "path 198.51.100.1\n") {
+		t.Errorf("Expected per-path summary lines, got %q", out)
+	}
+}
+
+func TestTextBidir(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewText(&buf, Options{})
+
+	// Stream 1 runs from the client to the server, stream 2 the other way
+	results := testResults()
+	results.Title = ""
+	results.Start.TestStart.NumStreams = 2
+	results.Start.TestStart.Bidir = 1
+	rep.Start(results)
+	tx := protocol.Interval{Socket: 1, End: 1, Seconds: 1, Bytes: 1 << 20, Sender: true}
+	rx := protocol.Interval{Socket: 2, End: 1, Seconds: 1, Bytes: 1 << 20}
+	rep.Interval(&protocol.IntervalReport{Streams: []protocol.Interval{tx, rx}, Sum: tx, SumBidirReverse: &rx})
+	rep.StreamEnd(&protocol.StreamEnd{
+		Sender:   &protocol.StreamResult{Socket: 1, End: 1, Seconds: 1, Bytes: 1 << 20, Sender: true},
+		Receiver: &protocol.StreamResult{Socket: 1, End: 1, Seconds: 1, Bytes: 1 << 20},
+	})
+	rep.Summary(results)
+
+	out := buf.String()
+	for _, want := range []string{"[ ID][Role] Interval", "[  1][TX-C]   0.00-1.00", "[  2][RX-C]   0.00-1.00", "[  1][TX-C]   0.00-1.00   sec  1.00 MBytes"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in %q", want, out)
+		}
+	}
+	// With one stream each way, there is nothing to sum
+	if strings.Contains(out, "SUM") {
+		t.Errorf("Unexpected sums in %q", out)
+	}
+}
+
+func TestJSONStreamEvents(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewJSONStream(&buf, Options{})
+
+	rep.Interval(&protocol.IntervalReport{Sum: protocol.Interval{Bytes: 10}})
+	ReportError(rep, errors.New("unable to connect to server"))
+	ReportQueued(Multi(rep), 3)
+	ReportRetrying(rep, errors.New("server busy"), 1500*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %d: %q", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], `{"event":"interval","data":{"streams":null,"sum":{`) {
+		t.Errorf("Unexpected interval event: %s", lines[0])
+	}
+	if lines[1] != `{"event":"error","data":"unable to connect to server"}` {
+		t.Errorf("Unexpected error event: %s", lines[1])
+	}
+	if lines[2] != `{"event":"queued","data":{"position":3}}` || lines[3] != `{"event":"retrying","data":{"error":"server busy","delay":1.5}}` {
+		t.Errorf("Unexpected wait events: %s", lines[2:])
+	}
+}
+
+func TestCSVHeaderOnce(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewCSV(&buf, Options{})
+
+	results := testResults()
+	results.Start.Timestamp = protocol.NewTimestamp(time.Unix(1700000000, 0))
+	rep.Start(results)
+	rep.Interval(&protocol.IntervalReport{Streams: []protocol.Interval{{Socket: 4, End: 1, Seconds: 1, Bytes: 125, Sender: true}}})
+	rep.Start(results)
+
+	want := strings.Join(CSVHeader, ",") + "\n" +
+		"2023-11-14T22:13:21Z,circuit-42,192.0.2.1,5201,TCP,sender,4,interval,0.000,1.000,1.000,125,0,0,0,0,0.000,0,0,0.00\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewInflux(&buf, Options{Server: true})
+
+	results := testResults()
+	results.Title = "circuit 42"
+	results.Start.Timestamp = protocol.NewTimestamp(time.Unix(1700000000, 0))
+	rep.Start(results)
+	rep.Summary(&protocol.TestResults{End: protocol.TestEnd{
+		SumReceived: protocol.StreamResult{End: 10, Seconds: 10, Bytes: 1250, BitsPerSecond: 1000},
+	}})
+
+	want := `iperf3,direction=receiver,host=192.0.2.1,port=40000,protocol=TCP,stream=SUM,title=circuit\ 42,type=sum ` +
+		"bits_per_second=1000,bytes=1250i,end=10,jitter_ms=0,lost_packets=0i,lost_percent=0,packets=0i,retransmits=0i,rtt=0i,seconds=10,snd_cwnd=0i,start=0 " +
+		"1700000010000000000\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestInfluxEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	rep := NewInflux(&buf, Options{Server: true})
+
+	results := testResults()
+	results.Title = "lab\\a,b=c\nd"
+	rep.Start(results)
+	// A zero-length interval has an infinite bitrate
+	iv := protocol.Interval{Socket: 1, Start: 1, End: 1, Bytes: 1250, BitsPerSecond: math.Inf(1), LostPercent: math.NaN()}
+	rep.Interval(&protocol.IntervalReport{Streams: []protocol.Interval{iv}, Sum: iv})
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 || !strings.Contains(line, `,title=lab\\a\,b\=c\ d,`) {
+		t.Errorf("Expected an escaped title on one line, got %q", line)
+	}
+	if !strings.Contains(line, " bits_per_second=0,") || !strings.Contains(line, ",lost_percent=0,") {
+		t.Errorf("Expected non-finite fields written as 0, got %q", line)
+	}
+}
+
+type countingReporter struct {
+	starts, summaries int
+}
+
+func (r *countingReporter) Start(results *protocol.TestResults)        { r.starts++ }
+func (r *countingReporter) Interval(interval *protocol.IntervalReport) {}
+func (r *countingReporter) StreamEnd(stream *protocol.StreamEnd)       {}
+func (r *countingReporter) Summary(results *protocol.TestResults)      { r.summaries++ }
+
+func TestRegisterAndMulti(t *testing.T) {
+	counter := &countingReporter{}
+	Register("counting", func(w io.Writer, opts Options) Reporter { return counter })
+
+	rep, err := New("counting", io.Discard, Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	multi := Multi(rep, NewJSON(io.Discard, Options{}))
+	multi.Start(testResults())
+	multi.Summary(testResults())
+
+	if counter.starts != 1 || counter.summaries != 1 {
+		t.Errorf("Expected one start and summary, got %d and %d", counter.starts, counter.summaries)
+	}
+
+	if _, err := New("no-such-format", io.Discard, Options{}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
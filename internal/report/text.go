@@ -0,0 +1,308 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/units"
+)
+
+// textReporter writes human-readable output in the style of iperf3
+type textReporter struct {
+	w    io.Writer
+	opts Options
+
+	title          string
+	udp            bool
+	sender         bool
+	params         protocol.TestParameters
+	summaryStarted bool
+	// paths holds the last path reported for each stream
+	paths map[int]string
+}
+
+// NewText creates a reporter producing iperf3's default text output
+func NewText(w io.Writer, opts Options) Reporter {
+	return &textReporter{w: w, opts: opts, title: opts.Title}
+}
+
+// printf writes a line of output, prefixed with the test title if one was set
+func (r *textReporter) printf(format string, a ...interface{}) {
+	if r.title != "" {
+		fmt.Fprintf(r.w, "%s:  ", r.title)
+	}
+	fmt.Fprintf(r.w, format, a...)
+}
+
+func (r *textReporter) Queued(position int) {
+	r.printf("Waiting for the server: test queued at position %d\n", position)
+}
+
+func (r *textReporter) Retrying(err error, delay time.Duration) {
+	r.printf("%v; retrying in %s\n", err, delay.Round(100*time.Millisecond))
+}
+
+func (r *textReporter) Start(results *protocol.TestResults) {
+	if results.Title != "" {
+		r.title = results.Title
+	}
+	r.udp = strings.EqualFold(results.Start.TestStart.Protocol, "udp")
+	// The client sends and the server receives, unless the test is
+	// reversed; both do in a bidirectional test
+	r.params = results.Start.TestStart
+	r.sender = !r.opts.Server
+	if r.params.Reverse != 0 {
+		r.sender = !r.sender
+	}
+	r.sender = r.sender || r.params.Bidir != 0
+	r.summaryStarted = false
+	r.paths = make(map[int]string)
+
+	if r.opts.Server {
+		if len(results.Start.Connected) > 0 {
+			conn := results.Start.Connected[0]
+			r.printf("Accepted connection from %s, port %d\n", conn.RemoteHost, conn.RemotePort)
+		}
+	} else if results.Start.ConnectingTo != nil {
+		r.printf("Connecting to host %s, port %d\n", results.Start.ConnectingTo.Host, results.Start.ConnectingTo.Port)
+	}
+
+	for _, conn := range results.Start.Connected {
+		// Say whether MPTCP was used or fell back to TCP, if it was asked for,
+		// and describe the TLS session, if any
+		var suffix string
+		switch {
+		case conn.MPTCP:
+			suffix = " using MPTCP"
+		case results.Start.TestStart.MPTCP:
+			suffix = " using TCP (MPTCP not available)"
+		}
+		if conn.TLS != nil {
+			suffix += fmt.Sprintf(" over %s %s (handshake %.2f ms)", conn.TLS.Version, conn.TLS.CipherSuite, conn.TLS.HandshakeMS)
+		}
+		r.printf("[%3d] local %s port %d connected to %s port %d%s\n",
+			conn.Socket, conn.LocalHost, conn.LocalPort, conn.RemoteHost, conn.RemotePort, suffix)
+	}
+
+	switch {
+	case r.udp && r.sender:
+		r.printf("%s Interval           Transfer     Bitrate         Total Datagrams\n", r.idHeader())
+	case r.udp:
+		r.printf("%s Interval           Transfer     Bitrate         Jitter    Lost/Total Datagrams\n", r.idHeader())
+	case r.sender:
+		r.printf("%s Interval           Transfer     Bitrate         Retr  Cwnd\n", r.idHeader())
+	default:
+		r.printf("%s Interval           Transfer     Bitrate\n", r.idHeader())
+	}
+}
+
+// idHeader is the heading of the ID column, which in a bidirectional test
+// also gives each line's role
+func (r *textReporter) idHeader() string {
+	if r.params.Bidir != 0 {
+		return "[ ID][Role]"
+	}
+	return "[ ID]"
+}
+
+// label returns the ID column for id, tagged in a bidirectional test with
+// the role of our end of the streams that run from the server to the client
+// if reversed is set, and the other way if not: TX-C for the client sending
+// and RX-S for the server receiving, say
+func (r *textReporter) label(id string, reversed bool) string {
+	if r.params.Bidir == 0 {
+		return id
+	}
+	direction, side := "RX", "C"
+	if reversed == r.opts.Server {
+		direction = "TX"
+	}
+	if r.opts.Server {
+		side = "S"
+	}
+	return fmt.Sprintf("%s][%s-%s", id, direction, side)
+}
+
+// streamLabel returns the ID column for a stream
+func (r *textReporter) streamLabel(socket int) string {
+	return r.label(fmt.Sprintf("%3d", socket), r.params.Reversed(socket))
+}
+
+// sums reports whether there are several streams running each way, to be
+// summed up
+func (r *textReporter) sums(streams int) bool {
+	if r.params.Bidir != 0 {
+		streams /= 2
+	}
+	return streams > 1
+}
+
+func (r *textReporter) Interval(interval *protocol.IntervalReport) {
+	for _, stream := range interval.Streams {
+		if last := r.paths[stream.Socket]; stream.Path != "" && last != "" && stream.Path != last {
+			r.printf("[%3d] primary path changed from %s to %s\n", stream.Socket, last, stream.Path)
+		}
+		if stream.Path != "" {
+			r.paths[stream.Socket] = stream.Path
+		}
+		r.intervalLine(r.streamLabel(stream.Socket), &stream)
+	}
+	if r.sums(len(interval.Streams)) {
+		r.intervalLine(r.label("SUM", false), &interval.Sum)
+		if interval.SumBidirReverse != nil {
+			r.intervalLine(r.label("SUM", true), interval.SumBidirReverse)
+		}
+	}
+}
+
+func (r *textReporter) intervalLine(id string, iv *protocol.Interval) {
+	line := r.rateColumns(id, iv.Start, iv.End, iv.Bytes, iv.BitsPerSecond)
+
+	switch {
+	case r.udp && iv.Sender:
+		line += fmt.Sprintf("  %d", iv.Packets)
+	case r.udp:
+		line += fmt.Sprintf("  %6.3f ms  %d/%d (%.2g%%)", iv.Jitter, iv.LostPackets, iv.Packets, iv.LostPercent)
+	case iv.Sender && iv.Socket == 0:
+		// The congestion window is per stream
+		line += fmt.Sprintf("  %4d", protocol.CountValue(iv.Retransmits))
+	case iv.Sender:
+		line += fmt.Sprintf("  %4d  %ss", protocol.CountValue(iv.Retransmits), units.Format(float64(iv.SndCwnd), 'A'))
+	}
+	r.printf("%s\n", line)
+}
+
+// startSummary prints the separator and header ahead of the final results
+func (r *textReporter) startSummary() {
+	if r.summaryStarted {
+		return
+	}
+	r.summaryStarted = true
+
+	r.printf("- - - - - - - - - - - - - - - - - - - - - - - - -\n")
+	switch {
+	case r.udp:
+		r.printf("%s Interval           Transfer     Bitrate         Jitter    Lost/Total Datagrams\n", r.idHeader())
+	case !r.opts.Server || r.sender:
+		r.printf("%s Interval           Transfer     Bitrate         Retr\n", r.idHeader())
+	default:
+		r.printf("%s Interval           Transfer     Bitrate\n", r.idHeader())
+	}
+}
+
+func (r *textReporter) StreamEnd(stream *protocol.StreamEnd) {
+	r.startSummary()
+
+	if res := stream.UDP; res != nil {
+		r.udpSummaryLine(r.streamLabel(res.Socket), res)
+	}
+	if res := stream.Sender; res != nil {
+		r.senderLine(r.streamLabel(res.Socket), res)
+		r.substreamLines(res, "sender")
+		r.pathLines(res)
+	}
+	if res := stream.Receiver; res != nil {
+		r.receiverLine(r.streamLabel(res.Socket), res)
+		r.substreamLines(res, "receiver")
+	}
+}
+
+// senderLine prints the final results of a sending end
+func (r *textReporter) senderLine(id string, res *protocol.StreamResult) {
+	r.printf("%s  %4d             sender\n",
+		r.rateColumns(id, res.Start, res.End, res.Bytes, res.BitsPerSecond), protocol.CountValue(res.Retransmits))
+}
+
+// receiverLine prints the final results of a receiving end
+func (r *textReporter) receiverLine(id string, res *protocol.StreamResult) {
+	r.printf("%s                  receiver\n",
+		r.rateColumns(id, res.Start, res.End, res.Bytes, res.BitsPerSecond))
+}
+
+// substreamLines breaks a stream's result down by substream, identified as
+// <stream>.<substream>, if it used more than one
+func (r *textReporter) substreamLines(res *protocol.StreamResult, role string) {
+	if len(res.Substreams) < 2 {
+		return
+	}
+	for _, sub := range res.Substreams {
+		r.printf("%s                  %s\n",
+			r.rateColumns(r.label(fmt.Sprintf("%3s", fmt.Sprintf("%d.%d", res.Socket, sub.ID)), r.params.Reversed(res.Socket)), res.Start, res.End, sub.Bytes, sub.BitsPerSecond), role)
+	}
+}
+
+// pathLines breaks a stream's result down by the paths that carried it, if
+// the primary path changed during the test
+func (r *textReporter) pathLines(res *protocol.StreamResult) {
+	if len(res.Paths) < 2 {
+		return
+	}
+	for _, path := range res.Paths {
+		r.printf("%s        path %s\n",
+			r.rateColumns(r.streamLabel(res.Socket), path.Start, path.End, path.Bytes, path.BitsPerSecond), path.Address)
+	}
+}
+
+func (r *textReporter) udpSummaryLine(id string, res *protocol.StreamResult) {
+	role := "receiver"
+	if res.Sender {
+		role = "sender"
+	}
+	r.printf("%s  %6.3f ms  %d/%d (%.2g%%)  %s\n",
+		r.rateColumns(id, res.Start, res.End, res.Bytes, res.BitsPerSecond),
+		res.Jitter, res.LostPackets, res.Packets, res.LostPercent, role)
+}
+
+func (r *textReporter) Summary(results *protocol.TestResults) {
+	r.startSummary()
+
+	if end := &results.End; r.sums(len(end.Streams)) {
+		r.sumLines(false, end.Sum, &end.SumSent, &end.SumReceived)
+		if r.params.Bidir != 0 {
+			r.sumLines(true, end.SumBidirReverse, end.SumSentBidirReverse, end.SumReceivedBidirReverse)
+		}
+	}
+
+	if results.ServerOutputText != "" {
+		fmt.Fprintln(r.w)
+		r.printf("Server output:\n")
+		fmt.Fprint(r.w, results.ServerOutputText)
+	}
+
+	switch {
+	case results.Error != "":
+		fmt.Fprintln(r.w)
+		r.printf("iperf3-go: %s\n", results.Error)
+	case !r.opts.Server:
+		fmt.Fprintln(r.w)
+		r.printf("iperf Done.\n")
+	}
+}
+
+// sumLines prints the totals of the streams running from the server to the
+// client if reversed is set, and the other way if not: the UDP sum, or the
+// sums of the ends we know of
+func (r *textReporter) sumLines(reversed bool, udp, sent, received *protocol.StreamResult) {
+	id := r.label("SUM", reversed)
+	if r.udp {
+		if udp != nil {
+			r.udpSummaryLine(id, udp)
+		}
+		return
+	}
+	if sent != nil && sent.Seconds > 0 {
+		r.senderLine(id, sent)
+	}
+	if received != nil && received.Seconds > 0 {
+		r.receiverLine(id, received)
+	}
+}
+
+// rateColumns formats the ID, interval, transfer and bitrate columns
+func (r *textReporter) rateColumns(id string, start, end float64, bytes int64, bitsPerSecond float64) string {
+	return fmt.Sprintf("[%s] %6.2f-%-6.2f sec  %ss  %ss/sec",
+		id, start, end, units.Format(float64(bytes), 'A'), units.Format(bitsPerSecond/8, r.opts.Units))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/units"
+)
+
+// defaultDuration is the length of tests whose client did not give one
+const defaultDuration = 10 * time.Second
+
+// defaultBitrateInterval is the period the bitrate limit is averaged over
+// when none is given, as in iperf3
+const defaultBitrateInterval = 5 * time.Second
+
+// Limits bounds the tests a server runs. Zero fields are unlimited.
+type Limits struct {
+	// Duration is the longest test a client may ask for
+	Duration time.Duration
+	// Parallel is the most data streams a test may have
+	Parallel int
+	// Bitrate is the highest total bitrate in bits/sec, as with iperf3's
+	// --server-bitrate-limit: tests asking for more are refused, and tests
+	// averaging more over BitrateInterval (5 seconds by default) are stopped
+	Bitrate         int64
+	BitrateInterval time.Duration
+	// Length is the largest block length, in bytes
+	Length int
+}
+
+// testDuration returns how long the test configured by config runs
+func testDuration(config *protocol.TestConfig) time.Duration {
+	if config.Time <= 0 {
+		return defaultDuration
+	}
+	return time.Duration(config.Time) * time.Second
+}
+
+// check returns the error to send a client whose test goes over a limit, or
+// nil if the test can run
+func (l *Limits) check(config *protocol.TestConfig) *protocol.ErrorMessage {
+	if l.Duration > 0 && testDuration(config) > l.Duration {
+		secs := int64(l.Duration / time.Second)
+		return &protocol.ErrorMessage{
+			Code:      protocol.ErrorCodeInvalidParameter,
+			Message:   fmt.Sprintf("test duration of %d seconds exceeds the server's limit of %d", int64(testDuration(config)/time.Second), secs),
+			Parameter: "time",
+			Limit:     secs,
+		}
+	}
+	streams := max(config.Parallel, 1)
+	if l.Parallel > 0 && streams > l.Parallel {
+		return l.parallelError(streams)
+	}
+	if l.Length > 0 && config.Length > l.Length {
+		return &protocol.ErrorMessage{
+			Code:      protocol.ErrorCodeInvalidParameter,
+			Message:   fmt.Sprintf("block length of %d bytes exceeds the server's limit of %d", config.Length, l.Length),
+			Parameter: "len",
+			Limit:     int64(l.Length),
+		}
+	}
+	if total := config.Bandwidth * int64(config.Streams()); l.Bitrate > 0 && total > l.Bitrate {
+		return l.bitrateError(fmt.Sprintf("total required bitrate of %s", formatBitrate(total)))
+	}
+	return nil
+}
+
+// parallelError is the error for a test with more streams than allowed
+func (l *Limits) parallelError(streams int) *protocol.ErrorMessage {
+	return &protocol.ErrorMessage{
+		Code:      protocol.ErrorCodeInvalidParameter,
+		Message:   fmt.Sprintf("%d parallel streams exceed the server's limit of %d", streams, l.Parallel),
+		Parameter: "parallel",
+		Limit:     int64(l.Parallel),
+	}
+}
+
+// bitrateError is the error for a test going over the bitrate limit, where
+// what describes the offending bitrate
+func (l *Limits) bitrateError(what string) *protocol.ErrorMessage {
+	return &protocol.ErrorMessage{
+		Code:      protocol.ErrorCodeInvalidParameter,
+		Message:   fmt.Sprintf("%s is larger than the server's limit of %s", what, formatBitrate(l.Bitrate)),
+		Parameter: "bandwidth",
+		Limit:     l.Bitrate,
+	}
+}
+
+// formatBitrate formats a bitrate in bits/sec for messages
+func formatBitrate(bps int64) string {
+	return strings.TrimSpace(units.Format(float64(bps)/8, 'a')) + "s/sec"
+}
+
+// bitrateMonitor averages a test's total bitrate over its last intervals, to
+// stop tests going over the server's bitrate limit
+type bitrateMonitor struct {
+	limits  *Limits
+	bytes   []int64
+	seconds []float64
+}
+
+// newBitrateMonitor returns a monitor for limits, or nil if the bitrate is
+// not limited
+func newBitrateMonitor(limits *Limits) *bitrateMonitor {
+	if limits.Bitrate <= 0 {
+		return nil
+	}
+	return &bitrateMonitor{limits: limits}
+}
+
+// add records an interval of the test and returns the error to stop the
+// test with if the bitrate averaged over the limit's interval is too high.
+// Nothing is checked until the test has run for that interval.
+func (m *bitrateMonitor) add(iv *protocol.Interval) *protocol.ErrorMessage {
+	if m == nil {
+		return nil
+	}
+	period := m.limits.BitrateInterval
+	if period <= 0 {
+		period = defaultBitrateInterval
+	}
+
+	m.bytes = append(m.bytes, iv.Bytes)
+	m.seconds = append(m.seconds, iv.Seconds)
+	var bytes int64
+	var seconds float64
+	for i := len(m.bytes) - 1; i >= 0; i-- {
+		bytes += m.bytes[i]
+		seconds += m.seconds[i]
+		// Intervals are a second long, give or take the ticker's jitter
+		if seconds >= period.Seconds()-0.5 {
+			m.bytes, m.seconds = m.bytes[i:], m.seconds[i:]
+			if bps := int64(float64(bytes*8) / seconds); bps > m.limits.Bitrate {
+				return m.limits.bitrateError(fmt.Sprintf("average bitrate of %s over %.0f seconds", formatBitrate(bps), seconds))
+			}
+			return nil
+		}
+	}
+	return nil
+}
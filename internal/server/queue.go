@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// admission limits the tests running at once, keeping those over the limit
+// in a FIFO queue
+type admission struct {
+	mu      sync.Mutex
+	running int
+	queue   []*waiter
+}
+
+// waiter is a test in the queue
+type waiter struct {
+	// admitted is closed when the test may run; it then holds the place
+	// of the test that ended
+	admitted chan struct{}
+	// moved is signalled when the test moves up the queue
+	moved chan struct{}
+}
+
+// enter admits a test if fewer than max are running, or else queues it
+// unless queueLen tests are waiting already. It returns the queued test's
+// waiter and position, a nil waiter if the test may run at once, or false
+// if the queue is full.
+func (a *admission) enter(max, queueLen int) (w *waiter, position int, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running < max && len(a.queue) == 0 {
+		a.running++
+		return nil, 0, true
+	}
+	if len(a.queue) >= queueLen {
+		return nil, 0, false
+	}
+	w = &waiter{admitted: make(chan struct{}), moved: make(chan struct{}, 1)}
+	a.queue = append(a.queue, w)
+	return w, len(a.queue), true
+}
+
+// position returns w's place in the queue, or 0 once it has left it
+func (a *admission) position(w *waiter) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Index(a.queue, w) + 1
+}
+
+// leave takes w out of the queue, reporting false if it was admitted first
+func (a *admission) leave(w *waiter) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := slices.Index(a.queue, w)
+	if i < 0 {
+		return false
+	}
+	a.queue = slices.Delete(a.queue, i, i+1)
+	a.moveUp(i)
+	return true
+}
+
+// release ends a running test, handing its place to the first one queued
+func (a *admission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.queue) == 0 {
+		a.running--
+		return
+	}
+	close(a.queue[0].admitted)
+	a.queue = slices.Delete(a.queue, 0, 1)
+	a.moveUp(0)
+}
+
+// moveUp tells the tests queued from index i on that they moved up
+func (a *admission) moveUp(i int) {
+	for _, w := range a.queue[i:] {
+		select {
+		case w.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// admit waits until the test started on conn may run, within the limit on
+// tests running at once, telling the client its place in the queue as it
+// moves up. On success, the returned function must be called once the test
+// is over; otherwise the error to send the client is returned.
+func (s *Server) admit(ctx context.Context, conn net.Conn) (func(), *protocol.ErrorMessage) {
+	if s.config.MaxTests <= 0 {
+		return func() {}, nil
+	}
+	w, position, ok := s.admission.enter(s.config.MaxTests, s.config.QueueLength)
+	if !ok {
+		return nil, &protocol.ErrorMessage{
+			Code:      protocol.ErrorCodeBusy,
+			Message:   "the server is busy running tests",
+			Retryable: true,
+		}
+	}
+	if w == nil {
+		return s.admission.release, nil
+	}
+
+	// The client sends nothing until the test starts, so a read only ends
+	// if it goes away
+	gone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		conn.Read(b[:])
+		close(gone)
+	}()
+	defer func() {
+		conn.SetReadDeadline(time.Now())
+		<-gone
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		if position > 0 {
+			if s.config.Verbose {
+				log.Printf("Queued test from %s at position %d", conn.RemoteAddr(), position)
+			}
+			queued := &protocol.Message{
+				Type: protocol.MessageTypeQueued,
+				Data: mustMarshal(protocol.QueuePosition{Position: position}),
+			}
+			if err := protocol.WriteMessage(conn, queued); err != nil {
+				return s.leaveQueue(w, &protocol.ErrorMessage{Code: protocol.ErrorCodeInternal, Message: err.Error()})
+			}
+		}
+
+		select {
+		case <-w.admitted:
+			return s.admission.release, nil
+		case <-w.moved:
+			position = s.admission.position(w)
+		case <-gone:
+			return s.leaveQueue(w, &protocol.ErrorMessage{Code: protocol.ErrorCodeAborted, Message: "the client has terminated"})
+		case <-ctx.Done():
+			errMsg := &protocol.ErrorMessage{Code: protocol.ErrorCodeAborted, Message: "interrupt - the server has terminated"}
+			if cause := context.Cause(ctx); errors.Is(cause, errShuttingDown) {
+				errMsg.Message, errMsg.Retryable = cause.Error(), true
+			}
+			return s.leaveQueue(w, errMsg)
+		}
+	}
+}
+
+// leaveQueue gives up the queued test w with errMsg, passing on the place it
+// may have been given meanwhile
+func (s *Server) leaveQueue(w *waiter, errMsg *protocol.ErrorMessage) (func(), *protocol.ErrorMessage) {
+	if !s.admission.leave(w) {
+		s.admission.release()
+	}
+	return nil, errMsg
+}
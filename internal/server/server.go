@@ -1,36 +1,126 @@
 package server
 
 import (
-	"encoding/binary"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"iperf3-go/internal/acl"
+	"iperf3-go/internal/auth"
 	"iperf3-go/internal/protocol"
-
-	"github.com/ishidawataru/sctp"
+	"iperf3-go/internal/report"
+	"iperf3-go/internal/stream"
+	"iperf3-go/internal/sysstat"
+	"iperf3-go/internal/transport"
 )
 
 // Config holds server configuration
 type Config struct {
-	Port     int
-	Bind     string
-	Verbose  bool
-	Daemon   bool
-	OneOff   bool
-	Protocol string
+	Port int
+	Bind string
+	// XBind lists further local addresses SCTP tests are accepted on, as
+	// with iperf3's -X
+	XBind []string
+	// MPTCP accepts Multipath TCP data streams, as with iperf3's -m
+	MPTCP bool
+	// TLS, if set, wraps every connection in TLS with this configuration;
+	// without certificates, the server presents a self-signed one
+	TLS *tls.Config
+	// Auth, if set, requires clients to authenticate, as with iperf3's
+	// --rsa-private-key-path and --authorized-users-path
+	Auth *auth.Authenticator
+	// Allow and Deny restrict the networks tests are accepted from: a
+	// denied source is rejected, and so is any source outside Allow unless
+	// Allow is empty. ACLFile adds the rules of an acl.Load file, read at
+	// start and again by ReloadACL.
+	Allow   []netip.Prefix
+	Deny    []netip.Prefix
+	ACLFile string
+	// Limits bounds the tests clients may run; tests over a limit are
+	// refused, or stopped for the bitrate, with an error naming the limit
+	Limits Limits
+	// MaxTests, if positive, is the most tests run at once. Up to
+	// QueueLength more wait their turn in order, told their place in the
+	// queue; others are refused as busy, and may retry.
+	MaxTests    int
+	QueueLength int
+	// PeerTimeout is how long a test whose client sends heartbeats goes
+	// without hearing from it before the client is taken for gone and the
+	// test aborted. Zero means 10 seconds; negative disables the check.
+	PeerTimeout time.Duration
+	Verbose     bool
+	Daemon      bool
+	OneOff      bool
+	Protocol    string
+	// Format names the report format for the server's own output ("text",
+	// "json", "json-stream", "csv" or a registered one)
+	Format string
+	// Units is the -f unit for reported bitrates (see report.Options)
+	Units byte
+	// Output receives the server's own report; nil means os.Stdout
+	Output io.Writer
+}
+
+// errShuttingDown is the cause given to sessions aborted by Shutdown
+var errShuttingDown = errors.New("the server is shutting down")
+
+// minPartialInterval is the shortest trailing interval reported when a test
+// is interrupted
+const minPartialInterval = 0.01
+
+// defaultPeerTimeout is the PeerTimeout used when none is given
+const defaultPeerTimeout = 10 * time.Second
+
+// peerTimeout returns how long the test configured by config may go without
+// hearing from its client, or 0 if the client is not watched
+func (s *Server) peerTimeout(config *protocol.TestConfig) time.Duration {
+	if config.Heartbeat <= 0 || s.config.PeerTimeout < 0 {
+		return 0
+	}
+	if s.config.PeerTimeout == 0 {
+		return defaultPeerTimeout
+	}
+	return s.config.PeerTimeout
 }
 
 // Server represents an iperf3 server
 type Server struct {
-	config      *Config
-	listener    net.Listener
-	sessions    map[string]*Session
-	udpSessions map[string]*protocol.UDPStats
-	mutex       sync.RWMutex
+	config   *Config
+	listener net.Listener
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+	out      io.Writer
+	// tests counts the tests started, for one-off servers
+	tests int
+	// acl is the access control list in force; rejected holds the hosts
+	// whose rejection was logged since it was loaded
+	acl      atomic.Pointer[acl.List]
+	rejected map[string]bool
+	// admission queues tests over MaxTests
+	admission admission
+	// active tracks running sessions so Start can wait for them
+	active sync.WaitGroup
+
+	// Set by Start, used by Shutdown
+	shuttingDown  bool
+	stopAccepting context.CancelFunc
+	abortSessions context.CancelCauseFunc
+	acceptDone    chan struct{}
 }
 
 // Session represents a client test session
@@ -40,522 +130,924 @@ type Session struct {
 	Config    *protocol.TestConfig
 	Results   *protocol.TestResults
 	StartTime time.Time
-	UDPStats  *protocol.UDPStats
+	// Output captures the server report when the client asked for it
+	Output *bytes.Buffer
+
+	// The data streams attached to the test; none can be added once it
+	// is running
+	mu      sync.Mutex
+	streams []*stream.Stream
+	running bool
+	closed  bool
 }
 
 // New creates a new iperf3 server
 func New(config *Config) *Server {
-	return &Server{
-		config:      config,
-		sessions:    make(map[string]*Session),
-		udpSessions: make(map[string]*protocol.UDPStats),
+	s := &Server{
+		config:   config,
+		sessions: make(map[string]*Session),
+		out:      os.Stdout,
 	}
+	if config.Output != nil {
+		s.out = config.Output
+	}
+	s.acl.Store(&acl.List{Allow: config.Allow, Deny: config.Deny})
+	return s
 }
 
-// Start starts the iperf3 server
-func (s *Server) Start() error {
-	addr := fmt.Sprintf(":%d", s.config.Port)
-	if s.config.Bind != "" {
-		addr = fmt.Sprintf("%s:%d", s.config.Bind, s.config.Port)
+// maxRejectedLogged bounds the hosts remembered as having their rejection
+// logged, past which further rejections are not logged
+const maxRejectedLogged = 4096
+
+// ReloadACL reads the configured ACLFile again and puts its rules, with
+// those of Allow and Deny, in force for new connections and datagrams. On
+// error, the rules in force are kept.
+func (s *Server) ReloadACL() error {
+	if s.config.ACLFile == "" {
+		return errors.New("no access control list file configured")
+	}
+	list, err := acl.Load(s.config.ACLFile)
+	if err != nil {
+		return err
 	}
 
-	protocol := s.config.Protocol
-	if protocol == "" {
-		protocol = "tcp"
+	s.mutex.Lock()
+	s.acl.Store(list.Merge(&acl.List{Allow: s.config.Allow, Deny: s.config.Deny}))
+	s.rejected = nil
+	s.mutex.Unlock()
+	return nil
+}
+
+// permits checks a source address against the access control list, logging
+// the first rejection of each host
+func (s *Server) permits(addr net.Addr) bool {
+	if s.acl.Load().Permits(addr) {
+		return true
 	}
 
-	switch protocol {
-	case "udp":
-		return s.startUDPServer(addr)
-	case "sctp":
-		return s.startSCTPServer(addr)
-	default: // tcp
-		return s.startTCPServer(addr)
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
+	s.mutex.Lock()
+	logIt := !s.rejected[host] && len(s.rejected) < maxRejectedLogged
+	if logIt {
+		if s.rejected == nil {
+			s.rejected = make(map[string]bool)
+		}
+		s.rejected[host] = true
+	}
+	s.mutex.Unlock()
+	if logIt {
+		log.Printf("Rejected %s: denied by the access control list", addr)
+	}
+	return false
 }
 
-// startTCPServer starts a TCP server
-func (s *Server) startTCPServer(addr string) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+// format returns the name of the configured report format
+func (s *Server) format() string {
+	if s.config.Format == "" {
+		return "text"
 	}
-	s.listener = listener
+	return s.config.Format
+}
 
-	if s.config.Verbose {
-		log.Printf("TCP Server listening on %s", addr)
+// newReporter returns the reporter for a session: the server's own output,
+// plus a capture of it in the client's format if the client asked for it
+func (s *Server) newReporter(session *Session) (report.Reporter, error) {
+	opts := report.Options{Server: true, Units: s.config.Units, Title: session.Config.Title}
+
+	rep, err := report.New(s.format(), s.out, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	for {
-		conn, err := listener.Accept()
+	if session.Config.GetServerOutput {
+		format := "text"
+		if session.Config.JSON {
+			format = "json"
+		}
+		session.Output = &bytes.Buffer{}
+		capture, err := report.New(format, session.Output, opts)
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			return nil, err
 		}
+		rep = report.Multi(rep, capture)
+	}
+
+	return rep, nil
+}
 
-		go s.handleConnection(conn)
+// Start starts the iperf3 server and serves until ctx is done or Shutdown is
+// called. When ctx is done, running tests are stopped early; Start returns
+// once they have all reported.
+func (s *Server) Start(ctx context.Context) error {
+	return s.run(ctx, s.serve)
+}
 
-		if s.config.OneOff {
-			break
+// Serve is like Start but accepts tests on a listener supplied by the
+// caller, e.g. one inherited through socket activation or an in-memory one.
+// The listener is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if s.config.TLS != nil {
+		tlsLn, err := transport.NewTLSListener(ln, s.config.TLS)
+		if err != nil {
+			ln.Close()
+			return err
 		}
+		ln = tlsLn
 	}
-
-	return nil
+	return s.run(ctx, func(acceptCtx, sessionCtx context.Context) error {
+		return s.acceptLoop(acceptCtx, sessionCtx, ln)
+	})
 }
 
-// startUDPServer starts a UDP server
-func (s *Server) startUDPServer(addr string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address %s: %w", addr, err)
+// run calls serve to accept tests until ctx is done or Shutdown is called,
+// then waits for the running tests
+func (s *Server) run(ctx context.Context, serve func(acceptCtx, sessionCtx context.Context) error) error {
+	if _, err := report.New(s.format(), io.Discard, report.Options{Server: true}); err != nil {
+		return err
 	}
-
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	if s.config.ACLFile != "" {
+		if err := s.ReloadACL(); err != nil {
+			return err
+		}
 	}
-	defer conn.Close()
 
-	if s.config.Verbose {
-		log.Printf("UDP Server listening on %s", addr)
+	// Accepting and sessions are stopped separately so Shutdown can drain
+	acceptCtx, stopAccepting := context.WithCancel(ctx)
+	defer stopAccepting()
+	sessionCtx, abortSessions := context.WithCancelCause(ctx)
+	defer abortSessions(nil)
+	acceptDone := make(chan struct{})
+
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		return nil
 	}
+	s.stopAccepting, s.abortSessions, s.acceptDone = stopAccepting, abortSessions, acceptDone
+	s.mutex.Unlock()
 
-	// For UDP, we handle packets differently
-	buffer := make([]byte, 65536) // Max UDP packet size
-	for {
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("Failed to read UDP packet: %v", err)
-			continue
-		}
+	err := serve(acceptCtx, sessionCtx)
+	close(acceptDone)
+	s.active.Wait()
+	return err
+}
 
-		// Handle UDP packet in a goroutine
-		go s.handleUDPPacket(conn, clientAddr, buffer[:n])
+// Shutdown stops the server gracefully: it stops accepting new tests and
+// waits for running ones to finish. If ctx is done first, the remaining tests
+// are aborted, their clients are sent an error and partial results, and
+// Shutdown returns ctx's error once they have ended.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	stopAccepting, abortSessions, acceptDone := s.stopAccepting, s.abortSessions, s.acceptDone
+	s.mutex.Unlock()
 
-		if s.config.OneOff {
-			break
-		}
+	if stopAccepting == nil {
+		return nil
 	}
+	stopAccepting()
+	<-acceptDone
 
-	return nil
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		abortSessions(errShuttingDown)
+		<-drained
+		return ctx.Err()
+	}
 }
 
-// startSCTPServer starts an SCTP server
-func (s *Server) startSCTPServer(addr string) error {
-	sctpAddr, err := sctp.ResolveSCTPAddr("sctp", addr)
+// transport returns the transport tests are run over
+func (s *Server) transport() (transport.Transport, error) {
+	t, err := transport.Lookup(s.config.Protocol)
 	if err != nil {
-		return fmt.Errorf("failed to resolve SCTP address %s: %w", addr, err)
+		return nil, err
+	}
+	if s.config.TLS != nil {
+		t = transport.WithTLS(t, s.config.TLS)
 	}
+	return t, nil
+}
+
+// serve listens on the configured protocol and accepts tests until
+// acceptCtx is done; the tests run with sessionCtx
+func (s *Server) serve(acceptCtx, sessionCtx context.Context) error {
+	addr := net.JoinHostPort(s.config.Bind, strconv.Itoa(s.config.Port))
 
-	listener, err := sctp.ListenSCTP("sctp", sctpAddr)
+	t, err := s.transport()
 	if err != nil {
-		return fmt.Errorf("failed to listen on SCTP %s: %w", addr, err)
+		return err
+	}
+	listener, err := t.Listen(acceptCtx, addr, transport.ListenOptions{
+		XBind:  s.config.XBind,
+		MPTCP:  s.config.MPTCP,
+		Filter: s.permits,
+	})
+	if err != nil {
+		return err
 	}
-	defer listener.Close()
 
 	if s.config.Verbose {
-		log.Printf("SCTP Server listening on %s", addr)
+		log.Printf("%s Server listening on %s", strings.ToUpper(t.Name()), listener.Addr())
 	}
 
+	return s.acceptLoop(acceptCtx, sessionCtx, listener)
+}
+
+// acceptLoop handles each connection accepted on listener until ctx is
+// done, then closes the listener
+func (s *Server) acceptLoop(ctx, sessionCtx context.Context, listener net.Listener) error {
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
 	for {
-		conn, err := listener.AcceptSCTP()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept SCTP connection: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("listener closed: %w", err)
+			}
+			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
-
-		go s.handleConnection(conn)
-
-		if s.config.OneOff {
-			break
+		if !s.permits(conn.RemoteAddr()) {
+			conn.Close()
+			continue
 		}
+
+		s.active.Add(1)
+		go func() {
+			defer s.active.Done()
+			s.handleConnection(sessionCtx, conn)
+		}()
 	}
 
 	return nil
 }
 
-// handleUDPPacket handles a UDP packet from a client with advanced statistics
-func (s *Server) handleUDPPacket(conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte) {
+// handleConnection handles a new connection: either the control connection
+// of a test or one of its data streams
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	if s.config.Verbose {
-		log.Printf("Received UDP packet from %s, size: %d bytes", clientAddr, len(data))
-	}
-
-	clientKey := clientAddr.String()
-
-	// Parse UDP packet header if present
-	if len(data) >= 16 {
-		// Extract packet header
-		sequence := binary.BigEndian.Uint32(data[0:4])
-		timestamp := int64(binary.BigEndian.Uint64(data[4:12]))
-		magic := binary.BigEndian.Uint32(data[12:16])
-
-		// Verify magic number
-		const expectedMagic uint32 = 0x12345678
-		if magic == expectedMagic {
-			// Calculate statistics
-			arrivalTime := time.Now().UnixNano()
-			transitTime := float64(arrivalTime-timestamp) / 1000000.0 // Convert to milliseconds
-
-			// Get or create UDP session stats
-			s.mutex.Lock()
-			stats, exists := s.udpSessions[clientKey]
-			if !exists {
-				stats = &protocol.UDPStats{
-					LastSequence: sequence - 1, // Initialize to expect this sequence
-				}
-				s.udpSessions[clientKey] = stats
-			}
-
-			// Update packet statistics
-			stats.TotalPackets++
-
-			// Check for packet loss (sequence gaps)
-			expectedSeq := stats.LastSequence + 1
-			if sequence > expectedSeq {
-				// Packets were lost
-				lostCount := int64(sequence - expectedSeq)
-				stats.LostPackets += lostCount
-				if s.config.Verbose {
-					log.Printf("Packet loss detected: expected seq %d, got %d (lost %d packets)",
-						expectedSeq, sequence, lostCount)
-				}
-			} else if sequence < expectedSeq {
-				// Out-of-order packet
-				stats.OutOfOrder++
-				if s.config.Verbose {
-					log.Printf("Out-of-order packet: expected seq %d, got %d", expectedSeq, sequence)
-				}
-			}
-
-			// Update sequence tracking
-			if sequence >= stats.LastSequence {
-				stats.LastSequence = sequence
-			}
-
-			// Calculate jitter using RFC 1889 algorithm
-			if stats.LastArrivalTime > 0 {
-				// Calculate transit time difference
-				transitDiff := transitTime - stats.LastTransitTime
-				if transitDiff < 0 {
-					transitDiff = -transitDiff
-				}
-
-				// Update jitter using exponential smoothing (RFC 1889)
-				// J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16
-				if stats.JitterCount == 0 {
-					stats.JitterSum = transitDiff
-				} else {
-					currentJitter := stats.JitterSum / float64(stats.JitterCount)
-					newJitter := currentJitter + (transitDiff-currentJitter)/16.0
-					stats.JitterSum = newJitter * float64(stats.JitterCount+1)
-				}
-				stats.JitterCount++
-			}
-
-			// Update timing for next jitter calculation
-			stats.LastArrivalTime = arrivalTime
-			stats.LastTransitTime = transitTime
-
-			s.mutex.Unlock()
-
-			if s.config.Verbose {
-				lossPercent := 0.0
-				if stats.TotalPackets > 0 {
-					lossPercent = float64(stats.LostPackets) / float64(stats.TotalPackets+stats.LostPackets) * 100.0
-				}
-				jitter := 0.0
-				if stats.JitterCount > 0 {
-					jitter = stats.JitterSum / float64(stats.JitterCount)
-				}
-				log.Printf("UDP stats from %s: seq=%d, transit=%.2fms, loss=%.2f%%, jitter=%.2fms, ooo=%d",
-					clientAddr, sequence, transitTime, lossPercent, jitter, stats.OutOfOrder)
-			}
+		log.Printf("New connection from %s", conn.RemoteAddr())
+	}
 
-			// Send acknowledgment with basic stats
-			response := fmt.Sprintf("UDP packet received: seq=%d, total=%d, lost=%d, ooo=%d",
-				sequence, stats.TotalPackets, stats.LostPackets, stats.OutOfOrder)
-			_, err := conn.WriteToUDP([]byte(response), clientAddr)
-			if err != nil {
-				log.Printf("Failed to send UDP response to %s: %v", clientAddr, err)
-			}
-			return
-		}
+	// Read initial message from client, after the TLS handshake if any,
+	// giving up if the session is aborted
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err := transport.Handshake(ctx, conn)
+	var msg *protocol.Message
+	if err == nil {
+		msg, err = protocol.ReadMessage(conn)
+	}
+	if !stop() {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		conn.Close()
+		log.Printf("Protocol error from %s: failed to read initial message: %v", conn.RemoteAddr(), err)
+		return
 	}
 
-	// Handle packets without proper header (legacy mode)
-	response := []byte("UDP packet received (legacy mode)")
-	_, err := conn.WriteToUDP(response, clientAddr)
+	switch msg.Type {
+	case protocol.MessageTypeTestStart:
+		err = s.handleTestStart(ctx, conn, msg)
+	case protocol.MessageTypeStreamStart:
+		err = s.handleStreamStart(conn, msg)
+	default:
+		err = fmt.Errorf("unexpected message type: %d", msg.Type)
+		sendError(conn, protocol.ErrorCodeProtocol, err.Error())
+		conn.Close()
+	}
 	if err != nil {
-		log.Printf("Failed to send UDP response to %s: %v", clientAddr, err)
+		log.Printf("Protocol error from %s: %v", conn.RemoteAddr(), err)
 	}
 }
 
-// handleConnection handles a client connection
-func (s *Server) handleConnection(conn net.Conn) {
+// handleTestStart runs the test started on a control connection
+func (s *Server) handleTestStart(ctx context.Context, conn net.Conn, msg *protocol.Message) error {
 	defer conn.Close()
 
+	// Parse test configuration
+	var config protocol.TestConfig
+	if err := json.Unmarshal(msg.Data, &config); err != nil {
+		err = fmt.Errorf("failed to parse test config: %w", err)
+		sendError(conn, protocol.ErrorCodeProtocol, err.Error())
+		return err
+	}
+
 	if s.config.Verbose {
-		log.Printf("New connection from %s", conn.RemoteAddr())
+		log.Printf("Test config: %+v", config)
+	}
+
+	if s.config.Auth != nil {
+		username, err := s.config.Auth.Check(config.AuthToken, time.Now())
+		if err != nil {
+			log.Printf("Rejected test from %s: %v", conn.RemoteAddr(), err)
+			sendError(conn, protocol.ErrorCodeAccessDenied, auth.ErrAccessDenied.Error())
+			return nil
+		}
+		if s.config.Verbose {
+			log.Printf("Authenticated user %s", username)
+		}
+	}
+	if errMsg := s.config.Limits.check(&config); errMsg != nil {
+		log.Printf("Rejected test from %s: %s", conn.RemoteAddr(), errMsg.Message)
+		writeError(conn, errMsg)
+		return nil
 	}
 
-	// Create new session
+	id, err := generateSessionID()
+	if err != nil {
+		sendError(conn, protocol.ErrorCodeInternal, err.Error())
+		return err
+	}
 	session := &Session{
-		ID:        generateSessionID(),
+		ID:        id,
 		Conn:      conn,
+		Config:    &config,
 		StartTime: time.Now(),
 	}
 
+	if errMsg := s.addSession(session); errMsg != nil {
+		writeError(conn, errMsg)
+		return errors.New(errMsg.Message)
+	}
+	defer s.removeSession(session)
+
+	release, errMsg := s.admit(ctx, conn)
+	if errMsg != nil {
+		log.Printf("Test from %s not run: %s", conn.RemoteAddr(), errMsg.Message)
+		writeError(conn, errMsg)
+		return nil
+	}
+	defer release()
+
+	// Send acknowledgment
+	ack := &protocol.Message{
+		Type: protocol.MessageTypeTestStartAck,
+		Data: mustMarshal(protocol.TestStartAck{Cookie: session.ID}),
+	}
+
+	if err := protocol.WriteMessage(conn, ack); err != nil {
+		return fmt.Errorf("failed to send test start ack: %w", err)
+	}
+
+	// The client opens its data streams, then says the test is running
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	msg, err = protocol.ReadMessage(conn)
+	if !stop() {
+		return fmt.Errorf("session aborted: %w", context.Cause(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read test running: %w", err)
+	}
+	switch msg.Type {
+	case protocol.MessageTypeTestRunning:
+	case protocol.MessageTypeError:
+		// The client could not start the test, e.g. open its data streams
+		var errMsg protocol.ErrorMessage
+		json.Unmarshal(msg.Data, &errMsg)
+		log.Printf("Test %s not started by the client: %s", session.ID, errMsg.Message)
+		return nil
+	default:
+		err := fmt.Errorf("unexpected message type: %d", msg.Type)
+		sendError(conn, protocol.ErrorCodeProtocol, err.Error())
+		return err
+	}
+
+	// Run the test
+	return s.runTest(ctx, session)
+}
+
+// addSession registers a test about to start, or returns the error to send
+// the client if the server cannot run it
+func (s *Server) addSession(session *Session) *protocol.ErrorMessage {
+	t, err := s.transport()
+	if err != nil {
+		return &protocol.ErrorMessage{Code: protocol.ErrorCodeInternal, Message: err.Error()}
+	}
+	name := session.Config.Protocol
+	if name == "" {
+		name = "tcp"
+	}
+	if name != t.Name() {
+		return &protocol.ErrorMessage{
+			Code:      protocol.ErrorCodeInvalidParameter,
+			Message:   fmt.Sprintf("this server does not run %s tests", name),
+			Parameter: "protocol",
+		}
+	}
+
 	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.config.OneOff && s.tests > 0 {
+		return &protocol.ErrorMessage{Code: protocol.ErrorCodeBusy, Message: "the server is busy running a test"}
+	}
+	s.tests++
 	s.sessions[session.ID] = session
+	return nil
+}
+
+// removeSession unregisters a finished test and closes its data streams. A
+// one-off server stops accepting once its test is over.
+func (s *Server) removeSession(session *Session) {
+	s.mutex.Lock()
+	delete(s.sessions, session.ID)
+	stopAccepting := s.stopAccepting
 	s.mutex.Unlock()
 
-	defer func() {
-		s.mutex.Lock()
-		delete(s.sessions, session.ID)
-		s.mutex.Unlock()
-	}()
+	session.mu.Lock()
+	session.closed = true
+	for _, st := range session.streams {
+		st.Conn.Close()
+	}
+	session.mu.Unlock()
 
-	// Handle iperf3 protocol
-	if err := s.handleProtocol(session); err != nil {
-		log.Printf("Protocol error for session %s: %v", session.ID, err)
+	if s.config.OneOff && stopAccepting != nil {
+		stopAccepting()
 	}
 }
 
-// handleProtocol handles the iperf3 protocol exchange
-func (s *Server) handleProtocol(session *Session) error {
-	// Read initial message from client
-	msg, err := protocol.ReadMessage(session.Conn)
-	if err != nil {
-		return fmt.Errorf("failed to read initial message: %w", err)
+// handleStreamStart attaches a data stream to its test
+func (s *Server) handleStreamStart(conn net.Conn, msg *protocol.Message) error {
+	var start protocol.StreamStart
+	if err := json.Unmarshal(msg.Data, &start); err != nil {
+		err = fmt.Errorf("failed to parse stream start: %w", err)
+		sendError(conn, protocol.ErrorCodeProtocol, err.Error())
+		conn.Close()
+		return err
 	}
 
-	switch msg.Type {
-	case protocol.MessageTypeTestStart:
-		return s.handleTestStart(session, msg)
-	default:
-		return fmt.Errorf("unexpected message type: %d", msg.Type)
+	// The cookie alone must not let in a source the access control list
+	// rejects, e.g. since it was reloaded
+	if !s.permits(conn.RemoteAddr()) {
+		sendError(conn, protocol.ErrorCodeAccessDenied, "access denied")
+		conn.Close()
+		return nil
 	}
-}
 
-// handleTestStart handles test start message
-func (s *Server) handleTestStart(session *Session, msg *protocol.Message) error {
-	// Parse test configuration
-	var config protocol.TestConfig
-	if err := json.Unmarshal(msg.Data, &config); err != nil {
-		return fmt.Errorf("failed to parse test config: %w", err)
+	s.mutex.RLock()
+	session := s.sessions[start.Cookie]
+	s.mutex.RUnlock()
+	if session == nil {
+		sendError(conn, protocol.ErrorCodeProtocol, "unknown test")
+		conn.Close()
+		return fmt.Errorf("stream %d for unknown test %s", start.ID, start.Cookie)
 	}
 
-	session.Config = &config
+	t, err := s.transport()
+	if err != nil {
+		sendError(conn, protocol.ErrorCodeInternal, err.Error())
+		conn.Close()
+		return err
+	}
+	sockOpts := transport.SocketOptions{
+		Window:  session.Config.Window,
+		NoDelay: session.Config.NoDelay,
+		MSS:     session.Config.MSS,
+	}
+	if err := t.SetOptions(conn, sockOpts); err != nil {
+		err = fmt.Errorf("failed to set options on stream %d: %w", start.ID, err)
+		sendError(conn, protocol.ErrorCodeInternal, err.Error())
+		conn.Close()
+		return err
+	}
 
-	if s.config.Verbose {
-		log.Printf("Test config: %+v", config)
+	// Once attached, the stream is closed with its session
+	if errMsg := session.attach(&stream.Stream{ID: start.ID, Conn: conn}, &s.config.Limits); errMsg != nil {
+		writeError(conn, errMsg)
+		conn.Close()
+		return errors.New(errMsg.Message)
 	}
 
-	// Send acknowledgment
-	ack := &protocol.Message{
-		Type: protocol.MessageTypeTestStartAck,
-		Data: []byte("{}"),
+	ack := &protocol.Message{Type: protocol.MessageTypeStreamStartAck}
+	if err := protocol.WriteMessage(conn, ack); err != nil {
+		return fmt.Errorf("failed to send stream start ack: %w", err)
 	}
+	return nil
+}
 
-	if err := protocol.WriteMessage(session.Conn, ack); err != nil {
-		return fmt.Errorf("failed to send test start ack: %w", err)
+// attach adds a data stream to a session that has not started measuring,
+// within the limit on parallel streams, and tells it which way its data runs
+func (session *Session) attach(st *stream.Stream, limits *Limits) *protocol.ErrorMessage {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.running || session.closed {
+		return &protocol.ErrorMessage{
+			Code:    protocol.ErrorCodeProtocol,
+			Message: fmt.Sprintf("stream %d arrived after test %s started", st.ID, session.ID),
+		}
 	}
+	// The limit is on the streams in each direction of a bidirectional test
+	if limit := limits.Parallel * session.Config.Streams() / max(session.Config.Parallel, 1); limits.Parallel > 0 && len(session.streams) >= limit {
+		return limits.parallelError(len(session.streams) + 1)
+	}
+	st.Reverse = session.Config.Reversed(st.ID)
+	st.Sender = st.Reverse
+	session.streams = append(session.streams, st)
+	return nil
+}
 
-	// Run the test
-	return s.runTest(session)
+// sendError tells the peer why the server is stopping or refusing a test
+func sendError(conn net.Conn, code protocol.ErrorCode, message string) error {
+	return writeError(conn, &protocol.ErrorMessage{Code: code, Message: message})
 }
 
-// runTest runs the actual performance test
-func (s *Server) runTest(session *Session) error {
-	switch session.Config.Protocol {
-	case "tcp", "":
-		return s.runTCPTest(session)
-	case "udp":
-		return s.runUDPTest(session)
-	default:
-		return fmt.Errorf("unsupported protocol: %s", session.Config.Protocol)
+// writeError sends the peer an error message
+func writeError(conn net.Conn, errMsg *protocol.ErrorMessage) error {
+	msg := &protocol.Message{
+		Type: protocol.MessageTypeError,
+		Data: mustMarshal(errMsg),
 	}
+	if err := protocol.WriteMessage(conn, msg); err != nil {
+		return fmt.Errorf("failed to send error: %w", err)
+	}
+	return nil
 }
 
-// runTCPTest runs a TCP performance test
-func (s *Server) runTCPTest(session *Session) error {
+// streamDrainTimeout bounds the wait for data still in flight when the
+// client ends the test
+const streamDrainTimeout = time.Second
+
+// runTest runs the actual performance test, sending on the session's
+// reversed streams and measuring the data received on the others until the
+// client ends the test
+func (s *Server) runTest(ctx context.Context, session *Session) error {
+	t, err := s.transport()
+	if err != nil {
+		return err
+	}
+
+	session.mu.Lock()
+	session.running = true
+	streams := session.streams
+	session.mu.Unlock()
+	if len(streams) == 0 {
+		err := fmt.Errorf("test %s has no data streams", session.ID)
+		sendError(session.Conn, protocol.ErrorCodeProtocol, err.Error())
+		return err
+	}
+
+	// Older clients leave the block length to us
+	length := session.Config.Length
+	if length <= 0 {
+		length = stream.DefaultLength(session.Config.Protocol)
+	}
+	reverse, bidir := 0, 0
+	if session.Config.Reverse {
+		reverse = 1
+	}
+	if session.Config.Bidir {
+		bidir = 1
+	}
+
 	results := &protocol.TestResults{
 		Start: protocol.TestStart{
-			Connected: []protocol.Connection{
-				{
-					Socket:     1,
-					LocalHost:  session.Conn.LocalAddr().String(),
-					LocalPort:  s.config.Port,
-					RemoteHost: session.Conn.RemoteAddr().String(),
-					RemotePort: getPort(session.Conn.RemoteAddr()),
-				},
-			},
-			Version:    "iperf3-go 1.0.0",
-			SystemInfo: "Go implementation",
-			Timestamp: protocol.Timestamp{
-				Time:     time.Now().Unix(),
-				Timesecs: time.Now().Unix(),
+			Version:       "iperf3-go 1.0.0",
+			SystemInfo:    sysstat.SystemInfo(),
+			Timestamp:     protocol.NewTimestamp(time.Now()),
+			Cookie:        session.ID,
+			TargetBitrate: session.Config.Bandwidth,
+			SockBufsize:   session.Config.Window,
+			TestStart: protocol.TestParameters{
+				Protocol:      strings.ToUpper(t.Name()),
+				NumStreams:    len(streams),
+				Blksize:       length,
+				Duration:      session.Config.Time,
+				Reverse:       reverse,
+				Bidir:         bidir,
+				TargetBitrate: session.Config.Bandwidth,
+				Interval:      1,
+				MPTCP:         session.Config.MPTCP,
 			},
-			ConnectingTo: protocol.ConnectingTo{
-				Host: session.Conn.RemoteAddr().String(),
-				Port: getPort(session.Conn.RemoteAddr()),
-			},
-			Cookie: session.ID,
 		},
+		Intervals: []protocol.IntervalReport{},
+		Title:     session.Config.Title,
+		ExtraData: session.Config.ExtraData,
+	}
+	for _, st := range streams {
+		results.Start.Connected = append(results.Start.Connected, protocol.Connection{
+			Socket:     st.ID,
+			LocalHost:  getHost(st.Conn.LocalAddr()),
+			LocalPort:  getPort(st.Conn.LocalAddr()),
+			RemoteHost: getHost(st.Conn.RemoteAddr()),
+			RemotePort: getPort(st.Conn.RemoteAddr()),
+			MPTCP:      transport.UsingMPTCP(st.Conn),
+			TLS:        transport.TLSInfo(st.Conn),
+		})
 	}
 
 	session.Results = results
 
-	// Send test results periodically during the test
-	duration := time.Duration(session.Config.Time) * time.Second
-	if duration == 0 {
-		duration = 10 * time.Second // default
+	rep, err := s.newReporter(session)
+	if err != nil {
+		return err
 	}
+	rep.Start(results)
+
+	// Send test results periodically during the test
+	duration := testDuration(session.Config)
+	bitrate := newBitrateMonitor(&s.config.Limits)
+	peerTimeout := s.peerTimeout(session.Config)
 
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	startTime := time.Now()
-	var totalBytes int64
-	intervalBytes := int64(0)
-	intervalNum := 0
-
-	buffer := make([]byte, 128*1024) // 128KB buffer
+	cpuStart := sysstat.SampleCPU()
+	intervalStart := 0.0
+
+	// We send on the reversed streams until the client ends the test
+	sendCtx, stopSending := context.WithCancel(ctx)
+	defer stopSending()
+	params := stream.Params{Length: length, Bitrate: session.Config.Bandwidth, Burst: session.Config.Burst}
+	var senders, receivers []*stream.Stream
+	for _, st := range streams {
+		st.Start(sendCtx, t.Datagram(), params)
+		if st.Sender {
+			senders = append(senders, st)
+		} else {
+			receivers = append(receivers, st)
+		}
+	}
 
+	// The client ends the test, or says why it stopped, on the control
+	// connection. Messages read once the test is over, such as heartbeats
+	// still in flight, are dropped; the read ends when the connection closes.
+	control := make(chan *protocol.Message)
+	finished := make(chan struct{})
+	defer close(finished)
 	go func() {
+		defer close(control)
 		for {
-			n, err := session.Conn.Read(buffer)
+			msg, err := protocol.ReadMessage(session.Conn)
 			if err != nil {
 				return
 			}
-			totalBytes += int64(n)
-			intervalBytes += int64(n)
+			select {
+			case control <- msg:
+			case <-finished:
+				return
+			}
+			if msg.Type == protocol.MessageTypeTestEnd || msg.Type == protocol.MessageTypeError {
+				return
+			}
 		}
 	}()
 
+	// emitInterval reports the interval ending at elapsed seconds to the
+	// client and to our own output, returning the total of both directions
+	emitInterval := func(elapsed float64) (*protocol.Interval, error) {
+		interval := stream.Report(t, streams, intervalStart, elapsed, session.Config.Bidir)
+		intervalStart = elapsed
+		results.Intervals = append(results.Intervals, interval)
+
+		intervalMsg := &protocol.Message{
+			Type: protocol.MessageTypeInterval,
+			Data: mustMarshal(interval),
+		}
+
+		if err := protocol.WriteMessage(session.Conn, intervalMsg); err != nil {
+			return nil, fmt.Errorf("failed to send interval: %w", err)
+		}
+
+		rep.Interval(&interval)
+		total := interval.Sum
+		if interval.SumBidirReverse != nil {
+			total.Bytes += interval.SumBidirReverse.Bytes
+		}
+		return &total, nil
+	}
+
+	// stop is set when the server stops the test, to tell the client why
+	var stop *protocol.ErrorMessage
+
+	// lastHeard is when the client last sent anything on the control
+	// connection, heartbeats included
+	lastHeard := startTime
+
+	deadline := time.NewTimer(duration + 2*time.Second)
+	defer deadline.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			intervalNum++
-			elapsed := time.Since(startTime).Seconds()
-
-			interval := protocol.Interval{
-				Socket:        1,
-				Start:         elapsed - 1,
-				End:           elapsed,
-				Seconds:       1.0,
-				Bytes:         intervalBytes,
-				BitsPerSecond: float64(intervalBytes * 8),
-				Omitted:       false,
+			if silent := time.Since(lastHeard); peerTimeout > 0 && silent > peerTimeout {
+				stop = &protocol.ErrorMessage{
+					Code:    protocol.ErrorCodeAborted,
+					Message: fmt.Sprintf("the client stopped responding: nothing heard for %.0f seconds", silent.Seconds()),
+				}
+				log.Printf("Stopping test %s: %s", session.ID, stop.Message)
+				results.Interrupted = true
+				results.Error = stop.Message
+				// The client is most likely gone, so don't wait on it
+				session.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+				goto testComplete
 			}
-
-			intervalMsg := &protocol.Message{
-				Type: protocol.MessageTypeInterval,
-				Data: mustMarshal(interval),
+			if peerTimeout > 0 {
+				// A client that is gone must not block the test in a write
+				session.Conn.SetWriteDeadline(time.Now().Add(peerTimeout))
 			}
-
-			if err := protocol.WriteMessage(session.Conn, intervalMsg); err != nil {
-				return fmt.Errorf("failed to send interval: %w", err)
+			sum, err := emitInterval(time.Since(startTime).Seconds())
+			if err != nil {
+				return err
+			}
+			if stop = bitrate.add(sum); stop != nil {
+				log.Printf("Stopping test %s: %s", session.ID, stop.Message)
+				results.Interrupted = true
+				results.Error = stop.Message
+				goto testComplete
 			}
 
-			intervalBytes = 0
+		case <-deadline.C:
+			goto testComplete
 
-			if elapsed >= duration.Seconds() {
+		case msg, ok := <-control:
+			if ok {
+				lastHeard = time.Now()
+			}
+			if ok && msg.Type == protocol.MessageTypeTestEnd {
 				goto testComplete
 			}
+			if ok && msg.Type != protocol.MessageTypeError {
+				continue
+			}
+			results.Interrupted = true
+			results.Error = "the client has terminated"
+			goto testComplete
 
-		case <-time.After(duration + 2*time.Second):
+		case <-ctx.Done():
+			results.Interrupted = true
+			results.Error = "interrupt - the server has terminated"
+			stop = &protocol.ErrorMessage{Code: protocol.ErrorCodeAborted}
+			if cause := context.Cause(ctx); errors.Is(cause, errShuttingDown) {
+				// The server may be back after a restart
+				results.Error = cause.Error()
+				stop.Retryable = true
+			}
+			stop.Message = results.Error
 			goto testComplete
 		}
 	}
 
 testComplete:
-	// Send final results
 	elapsed := time.Since(startTime).Seconds()
 
-	results.End = protocol.TestEnd{
-		Streams: []protocol.StreamResult{
-			{
-				Socket:        1,
-				Start:         0,
-				End:           elapsed,
-				Seconds:       elapsed,
-				Bytes:         totalBytes,
-				BitsPerSecond: float64(totalBytes*8) / elapsed,
-				Sender:        false,
-			},
-		},
-		SumSent: protocol.StreamResult{
-			Start:         0,
-			End:           elapsed,
-			Seconds:       elapsed,
-			Bytes:         totalBytes,
-			BitsPerSecond: float64(totalBytes*8) / elapsed,
-			Sender:        false,
-		},
-		SumReceived: protocol.StreamResult{
-			Start:         0,
-			End:           elapsed,
-			Seconds:       elapsed,
-			Bytes:         totalBytes,
-			BitsPerSecond: float64(totalBytes*8) / elapsed,
-			Sender:        false,
-		},
-		CPUUtilizationPercent: protocol.CPUUtilization{
-			HostTotal:    0.0,
-			HostUser:     0.0,
-			HostSystem:   0.0,
-			RemoteTotal:  0.0,
-			RemoteUser:   0.0,
-			RemoteSystem: 0.0,
-		},
+	// Stop sending, letting the client read what is still in flight
+	stopSending()
+	for _, st := range senders {
+		st.Stop()
+		if cw, ok := st.Conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
 	}
 
-	endMsg := &protocol.Message{
-		Type: protocol.MessageTypeTestEnd,
-		Data: mustMarshal(results.End),
+	// The client closes its sending side before ending the test, so wait
+	// briefly for the data still in flight
+	if !t.Datagram() && stop == nil {
+		stream.Drain(receivers, streamDrainTimeout)
 	}
 
-	return protocol.WriteMessage(session.Conn, endMsg)
-}
+	if results.Interrupted {
+		// Report the partial interval; the client may already be gone
+		if elapsed-intervalStart >= minPartialInterval {
+			emitInterval(elapsed)
+		}
+	}
+	if stop != nil {
+		// We are stopping the test, so tell the client why before the results
+		if err := writeError(session.Conn, stop); err != nil {
+			return err
+		}
+	}
 
-// runUDPTest runs a UDP performance test
-func (s *Server) runUDPTest(session *Session) error {
-	// UDP test implementation would go here
-	// For now, return an error as it's not implemented
-	return fmt.Errorf("UDP tests not yet implemented")
-}
+	// Only the client knows the other side of each stream, so we report
+	// ours, summing the streams of a bidirectional test that run from us to
+	// the client apart
+	results.End = protocol.TestEnd{}
+	var sent, received, udp [2][]protocol.StreamResult
+	for _, st := range streams {
+		res := st.Result(t, elapsed)
+		dir := 0
+		if session.Config.Bidir && st.Reverse {
+			dir = 1
+		}
+		switch {
+		case t.Datagram():
+			udp[dir] = append(udp[dir], res)
+			results.End.Streams = append(results.End.Streams, protocol.StreamEnd{UDP: &res})
+		case st.Sender:
+			results.End.Streams = append(results.End.Streams, protocol.StreamEnd{Sender: &res})
+		default:
+			results.End.Streams = append(results.End.Streams, protocol.StreamEnd{Receiver: &res})
+		}
+		if st.Sender {
+			sent[dir] = append(sent[dir], res)
+		} else {
+			received[dir] = append(received[dir], res)
+		}
+	}
+	if len(sent[0]) > 0 {
+		results.End.SumSent = protocol.SumResults(sent[0], elapsed)
+	}
+	if len(received[0]) > 0 {
+		results.End.SumReceived = protocol.SumResults(received[0], elapsed)
+	}
+	if t.Datagram() {
+		sum := protocol.SumResults(udp[0], elapsed)
+		results.End.Sum = &sum
+	}
+	if session.Config.Bidir {
+		sumSent := protocol.SumResults(sent[1], elapsed)
+		results.End.SumSentBidirReverse = &sumSent
+		if t.Datagram() {
+			sum := protocol.SumResults(udp[1], elapsed)
+			results.End.SumBidirReverse = &sum
+		}
+	}
 
-// GetUDPStats returns UDP statistics for a client
-func (s *Server) GetUDPStats(clientAddr string) *protocol.UDPStats {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	cpu := &results.End.CPUUtilizationPercent
+	cpu.HostTotal, cpu.HostUser, cpu.HostSystem = sysstat.CPUUtilization(cpuStart, sysstat.SampleCPU())
+	if stats, err := t.Stats(streams[0].Conn); err == nil && !t.Datagram() {
+		if streams[0].Sender {
+			results.End.SenderTCPCongestion = stats.Congestion
+		} else {
+			results.End.ReceiverTCPCongestion = stats.Congestion
+		}
+	}
 
-	if stats, exists := s.udpSessions[clientAddr]; exists {
-		// Return a copy to avoid race conditions
-		statsCopy := *stats
-		return &statsCopy
+	for i := range results.End.Streams {
+		rep.StreamEnd(&results.End.Streams[i])
+	}
+	rep.Summary(results)
+
+	// The client gets our results, plus our own report if it asked for one
+	final := *results
+	if session.Output != nil {
+		if session.Config.JSON {
+			final.ServerOutputJSON = bytes.TrimSpace(session.Output.Bytes())
+		} else {
+			final.ServerOutputText = session.Output.String()
+		}
 	}
-	return nil
-}
 
-// CleanupUDPSession removes UDP session statistics for a client
-func (s *Server) CleanupUDPSession(clientAddr string) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	delete(s.udpSessions, clientAddr)
+	endMsg := &protocol.Message{
+		Type: protocol.MessageTypeTestEnd,
+		Data: mustMarshal(final),
+	}
+
+	return protocol.WriteMessage(session.Conn, endMsg)
 }
 
-// Helper functions
-func generateSessionID() string {
-	return fmt.Sprintf("iperf3-go-%d", time.Now().UnixNano())
+// generateSessionID returns a random test cookie. Data streams join a test
+// by its cookie, so it must not be guessable.
+func generateSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate test cookie: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
 }
 
 func getPort(addr net.Addr) int {
-	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-		return tcpAddr.Port
+	if addr == nil {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func getHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
 	}
-	return 0
+	return host
 }
 
 func mustMarshal(v interface{}) []byte {
@@ -1,8 +1,27 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"iperf3-go/internal/client"
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/report"
+	"iperf3-go/internal/stream"
 )
 
 func TestServerConfig(t *testing.T) {
@@ -36,16 +55,18 @@ func TestServerConfig(t *testing.T) {
 }
 
 func TestGenerateSessionID(t *testing.T) {
-	id1 := generateSessionID()
-	time.Sleep(1 * time.Millisecond) // Ensure different timestamps
-	id2 := generateSessionID()
+	id1, err := generateSessionID()
+	if err != nil {
+		t.Fatalf("generateSessionID failed: %v", err)
+	}
+	id2, _ := generateSessionID()
 
 	if id1 == id2 {
 		t.Error("Expected different session IDs")
 	}
 
-	if len(id1) == 0 {
-		t.Error("Expected non-empty session ID")
+	if len(id1) != 32 {
+		t.Errorf("Expected 128 random bits in hex, got %q", id1)
 	}
 }
 
@@ -57,3 +78,573 @@ func TestGetPort(t *testing.T) {
 		t.Errorf("Expected port 0 for nil address, got %d", port)
 	}
 }
+
+func TestNewReporterCapture(t *testing.T) {
+	srv := New(&Config{Format: "json"})
+	srv.out = io.Discard
+
+	session := &Session{Config: &protocol.TestConfig{GetServerOutput: true}}
+	rep, err := srv.newReporter(session)
+	if err != nil {
+		t.Fatalf("newReporter failed: %v", err)
+	}
+	if session.Output == nil {
+		t.Fatal("Expected server output to be captured")
+	}
+
+	rep.Start(&protocol.TestResults{
+		Start: protocol.TestStart{
+			Connected: []protocol.Connection{{Socket: 1, RemoteHost: "192.0.2.1", RemotePort: 40000}},
+		},
+	})
+	if !strings.HasPrefix(session.Output.String(), "Accepted connection from 192.0.2.1, port 40000\n") {
+		t.Errorf("Expected text capture for a text client, got %q", session.Output.String())
+	}
+
+	srv.config.Format = "no-such-format"
+	if _, err := srv.newReporter(session); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestGetHost(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5201}
+	if host := getHost(addr); host != "192.0.2.1" {
+		t.Errorf("Expected host 192.0.2.1, got %s", host)
+	}
+
+	if host := getHost(nil); host != "" {
+		t.Errorf("Expected empty host for nil address, got %s", host)
+	}
+}
+
+// startTestServer runs a quiet server for proto tests on a free loopback port
+func startTestServer(t *testing.T, proto string) (*Server, int, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	srv := New(&Config{Port: port, Bind: "127.0.0.1", Protocol: proto, Output: io.Discard})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(context.Background()) }()
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+			return srv, port, done
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return nil, 0, nil
+}
+
+// runTestClient runs a quiet client test in the background
+func runTestClient(port, seconds int) <-chan *protocol.TestResults {
+	c := client.New(&client.Config{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Time:     seconds,
+		Reporter: report.Multi(),
+	})
+
+	results := make(chan *protocol.TestResults, 1)
+	go func() {
+		res, _ := c.RunTest(context.Background())
+		results <- res
+	}()
+	return results
+}
+
+func TestShutdownDrains(t *testing.T) {
+	srv, port, done := startTestServer(t, "tcp")
+	results := runTestClient(port, 1)
+	time.Sleep(300 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Start returned %v after Shutdown", err)
+	}
+
+	res := <-results
+	if res == nil || res.Interrupted {
+		t.Fatalf("expected the running test to complete, got %+v", res)
+	}
+
+	// New tests are refused once the server has shut down
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+		t.Error("server still accepting after Shutdown")
+	}
+}
+
+func TestShutdownAborts(t *testing.T) {
+	srv, port, done := startTestServer(t, "tcp")
+	results := runTestClient(port, 10)
+	time.Sleep(300 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to expire, got %v", err)
+	}
+	<-done
+
+	res := <-results
+	if res == nil || !res.Interrupted || res.Error != errShuttingDown.Error() {
+		t.Fatalf("expected the client to see the shutdown, got %+v", res)
+	}
+	if res.End.SumReceived.Bytes == 0 {
+		t.Error("expected the server's partial results")
+	}
+}
+
+func TestUDPStreams(t *testing.T) {
+	_, port, _ := startTestServer(t, "udp")
+
+	c := client.New(&client.Config{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Time:      1,
+		Parallel:  2,
+		Protocol:  "udp",
+		Bandwidth: 2000000,
+		Reporter:  report.Multi(),
+	})
+	res, err := c.RunTest(context.Background())
+	if err != nil {
+		t.Fatalf("RunTest failed: %v", err)
+	}
+
+	if len(res.End.Streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(res.End.Streams))
+	}
+	for i, stream := range res.End.Streams {
+		if stream.UDP == nil || stream.UDP.Socket != i+1 || stream.UDP.Packets == 0 {
+			t.Errorf("Unexpected UDP results for stream %d: %+v", i+1, stream.UDP)
+		}
+	}
+	if res.End.Sum == nil || res.End.SumReceived.Bytes == 0 {
+		t.Errorf("Expected UDP sums with the server's figures, got %+v", res.End)
+	}
+
+	// In reverse, the server sends and the client tracks the loss
+	reverse := client.New(&client.Config{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Time:      1,
+		Protocol:  "udp",
+		Bandwidth: 2000000,
+		Reverse:   true,
+		Reporter:  report.Multi(),
+	})
+	res, err = reverse.RunTest(context.Background())
+	if err != nil {
+		t.Fatalf("RunTest in reverse failed: %v", err)
+	}
+	if udp := res.End.Streams[0].UDP; udp == nil || udp.Sender || udp.Packets == 0 || res.End.SumSent.Packets == 0 {
+		t.Errorf("Unexpected reverse UDP results: %+v", res.End)
+	}
+
+	// A TCP test is refused by a UDP server
+	tcp := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: 1, Reporter: report.Multi()})
+	_, err = tcp.RunTest(context.Background())
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrorCodeInvalidParameter || !strings.Contains(err.Error(), "does not run tcp tests") {
+		t.Errorf("Expected the TCP test to be refused, got %v", err)
+	}
+}
+
+func TestReloadACL(t *testing.T) {
+	srv, port, _ := startTestServer(t, "tcp")
+	path := filepath.Join(t.TempDir(), "acl")
+	srv.config.ACLFile = path
+
+	if err := os.WriteFile(path, []byte("deny 127.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadACL(); err != nil {
+		t.Fatalf("ReloadACL failed: %v", err)
+	}
+	if res := <-runTestClient(port, 1); res != nil {
+		t.Fatalf("expected the test to be rejected, got %+v", res)
+	}
+
+	// A broken file keeps the rules in force
+	if err := os.WriteFile(path, []byte("permit all\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadACL(); err == nil {
+		t.Fatal("expected ReloadACL to fail")
+	}
+	if srv.permits(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) {
+		t.Error("expected the previous rules to stay in force")
+	}
+
+	if err := os.WriteFile(path, []byte("allow 127.0.0.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadACL(); err != nil {
+		t.Fatalf("ReloadACL failed: %v", err)
+	}
+	if res := <-runTestClient(port, 1); res == nil || res.End.SumReceived.Bytes == 0 {
+		t.Fatalf("expected the test to run, got %+v", res)
+	}
+}
+
+// remoteConn is a connection from a given remote address
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestStreamACL(t *testing.T) {
+	srv := New(&Config{Deny: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, Output: io.Discard})
+	session := &Session{ID: "cookie", Config: &protocol.TestConfig{}}
+	srv.sessions[session.ID] = session
+
+	// A stream from a denied source is refused even with the right cookie
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &remoteConn{Conn: local, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5201}}
+	start := &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: mustMarshal(protocol.StreamStart{Cookie: session.ID, ID: 1})}
+	go srv.handleStreamStart(conn, start)
+
+	msg, err := protocol.ReadMessage(remote)
+	if err != nil || msg.Type != protocol.MessageTypeError {
+		t.Fatalf("expected the stream to be refused, got %+v, %v", msg, err)
+	}
+	var errMsg protocol.ErrorMessage
+	if json.Unmarshal(msg.Data, &errMsg); errMsg.Code != protocol.ErrorCodeAccessDenied {
+		t.Errorf("unexpected error: %+v", errMsg)
+	}
+	if len(session.streams) != 0 {
+		t.Error("expected no stream attached to the test")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	srv, port, _ := startTestServer(t, "tcp")
+	srv.config.Limits = Limits{Duration: 5 * time.Second, Parallel: 2, Bitrate: 1000000, BitrateInterval: time.Second}
+
+	tests := []struct {
+		config    client.Config
+		parameter string
+		limit     int64
+	}{
+		{client.Config{Time: 10}, "time", 5},
+		{client.Config{Time: 1, Parallel: 3}, "parallel", 2},
+		{client.Config{Time: 1, Parallel: 2, Bandwidth: 800000}, "bandwidth", 1000000},
+		{client.Config{Time: 1, Parallel: 2, Bandwidth: 300000, Bidir: true}, "bandwidth", 1000000},
+	}
+	for _, tt := range tests {
+		config := tt.config
+		config.Host, config.Port, config.Reporter = "127.0.0.1", port, report.Multi()
+		_, err := client.New(&config).RunTest(context.Background())
+		var serverErr *client.ServerError
+		if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrorCodeInvalidParameter || serverErr.Parameter != tt.parameter || serverErr.Limit != tt.limit {
+			t.Errorf("RunTest(%+v) error = %v, want a server error for %s", tt.config, err, tt.parameter)
+		}
+	}
+
+	// An unpaced TCP test goes over the bitrate limit and is stopped
+	res := <-runTestClient(port, 3)
+	if res == nil || !res.Interrupted || !strings.Contains(res.Error, "larger than the server's limit") {
+		t.Fatalf("expected the test to be stopped, got %+v", res)
+	}
+}
+
+func TestAttachBidir(t *testing.T) {
+	// The parallel limit is on the streams each way
+	session := &Session{ID: "test", Config: &protocol.TestConfig{Parallel: 2, Bidir: true}}
+	limits := &Limits{Parallel: 2}
+	for id := 1; id <= 4; id++ {
+		st := &stream.Stream{ID: id}
+		if errMsg := session.attach(st, limits); errMsg != nil {
+			t.Fatalf("attach(%d) = %v", id, errMsg)
+		}
+		// We send on the last two, which run to the client
+		if st.Sender != (id > 2) || st.Reverse != st.Sender {
+			t.Errorf("stream %d: sender %v, reverse %v", id, st.Sender, st.Reverse)
+		}
+	}
+	if errMsg := session.attach(&stream.Stream{ID: 5}, limits); errMsg == nil || errMsg.Parameter != "parallel" {
+		t.Errorf("expected a fifth stream to be refused, got %v", errMsg)
+	}
+}
+
+func TestBitrateMonitor(t *testing.T) {
+	m := newBitrateMonitor(&Limits{Bitrate: 8000, BitrateInterval: 3 * time.Second})
+	// 1000 bytes a second is exactly the limit; the third second is
+	// averaged with the two before it
+	for i, bytes := range []int64{3000, 0, 0, 1000, 1000, 1000, 1200} {
+		errMsg := m.add(&protocol.Interval{Bytes: bytes, Seconds: 1})
+		if want := i == 6; (errMsg != nil) != want {
+			t.Errorf("interval %d: got %v, want stopped %v", i, errMsg, want)
+		}
+	}
+	if newBitrateMonitor(&Limits{}).add(&protocol.Interval{Bytes: 1 << 40, Seconds: 1}) != nil {
+		t.Error("expected no limit without a bitrate")
+	}
+}
+
+func TestOneOffBusy(t *testing.T) {
+	srv, port, _ := startTestServer(t, "tcp")
+	srv.config.OneOff = true
+	results := runTestClient(port, 1)
+	time.Sleep(300 * time.Millisecond)
+
+	c := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: 1, Reporter: report.Multi()})
+	_, err := c.RunTest(context.Background())
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrorCodeBusy {
+		t.Errorf("Expected the busy server to refuse the test, got %v", err)
+	}
+	if res := <-results; res == nil || res.Interrupted {
+		t.Errorf("Expected the first test to run, got %+v", res)
+	}
+}
+
+// waitRecorder records the client's waits for a busy server
+type waitRecorder struct {
+	report.Reporter
+	mu        sync.Mutex
+	positions []int
+	retries   int
+}
+
+func (r *waitRecorder) Queued(position int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.positions = append(r.positions, position)
+}
+
+func (r *waitRecorder) Retrying(err error, delay time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retries++
+}
+
+func TestQueue(t *testing.T) {
+	srv, port, _ := startTestServer(t, "tcp")
+	srv.config.MaxTests, srv.config.QueueLength = 1, 1
+
+	run := func(seconds int, retry time.Duration, rec *waitRecorder) <-chan error {
+		done := make(chan error, 1)
+		c := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: seconds, Retry: retry, Reporter: rec})
+		go func() {
+			_, err := c.RunTest(context.Background())
+			done <- err
+		}()
+		return done
+	}
+
+	first := run(1, 0, &waitRecorder{Reporter: report.Multi()})
+	time.Sleep(200 * time.Millisecond)
+	queued := &waitRecorder{Reporter: report.Multi()}
+	second := run(1, 0, queued)
+	time.Sleep(200 * time.Millisecond)
+
+	// The queue is full, so a third test is refused, and runs once retried
+	_, err := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: 1, Reporter: report.Multi()}).RunTest(context.Background())
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrorCodeBusy || !serverErr.Retryable {
+		t.Errorf("Expected the test to be refused as busy, got %v", err)
+	}
+	retried := &waitRecorder{Reporter: report.Multi()}
+	third := run(1, 10*time.Second, retried)
+
+	for i, done := range []<-chan error{first, second, third} {
+		if err := <-done; err != nil {
+			t.Errorf("test %d failed: %v", i+1, err)
+		}
+	}
+	if fmt.Sprint(queued.positions) != "[1]" {
+		t.Errorf("Expected the second test to be queued at position 1, got %v", queued.positions)
+	}
+	if retried.retries == 0 {
+		t.Error("Expected the third test to be retried")
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	var a admission
+	if w, _, ok := a.enter(1, 2); w != nil || !ok {
+		t.Fatal("Expected the first test to run")
+	}
+	w1, pos1, _ := a.enter(1, 2)
+	w2, pos2, _ := a.enter(1, 2)
+	if w1 == nil || w2 == nil || pos1 != 1 || pos2 != 2 {
+		t.Fatalf("Expected two queued tests, got positions %d and %d", pos1, pos2)
+	}
+	if _, _, ok := a.enter(1, 2); ok {
+		t.Fatal("Expected a full queue to refuse the test")
+	}
+
+	// The first queued test gives up, so the second moves up and takes
+	// the place of the running test when it ends
+	if !a.leave(w1) {
+		t.Fatal("Expected the test to leave the queue")
+	}
+	if a.position(w2) != 1 {
+		t.Errorf("Expected position 1, got %d", a.position(w2))
+	}
+	a.release()
+	select {
+	case <-w2.admitted:
+	default:
+		t.Fatal("Expected the queued test to be admitted")
+	}
+	if a.leave(w2) {
+		t.Error("Expected an admitted test not to be in the queue")
+	}
+	a.release()
+	if a.running != 0 || len(a.queue) != 0 {
+		t.Errorf("Expected no tests left, got %d running and %d queued", a.running, len(a.queue))
+	}
+}
+
+// startRawTest starts a test configured by config with one data stream by
+// hand, returning its control connection and stream
+func startRawTest(t *testing.T, port int, config protocol.TestConfig) (net.Conn, net.Conn) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	protocol.WriteMessage(conn, &protocol.Message{Type: protocol.MessageTypeTestStart, Data: mustMarshal(config)})
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil || msg.Type != protocol.MessageTypeTestStartAck {
+		t.Fatalf("expected the test to start, got %+v, %v", msg, err)
+	}
+	var ack protocol.TestStartAck
+	json.Unmarshal(msg.Data, &ack)
+
+	st, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to open a stream: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	protocol.WriteMessage(st, &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: mustMarshal(protocol.StreamStart{Cookie: ack.Cookie, ID: 1})})
+	if msg, err := protocol.ReadMessage(st); err != nil || msg.Type != protocol.MessageTypeStreamStartAck {
+		t.Fatalf("expected the stream to start, got %+v, %v", msg, err)
+	}
+	protocol.WriteMessage(conn, &protocol.Message{Type: protocol.MessageTypeTestRunning})
+	return conn, st
+}
+
+func TestPeerTimeout(t *testing.T) {
+	srv, port, _ := startTestServer(t, "tcp")
+	srv.config.PeerTimeout = 2 * time.Second
+
+	// A client that starts a test with heartbeats, then goes quiet
+	conn, _ := startRawTest(t, port, protocol.TestConfig{Protocol: "tcp", Time: 30, Heartbeat: 1000})
+
+	// The server gives up on the client long before the test would end
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("expected the server to stop the test: %v", err)
+		}
+		if msg.Type != protocol.MessageTypeError {
+			continue
+		}
+		var errMsg protocol.ErrorMessage
+		json.Unmarshal(msg.Data, &errMsg)
+		if errMsg.Code != protocol.ErrorCodeAborted || !strings.Contains(errMsg.Message, "the client stopped responding") {
+			t.Errorf("unexpected error: %+v", errMsg)
+		}
+		break
+	}
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil || msg.Type != protocol.MessageTypeTestEnd {
+		t.Fatalf("expected the server's results, got %+v, %v", msg, err)
+	}
+	var res protocol.TestResults
+	json.Unmarshal(msg.Data, &res)
+	if !res.Interrupted || !strings.Contains(res.Error, "stopped responding") {
+		t.Errorf("expected the results to record why the test stopped, got %v, %q", res.Interrupted, res.Error)
+	}
+
+	// A client sending heartbeats is not taken for gone
+	c := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: 3, Reporter: report.Multi()})
+	if _, err := c.RunTest(context.Background()); err != nil {
+		t.Errorf("RunTest failed: %v", err)
+	}
+}
+
+func TestControlReaderExits(t *testing.T) {
+	_, port, _ := startTestServer(t, "tcp")
+	before := runtime.NumGoroutine()
+
+	// A client that never ends the test, but keeps sending heartbeats
+	// until it has the server's results
+	conn, _ := startRawTest(t, port, protocol.TestConfig{Protocol: "tcp", Time: 1, Heartbeat: 50})
+	stop := make(chan struct{})
+	go func() {
+		heartbeat := &protocol.Message{Type: protocol.MessageTypeHeartbeat}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if protocol.WriteMessage(conn, heartbeat) != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("expected the server's results: %v", err)
+		}
+		if msg.Type == protocol.MessageTypeTestEnd {
+			break
+		}
+	}
+	close(stop)
+	conn.Close()
+
+	// The server's goroutines for the test all end with it
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("goroutines leaked: %d before the test, %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestInterruptedJSONStream(t *testing.T) {
+	_, port, _ := startTestServer(t, "tcp")
+
+	var buf bytes.Buffer
+	c := client.New(&client.Config{Host: "127.0.0.1", Port: port, Time: 10, Reporter: report.NewJSONStream(&buf, report.Options{})})
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if _, err := c.RunTest(ctx); !errors.Is(err, client.ErrInterrupted) {
+		t.Fatalf("expected the test to be interrupted, got %v", err)
+	}
+
+	// The end event is marked with why the test stopped
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[len(lines)-2], `{"event":"end",`) {
+		t.Fatalf("expected the end event, got %q", buf.String())
+	}
+	if last := lines[len(lines)-1]; last != `{"event":"error","data":"interrupt - the client has terminated"}` {
+		t.Errorf("unexpected last event: %s", last)
+	}
+}
@@ -0,0 +1,376 @@
+// Package stream moves the data of a test's streams and measures it. The
+// client and the server each run one end of every stream: the client sends
+// and the server receives, unless the stream is reversed.
+package stream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/transport"
+)
+
+// DefaultLength returns iperf3's block length for protocol when none is
+// given: 1460 bytes for UDP, so that a packet fits a typical MTU, and 128 KB
+// otherwise
+func DefaultLength(protocol string) int {
+	if protocol == "udp" {
+		return 1460
+	}
+	return 128 * 1024
+}
+
+// DefaultBitrate returns iperf3's target bitrate for protocol when none is
+// given: 1 Mbit/s for UDP, and 0, unlimited, otherwise
+func DefaultBitrate(protocol string) int64 {
+	if protocol == "udp" {
+		return 1000000
+	}
+	return 0
+}
+
+// Params shape the data the sending end of a stream writes
+type Params struct {
+	// Length is the size of each write, the payload of each datagram for
+	// datagram transports
+	Length int
+	// Bitrate is the target rate of datagrams in bits/sec, 0 for unlimited;
+	// other transports send as fast as they can
+	Bitrate int64
+	// Burst is the number of datagrams sent back to back per pacing tick
+	Burst int
+}
+
+// Stream is our end of one of a test's data streams
+type Stream struct {
+	ID   int
+	Conn net.Conn
+	// Sender is set on the end that sends the data
+	Sender bool
+	// Reverse is set on streams whose data runs from the server to the
+	// client
+	Reverse bool
+
+	bytes, intervalBytes     atomic.Int64
+	packets, intervalPackets atomic.Int64
+	// done is closed when the stream stops sending or receiving
+	done chan struct{}
+
+	// Set by the goroutine measuring the test
+	lastRetransmits int
+	intervals       []protocol.Interval
+	// substreams counts the bytes carried per substream before the test
+	substreams map[int]int64
+
+	// UDP statistics of the receiving end, as of now and as of the last
+	// interval
+	mu      sync.Mutex
+	udp     protocol.UDPStats
+	lastUDP protocol.UDPStats
+}
+
+// Start sends on the stream if we are its sender, until ctx is done, and
+// otherwise counts what we receive until the stream ends or fails
+func (st *Stream) Start(ctx context.Context, datagram bool, params Params) {
+	if ss, ok := st.Conn.(transport.Substreams); ok {
+		sent, received := ss.SubstreamBytes()
+		st.substreams = received
+		if st.Sender {
+			st.substreams = sent
+		}
+	}
+
+	st.done = make(chan struct{})
+	go func() {
+		defer close(st.done)
+		switch {
+		case st.Sender && datagram:
+			st.sendDatagrams(ctx, params)
+		case st.Sender:
+			st.send(ctx, params)
+		case datagram:
+			st.receiveDatagrams()
+		default:
+			st.receive()
+		}
+	}()
+}
+
+// Stop stops a started stream, unblocking a write or read in progress, and
+// waits for it
+func (st *Stream) Stop() {
+	if st.done == nil {
+		return
+	}
+	st.Conn.SetDeadline(time.Now())
+	<-st.done
+}
+
+// Drain waits up to timeout in all for the streams to stop on their own, as
+// receivers do once the data in flight has arrived
+func Drain(streams []*Stream, timeout time.Duration) {
+	expired := time.After(timeout)
+	for _, st := range streams {
+		if st.done == nil {
+			continue
+		}
+		select {
+		case <-st.done:
+		case <-expired:
+			return
+		}
+	}
+}
+
+// Bytes returns the bytes sent or received so far
+func (st *Stream) Bytes() int64 {
+	return st.bytes.Load()
+}
+
+// pattern returns a buffer of n bytes to send
+func pattern(n int) []byte {
+	buffer := make([]byte, n)
+	for i := range buffer {
+		buffer[i] = byte(i % 256)
+	}
+	return buffer
+}
+
+// send writes to the stream as fast as it will take the data until ctx is
+// done
+func (st *Stream) send(ctx context.Context, params Params) {
+	buffer := pattern(params.Length)
+	for ctx.Err() == nil {
+		// A write cut short when the test stops still put n bytes on the wire
+		n, err := st.Conn.Write(buffer)
+		st.bytes.Add(int64(n))
+		st.intervalBytes.Add(int64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendDatagrams sends numbered, timestamped datagrams at the target bitrate
+// until ctx is done
+func (st *Stream) sendDatagrams(ctx context.Context, params Params) {
+	buffer := pattern(params.Length)
+
+	// A burst of packets is sent back to back on every tick. Without a
+	// target bitrate, or with one too high for the ticker to pace, packets go
+	// out as fast as the socket takes them
+	burst := max(params.Burst, 1)
+	var tick <-chan time.Time
+	if params.Bitrate > 0 {
+		packetInterval := time.Duration(float64(params.Length*8*burst) / float64(params.Bitrate) * float64(time.Second))
+		if packetInterval > 0 {
+			ticker := time.NewTicker(packetInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+	}
+
+	header := protocol.UDPPacketHeader{Magic: protocol.UDPMagic}
+	for ctx.Err() == nil {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		}
+		for i := 0; i < burst; i++ {
+			// Packets too short for the header go out as they are
+			if params.Length >= protocol.UDPHeaderSize {
+				header.Timestamp = time.Now().UnixNano()
+				header.Put(buffer)
+			}
+
+			n, err := st.Conn.Write(buffer)
+			if err != nil {
+				return
+			}
+			st.bytes.Add(int64(n))
+			st.intervalBytes.Add(int64(n))
+			st.packets.Add(1)
+			st.intervalPackets.Add(1)
+			header.Sequence++
+		}
+	}
+}
+
+// receive counts the bytes read from the stream until it ends
+func (st *Stream) receive() {
+	buffer := make([]byte, 128*1024) // 128KB buffer
+	for {
+		n, err := st.Conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		st.bytes.Add(int64(n))
+		st.intervalBytes.Add(int64(n))
+	}
+}
+
+// receiveDatagrams counts the datagrams read from the stream, tracking their
+// loss and jitter, until the stream is closed
+func (st *Stream) receiveDatagrams() {
+	buffer := make([]byte, 65536) // Max UDP packet size
+	for {
+		n, err := st.Conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		st.bytes.Add(int64(n))
+		st.intervalBytes.Add(int64(n))
+
+		if header, ok := protocol.ParseUDPPacketHeader(buffer[:n]); ok {
+			st.mu.Lock()
+			st.udp.Add(header, time.Now())
+			st.mu.Unlock()
+		}
+	}
+}
+
+// Interval returns the stream's measurement for the interval from start to
+// end seconds. A sender adds the statistics t keeps for the connection.
+func (st *Stream) Interval(t transport.Transport, start, end float64) protocol.Interval {
+	iv := protocol.Interval{
+		Socket:  st.ID,
+		Start:   start,
+		End:     end,
+		Seconds: end - start,
+		Bytes:   st.intervalBytes.Swap(0),
+		Omitted: false,
+		Sender:  st.Sender,
+	}
+	iv.BitsPerSecond = float64(iv.Bytes*8) / iv.Seconds
+
+	switch {
+	case st.Sender && t.Datagram():
+		iv.Packets = st.intervalPackets.Swap(0)
+	case st.Sender:
+		if stats, err := t.Stats(st.Conn); err == nil {
+			iv.Retransmits = protocol.NewCount(stats.Retransmits - st.lastRetransmits)
+			iv.SndCwnd = stats.SndCwnd
+			iv.RTT = stats.RTT
+			iv.RTTVar = stats.RTTVar
+			iv.PMTU = stats.PMTU
+			iv.Path = stats.Path
+			st.lastRetransmits = stats.Retransmits
+		}
+	case t.Datagram():
+		st.mu.Lock()
+		now, last := st.udp, st.lastUDP
+		st.lastUDP = now
+		st.mu.Unlock()
+
+		// Packets counts those expected, lost ones included
+		iv.LostPackets = now.LostPackets - last.LostPackets
+		iv.Packets = now.TotalPackets - last.TotalPackets + iv.LostPackets
+		iv.OutOfOrder = now.OutOfOrder - last.OutOfOrder
+		iv.Jitter = now.Jitter
+		if iv.Packets > 0 {
+			iv.LostPercent = float64(iv.LostPackets) * 100 / float64(iv.Packets)
+		}
+	}
+	st.intervals = append(st.intervals, iv)
+	return iv
+}
+
+// Report measures the streams over the interval from start to end seconds.
+// In a bidirectional test, the streams running from the server to the
+// client are summed apart.
+func Report(t transport.Transport, streams []*Stream, start, end float64, bidir bool) protocol.IntervalReport {
+	var report protocol.IntervalReport
+	var forward, reverse []protocol.Interval
+	for _, st := range streams {
+		iv := st.Interval(t, start, end)
+		report.Streams = append(report.Streams, iv)
+		if bidir && st.Reverse {
+			reverse = append(reverse, iv)
+		} else {
+			forward = append(forward, iv)
+		}
+	}
+	report.Sum = protocol.SumIntervals(forward, start, end)
+	if bidir {
+		sum := protocol.SumIntervals(reverse, start, end)
+		report.SumBidirReverse = &sum
+	}
+	return report
+}
+
+// Result returns the stream's final results for a test of elapsed seconds.
+// A sender sums up the statistics of its intervals.
+func (st *Stream) Result(t transport.Transport, elapsed float64) protocol.StreamResult {
+	res := protocol.StreamResult{
+		Socket:        st.ID,
+		Start:         0,
+		End:           elapsed,
+		Seconds:       elapsed,
+		Bytes:         st.bytes.Load(),
+		BitsPerSecond: float64(st.bytes.Load()*8) / elapsed,
+		Sender:        st.Sender,
+	}
+	if ss, ok := st.Conn.(transport.Substreams); ok {
+		sent, received := ss.SubstreamBytes()
+		if !st.Sender {
+			sent = received
+		}
+		res.Substreams = protocol.SubstreamResults(st.substreams, sent, elapsed)
+	}
+
+	switch {
+	case st.Sender && t.Datagram():
+		res.Packets = st.packets.Load()
+	case st.Sender:
+		var rtts []int
+		for _, iv := range st.intervals {
+			res.Retransmits = protocol.AddCounts(res.Retransmits, iv.Retransmits)
+			res.MaxSndCwnd = max(res.MaxSndCwnd, iv.SndCwnd)
+			if iv.RTT > 0 {
+				rtts = append(rtts, iv.RTT)
+			}
+		}
+		res.MaxRTT, res.MinRTT, res.MeanRTT = rttStats(rtts)
+		res.Paths = protocol.PathResults(st.intervals)
+	case t.Datagram():
+		st.mu.Lock()
+		udp := st.udp
+		st.mu.Unlock()
+
+		res.LostPackets = udp.LostPackets
+		res.Packets = udp.TotalPackets + udp.LostPackets
+		res.OutOfOrder = udp.OutOfOrder
+		res.Jitter = udp.Jitter
+		if res.Packets > 0 {
+			res.LostPercent = float64(res.LostPackets) * 100 / float64(res.Packets)
+		}
+	}
+	return res
+}
+
+// rttStats returns the maximum, minimum and mean of the sampled RTTs
+func rttStats(rtts []int) (maxRTT, minRTT, meanRTT int) {
+	if len(rtts) == 0 {
+		return 0, 0, 0
+	}
+
+	minRTT = rtts[0]
+	total := 0
+	for _, rtt := range rtts {
+		if rtt > maxRTT {
+			maxRTT = rtt
+		}
+		if rtt < minRTT {
+			minRTT = rtt
+		}
+		total += rtt
+	}
+	return maxRTT, minRTT, total / len(rtts)
+}
@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	maxRTT, minRTT, meanRTT := rttStats([]int{300, 100, 200})
+	if maxRTT != 300 || minRTT != 100 || meanRTT != 200 {
+		t.Errorf("Expected 300/100/200, got %d/%d/%d", maxRTT, minRTT, meanRTT)
+	}
+
+	if maxRTT, minRTT, meanRTT := rttStats(nil); maxRTT != 0 || minRTT != 0 || meanRTT != 0 {
+		t.Errorf("Expected zeros for no samples, got %d/%d/%d", maxRTT, minRTT, meanRTT)
+	}
+}
+
+func TestSendDatagramsUnpaced(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("udp", ln.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// A rate too high to pace, and no rate at all, both send flat out
+	for _, bitrate := range []int64{100e12, 0} {
+		st := &Stream{Conn: conn, Sender: true}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		st.sendDatagrams(ctx, Params{Length: 1460, Bitrate: bitrate, Burst: 10})
+		cancel()
+		if st.packets.Load() < 100 {
+			t.Errorf("expected packets sent unpaced at %d bits/sec, got %d", bitrate, st.packets.Load())
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	// Only the middle stream reaches the end of its data
+	streams := []*Stream{{done: make(chan struct{})}, {done: make(chan struct{})}, {done: make(chan struct{})}}
+	close(streams[1].done)
+
+	finished := make(chan struct{})
+	go func() {
+		Drain(streams, 100*time.Millisecond)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Drain did not give up on the unfinished streams")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The sender writes until stopped, the receiver reads what it sends
+	sender := &Stream{ID: 1, Conn: client, Sender: true}
+	receiver := &Stream{ID: 1, Conn: server}
+	receiver.Start(context.Background(), false, Params{})
+	ctx, cancel := context.WithCancel(context.Background())
+	sender.Start(ctx, false, Params{Length: 1024})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	sender.Stop()
+	client.Close()
+	Drain([]*Stream{receiver}, time.Second)
+	receiver.Stop()
+
+	if sender.Bytes() == 0 || receiver.Bytes() != sender.Bytes() {
+		t.Errorf("expected the bytes sent to be received, sent %d and received %d", sender.Bytes(), receiver.Bytes())
+	}
+	// Stopping a stream that never started does nothing
+	(&Stream{Conn: client}).Stop()
+}
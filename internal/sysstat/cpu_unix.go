@@ -0,0 +1,16 @@
+//go:build unix
+
+package sysstat
+
+import (
+	"syscall"
+	"time"
+)
+
+func processTimes() (user, system time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package sysstat
+
+import (
+	"syscall"
+	"time"
+)
+
+func processTimes() (user, system time.Duration) {
+	var creation, exit, kernel, usr syscall.Filetime
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0
+	}
+	if err := syscall.GetProcessTimes(handle, &creation, &exit, &kernel, &usr); err != nil {
+		return 0, 0
+	}
+	// Filetime counts 100ns ticks
+	return filetimeDuration(usr), filetimeDuration(kernel)
+}
+
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	ticks := int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+	return time.Duration(ticks * 100)
+}
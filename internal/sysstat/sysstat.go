@@ -0,0 +1,63 @@
+// Package sysstat collects the host and socket statistics iperf3 reports:
+// process CPU usage, TCP_INFO counters and the congestion control algorithm.
+package sysstat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// ErrUnsupported is returned when a statistic is not available on this platform
+var ErrUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+// CPUSample is a snapshot of the process CPU times
+type CPUSample struct {
+	Wall   time.Time
+	User   time.Duration
+	System time.Duration
+}
+
+// SampleCPU takes a snapshot of the process CPU times
+func SampleCPU() CPUSample {
+	user, system := processTimes()
+	return CPUSample{
+		Wall:   time.Now(),
+		User:   user,
+		System: system,
+	}
+}
+
+// CPUUtilization returns the total, user and system CPU usage between two
+// samples as a percentage of the elapsed wall-clock time
+func CPUUtilization(start, end CPUSample) (total, user, system float64) {
+	wall := end.Wall.Sub(start.Wall)
+	if wall <= 0 {
+		return 0, 0, 0
+	}
+
+	user = float64(end.User-start.User) / float64(wall) * 100.0
+	system = float64(end.System-start.System) / float64(wall) * 100.0
+	return user + system, user, system
+}
+
+// SystemInfo describes the host in the spirit of iperf3's system_info field
+func SystemInfo() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s %s %s %s", runtime.GOOS, hostname, runtime.Version(), runtime.GOARCH)
+}
+
+// TCPInfo holds the TCP_INFO counters iperf3 reports for a stream
+type TCPInfo struct {
+	Retransmits int // total retransmitted segments
+	SndCwnd     int // congestion window in bytes
+	RTT         int // smoothed round-trip time in microseconds
+	RTTVar      int // round-trip time variance in microseconds
+	PMTU        int // path MTU in bytes
+	SndMSS      int // sender maximum segment size in bytes
+}
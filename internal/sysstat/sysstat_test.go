@@ -0,0 +1,56 @@
+package sysstat
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCPUUtilization(t *testing.T) {
+	start := CPUSample{Wall: time.Unix(0, 0)}
+	end := CPUSample{
+		Wall:   time.Unix(10, 0),
+		User:   2 * time.Second,
+		System: 1 * time.Second,
+	}
+
+	total, user, system := CPUUtilization(start, end)
+	if user != 20 || system != 10 || total != 30 {
+		t.Errorf("Expected 30/20/10, got %v/%v/%v", total, user, system)
+	}
+
+	if total, _, _ := CPUUtilization(end, end); total != 0 {
+		t.Errorf("Expected 0 for empty interval, got %v", total)
+	}
+}
+
+func TestGetTCPInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only read on Linux")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	info, err := GetTCPInfo(conn)
+	if err != nil {
+		t.Fatalf("GetTCPInfo failed: %v", err)
+	}
+	if info.SndMSS <= 0 {
+		t.Errorf("Expected positive MSS, got %d", info.SndMSS)
+	}
+
+	if _, err := TCPCongestion(conn); err != nil {
+		t.Errorf("TCPCongestion failed: %v", err)
+	}
+}
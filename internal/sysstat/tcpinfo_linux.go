@@ -0,0 +1,96 @@
+//go:build linux
+
+package sysstat
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// GetTCPInfo reads the TCP_INFO counters of a TCP connection
+func GetTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	var raw syscall.TCPInfo
+	size := uint32(unsafe.Sizeof(raw))
+
+	err := control(conn, func(fd uintptr) error {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPInfo{
+		Retransmits: int(raw.Total_retrans),
+		SndCwnd:     int(raw.Snd_cwnd) * int(raw.Snd_mss),
+		RTT:         int(raw.Rtt),
+		RTTVar:      int(raw.Rttvar),
+		PMTU:        int(raw.Pmtu),
+		SndMSS:      int(raw.Snd_mss),
+	}, nil
+}
+
+// TCPCongestion returns the congestion control algorithm of a TCP connection
+func TCPCongestion(conn net.Conn) (string, error) {
+	buf := make([]byte, 16) // TCP_CA_NAME_MAX
+	size := uint32(len(buf))
+
+	err := control(conn, func(fd uintptr) error {
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for i, b := range buf[:size] {
+		if b == 0 {
+			return string(buf[:i]), nil
+		}
+	}
+	return string(buf[:size]), nil
+}
+
+// SocketBuffers returns the actual send and receive buffer sizes of a socket
+func SocketBuffers(conn net.Conn) (sndbuf, rcvbuf int, err error) {
+	err = control(conn, func(fd uintptr) error {
+		var err error
+		if sndbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil {
+			return err
+		}
+		rcvbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		return err
+	})
+	return sndbuf, rcvbuf, err
+}
+
+// control runs f against the file descriptor of conn
+func control(conn net.Conn, f func(fd uintptr) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var opErr error
+	if err := raw.Control(func(fd uintptr) {
+		opErr = f(fd)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package sysstat
+
+import "net"
+
+// GetTCPInfo reads the TCP_INFO counters of a TCP connection
+func GetTCPInfo(conn net.Conn) (*TCPInfo, error) {
+	return nil, ErrUnsupported
+}
+
+// TCPCongestion returns the congestion control algorithm of a TCP connection
+func TCPCongestion(conn net.Conn) (string, error) {
+	return "", ErrUnsupported
+}
+
+// SocketBuffers returns the actual send and receive buffer sizes of a socket
+func SocketBuffers(conn net.Conn) (sndbuf, rcvbuf int, err error) {
+	return 0, 0, ErrUnsupported
+}
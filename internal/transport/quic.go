@@ -0,0 +1,487 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// QUIC carries tests over QUIC: the control connection and each data stream
+// are QUIC connections. A data stream can spread its data over several QUIC
+// streams of its connection (see DialOptions.Streams), which are then
+// reported as its substreams.
+//
+// QUIC always runs over TLS. The server presents a throwaway self-signed
+// certificate that clients do not verify, since the test measures the path
+// rather than the server's identity.
+type QUIC struct{}
+
+// quicALPN is the application protocol negotiated on QUIC connections
+const quicALPN = "iperf3-go"
+
+// maxQUICStreams bounds the QUIC streams a peer may open on one connection
+const maxQUICStreams = 65535
+
+// quicChunkSize is the most data read from a QUIC stream at once
+const quicChunkSize = 64 * 1024
+
+// quicStreamHello starts every stream the client opens. A QUIC stream only
+// reaches the server with its first data, so without it the server would
+// not see the streams the client has yet to write to, and its own writes,
+// which go round-robin to the streams it knows of, would use fewer of them.
+var quicStreamHello = []byte{0}
+
+func (QUIC) Name() string { return "quic" }
+
+func (QUIC) Datagram() bool { return false }
+
+func (QUIC) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: opts.Control}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	}
+
+	// Each accepted connection gets its own metrics, found by Stats
+	// through the connection's context
+	tr := &quic.Transport{
+		Conn: pc,
+		ConnContext: func(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+			return context.WithValue(ctx, quicMetricsKey{}, &quicMetrics{}), nil
+		},
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+	}
+	ln, err := tr.Listen(tlsConfig, quicConfig())
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to listen on QUIC %s: %w", addr, err)
+	}
+	return &quicListener{ln: ln, tr: tr, pc: pc}, nil
+}
+
+func (t QUIC) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	opts.Streams = 1
+	return t.dial(ctx, addr, opts)
+}
+
+func (t QUIC) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return t.dial(ctx, addr, opts)
+}
+
+// SetOptions sizes the UDP socket buffers of a client connection; server
+// connections share the listener's socket
+func (QUIC) SetOptions(conn net.Conn, opts SocketOptions) error {
+	c, ok := conn.(*quicConn)
+	if !ok || c.pc == nil {
+		return nil
+	}
+	return setBuffers(c.pc.(net.Conn), opts.Window)
+}
+
+// Stats reports the connection's congestion window, smoothed RTT and path
+// MTU. Retransmits counts the packets declared lost, whose data QUIC sends
+// again in new packets.
+func (QUIC) Stats(conn net.Conn) (*Stats, error) {
+	c, ok := conn.(*quicConn)
+	if !ok || c.metrics == nil {
+		return nil, ErrNoStats
+	}
+
+	m := c.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &Stats{}
+	stats.SndCwnd = m.cwnd
+	stats.RTT = int(m.rtt / time.Microsecond)
+	stats.RTTVar = int(m.rttVar / time.Microsecond)
+	stats.Retransmits = m.lost
+	stats.PMTU = m.mtu
+	return stats, nil
+}
+
+// dial opens a QUIC connection to addr from its own UDP socket, with
+// opts.Streams QUIC streams
+func (QUIC) dial(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	if opts.Dial != nil {
+		return nil, errors.New("QUIC connections cannot be opened with a custom dialer")
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+	local := bindAddr(opts.Bind)
+	if local == "" {
+		local = sourceAddr(raddr)
+	}
+	lc := net.ListenConfig{Control: opts.Control}
+	pc, err := lc.ListenPacket(ctx, "udp", local)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind %s: %w", local, err)
+	}
+
+	metrics := &quicMetrics{}
+	tr := &quic.Transport{Conn: pc}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+	}
+	conn, err := tr.Dial(context.WithValue(ctx, quicMetricsKey{}, metrics), raddr, tlsConfig, quicConfig())
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+
+	c := newQUICConn(conn, metrics)
+	c.tr, c.pc = tr, pc
+	for i := 0; i < max(opts.Streams, 1); i++ {
+		st, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to open QUIC stream: %w", err)
+		}
+		if _, err := st.Write(quicStreamHello); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to start QUIC stream: %w", err)
+		}
+		c.addStream(st)
+	}
+	return c, nil
+}
+
+// sourceAddr is the local address the kernel would send to raddr from, so
+// that an unbound client reports its actual address rather than a wildcard
+func sourceAddr(raddr *net.UDPAddr) string {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return ":0"
+	}
+	defer conn.Close()
+	return net.JoinHostPort(conn.LocalAddr().(*net.UDPAddr).IP.String(), "0")
+}
+
+// quicConfig is the configuration of both ends' connections
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIncomingStreams: maxQUICStreams,
+		KeepAlivePeriod:    5 * time.Second,
+		Tracer:             traceMetrics,
+	}
+}
+
+// quicListener accepts QUIC connections as quicConns
+type quicListener struct {
+	ln *quic.Listener
+	tr *quic.Transport
+	pc net.PacketConn
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, err := l.ln.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	metrics, _ := conn.Context().Value(quicMetricsKey{}).(*quicMetrics)
+	c := newQUICConn(conn, metrics)
+	c.accepted = true
+	go c.acceptStreams()
+	return c, nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.ln.Close()
+	l.tr.Close()
+	l.pc.Close()
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr { return l.ln.Addr() }
+
+// quicConn is a QUIC connection read and written like a stream. Writes go
+// round-robin to the connection's QUIC streams; reads return the data of all
+// of them as it arrives. The bytes carried by each QUIC stream are counted
+// by its index, in the order the client opened them.
+type quicConn struct {
+	conn    *quic.Conn
+	metrics *quicMetrics
+	// The client's own UDP socket and transport, closed with the connection
+	tr *quic.Transport
+	pc net.PacketConn
+	// accepted is set on the server, whose streams start with quicStreamHello
+	accepted bool
+
+	chunks  chan []byte
+	ended   chan struct{}
+	done    chan struct{}
+	pending []byte
+	chunk   []byte
+
+	mu           sync.Mutex
+	streams      []*quic.Stream
+	next         int
+	reading      int
+	readErr      error
+	readDeadline time.Time
+	sent         map[int]int64
+	received     map[int]int64
+	closeOnce    sync.Once
+}
+
+var chunkPool = sync.Pool{New: func() any { return make([]byte, quicChunkSize) }}
+
+func newQUICConn(conn *quic.Conn, metrics *quicMetrics) *quicConn {
+	return &quicConn{
+		conn:     conn,
+		metrics:  metrics,
+		chunks:   make(chan []byte, 64),
+		ended:    make(chan struct{}),
+		done:     make(chan struct{}),
+		sent:     make(map[int]int64),
+		received: make(map[int]int64),
+	}
+}
+
+// acceptStreams adds the streams the client opens until the connection ends
+func (c *quicConn) acceptStreams() {
+	for {
+		st, err := c.conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		c.addStream(st)
+	}
+}
+
+// addStream starts reading a stream and makes it available to writes
+func (c *quicConn) addStream(st *quic.Stream) {
+	c.mu.Lock()
+	c.streams = append(c.streams, st)
+	c.reading++
+	c.mu.Unlock()
+	go c.readStream(st)
+}
+
+// readStream passes a stream's data on to Read until the stream ends
+func (c *quicConn) readStream(st *quic.Stream) {
+	id := int(st.StreamID() / 4)
+	if c.accepted {
+		hello := make([]byte, len(quicStreamHello))
+		if _, err := io.ReadFull(st, hello); err != nil {
+			c.streamEnded(err)
+			return
+		}
+	}
+	for {
+		buf := chunkPool.Get().([]byte)
+		n, err := st.Read(buf)
+		if n > 0 {
+			c.mu.Lock()
+			c.received[id] += int64(n)
+			c.mu.Unlock()
+
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			c.streamEnded(err)
+			return
+		}
+	}
+}
+
+// streamEnded records the end of a stream; reads fail once all have ended
+func (c *quicConn) streamEnded(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading--
+	if c.readErr == nil && (c.reading == 0 || !errors.Is(err, io.EOF)) {
+		c.readErr = err
+		close(c.ended)
+	}
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.chunk != nil {
+			chunkPool.Put(c.chunk[:cap(c.chunk)])
+			c.chunk = nil
+		}
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case chunk := <-c.chunks:
+			c.chunk, c.pending = chunk, chunk
+		case <-c.ended:
+			// Data read before the streams ended comes first
+			select {
+			case chunk := <-c.chunks:
+				c.chunk, c.pending = chunk, chunk
+			default:
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return 0, c.readErr
+			}
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.streams) == 0 {
+		c.mu.Unlock()
+		return 0, errors.New("no QUIC stream to write to")
+	}
+	st := c.streams[c.next]
+	c.next = (c.next + 1) % len(c.streams)
+	c.mu.Unlock()
+
+	n, err := st.Write(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.sent[int(st.StreamID()/4)] += int64(n)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// CloseWrite ends the sending side of every stream
+func (c *quicConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, st := range c.streams {
+		st.Close()
+	}
+	return nil
+}
+
+func (c *quicConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.CloseWithError(0, "")
+		if c.tr != nil {
+			c.tr.Close()
+			c.pc.Close()
+		}
+	})
+	return nil
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline; it applies from the next read
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, st := range c.streams {
+		st.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (c *quicConn) SubstreamBytes() (sent, received map[int]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sent = make(map[int]int64, len(c.sent))
+	for id, n := range c.sent {
+		sent[id] = n
+	}
+	received = make(map[int]int64, len(c.received))
+	for id, n := range c.received {
+		received[id] = n
+	}
+	return sent, received
+}
+
+// quicMetrics holds a connection's latest congestion figures, as traced by
+// quic-go
+type quicMetrics struct {
+	mu     sync.Mutex
+	cwnd   int
+	rtt    time.Duration
+	rttVar time.Duration
+	lost   int
+	mtu    int
+}
+
+type quicMetricsKey struct{}
+
+// traceMetrics records the metrics of connections whose context carries a
+// quicMetrics
+func traceMetrics(ctx context.Context, _ logging.Perspective, _ logging.ConnectionID) *logging.ConnectionTracer {
+	m, ok := ctx.Value(quicMetricsKey{}).(*quicMetrics)
+	if !ok {
+		return nil
+	}
+	return &logging.ConnectionTracer{
+		UpdatedMetrics: func(rtt *logging.RTTStats, cwnd, _ logging.ByteCount, _ int) {
+			m.mu.Lock()
+			m.cwnd = int(cwnd)
+			m.rtt = rtt.SmoothedRTT()
+			m.rttVar = rtt.MeanDeviation()
+			m.mu.Unlock()
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			m.mu.Lock()
+			m.lost++
+			m.mu.Unlock()
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, _ bool) {
+			m.mu.Lock()
+			m.mtu = int(mtu)
+			m.mu.Unlock()
+		},
+	}
+}
@@ -0,0 +1,316 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// SCTP carries tests over SCTP: the control connection and each data
+// stream are SCTP associations. A data stream can spread its data over
+// several SCTP streams of its association, as with iperf3's --nstreams.
+//
+// Associations are multi-homed when either end has several addresses: the
+// local ones are the bind host plus ListenOptions.XBind or DialOptions.XBind,
+// and the remote ones are given as "host1/host2:port".
+type SCTP struct{}
+
+func (SCTP) Name() string { return "sctp" }
+
+func (SCTP) Datagram() bool { return false }
+
+func (SCTP) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	laddr, err := resolveSCTPAddr(append(splitHosts(host), opts.XBind...), port)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accept as many inbound streams as clients ask for
+	config := sctp.SocketConfig{
+		Control: opts.Control,
+		InitMsg: sctp.InitMsg{MaxInstreams: sctp.SCTP_MAX_STREAM},
+	}
+	ln, err := config.Listen("sctp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on SCTP %s: %w", addr, err)
+	}
+	return &sctpListener{ln}, nil
+}
+
+func (t SCTP) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	opts.Streams = 1
+	return t.dial(ctx, addr, opts)
+}
+
+func (t SCTP) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return t.dial(ctx, addr, opts)
+}
+
+func (SCTP) SetOptions(conn net.Conn, opts SocketOptions) error {
+	if err := setBuffers(conn, opts.Window); err != nil {
+		return err
+	}
+
+	c, ok := conn.(*sctpConn)
+	if !ok {
+		return nil
+	}
+	if opts.NoDelay {
+		on := int32(1)
+		if _, _, err := c.Setsockopt(sctp.SCTP_NODELAY, uintptr(unsafe.Pointer(&on)), unsafe.Sizeof(on)); err != nil {
+			return fmt.Errorf("failed to set SCTP_NODELAY: %w", err)
+		}
+	}
+	if opts.MSS > 0 {
+		// struct sctp_assoc_value, for the association of the socket
+		value := struct {
+			AssocID int32
+			Value   uint32
+		}{Value: uint32(opts.MSS)}
+		if _, _, err := c.Setsockopt(sctp.SCTP_MAXSEG, uintptr(unsafe.Pointer(&value)), unsafe.Sizeof(value)); err != nil {
+			return fmt.Errorf("failed to set SCTP_MAXSEG: %w", err)
+		}
+	}
+	return nil
+}
+
+// Stats reports the association's primary path as seen by SCTP_STATUS
+func (SCTP) Stats(conn net.Conn) (*Stats, error) {
+	c, ok := conn.(*sctpConn)
+	if !ok {
+		return nil, ErrNoStats
+	}
+	status, err := c.status()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	stats.SndCwnd = int(status.Cwnd)
+	stats.RTT = int(status.SRTT) * 1000 // milliseconds to microseconds
+	stats.PMTU = int(status.MTU)
+	if status.Primary != nil {
+		stats.Path = status.Primary.String()
+	}
+	return stats, nil
+}
+
+// dial opens an association to addr with opts.Streams outbound streams
+func (SCTP) dial(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	if opts.Dial != nil {
+		return opts.Dial(ctx, "sctp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	raddr, err := resolveSCTPAddr(splitHosts(host), port)
+	if err != nil {
+		return nil, err
+	}
+
+	var laddr *sctp.SCTPAddr
+	if local := append(splitHosts(opts.Bind), opts.XBind...); len(local) > 0 {
+		if laddr, err = resolveSCTPAddr(local, "0"); err != nil {
+			return nil, err
+		}
+	}
+
+	config := sctp.SocketConfig{
+		Control: opts.Control,
+		InitMsg: sctp.InitMsg{NumOstreams: uint16(opts.Streams)},
+	}
+	conn, err := config.Dial("sctp", laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server may grant fewer streams than we asked for
+	c := newSCTPConn(conn, max(opts.Streams, 1))
+	if status, err := c.status(); err == nil && int(status.OutStreams) < c.streams {
+		c.streams = max(int(status.OutStreams), 1)
+	}
+	return c, nil
+}
+
+// splitHosts splits a "host1/host2" list of an association's addresses
+func splitHosts(hosts string) []string {
+	if hosts == "" {
+		return nil
+	}
+	return strings.Split(hosts, "/")
+}
+
+// resolveSCTPAddr resolves the addresses of one end of an association; no
+// hosts means all local addresses
+func resolveSCTPAddr(hosts []string, port string) (*sctp.SCTPAddr, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+
+	addr := &sctp.SCTPAddr{Port: p}
+	for _, host := range hosts {
+		ip, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SCTP address %s: %w", host, err)
+		}
+		addr.IPAddrs = append(addr.IPAddrs, *ip)
+	}
+	return addr, nil
+}
+
+// sctpListener accepts associations as sctpConns
+type sctpListener struct {
+	*sctp.SCTPListener
+}
+
+func (l *sctpListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptSCTP()
+	if err != nil {
+		return nil, err
+	}
+	return newSCTPConn(conn, 1), nil
+}
+
+// sctpConn is an association that spreads its writes round-robin over its
+// first streams outbound SCTP streams and counts the bytes carried by each
+// stream in both directions
+type sctpConn struct {
+	*sctp.SCTPConn
+	streams int
+	next    int
+
+	mu       sync.Mutex
+	sent     map[int]int64
+	received map[int]int64
+}
+
+func newSCTPConn(conn *sctp.SCTPConn, streams int) *sctpConn {
+	// Have reads say which stream the data came in on
+	conn.SubscribeEvents(sctp.SCTP_EVENT_DATA_IO)
+	return &sctpConn{
+		SCTPConn: conn,
+		streams:  streams,
+		sent:     make(map[int]int64),
+		received: make(map[int]int64),
+	}
+}
+
+func (c *sctpConn) Write(b []byte) (int, error) {
+	stream := c.next
+	c.next = (c.next + 1) % c.streams
+
+	n, err := c.SCTPWrite(b, &sctp.SndRcvInfo{Stream: uint16(stream)})
+	if n > 0 {
+		c.mu.Lock()
+		c.sent[stream] += int64(n)
+		c.mu.Unlock()
+	}
+	return max(n, 0), err
+}
+
+func (c *sctpConn) Read(b []byte) (int, error) {
+	n, info, err := c.SCTPRead(b)
+	if n > 0 {
+		stream := 0
+		if info != nil {
+			stream = int(info.Stream)
+		}
+		c.mu.Lock()
+		c.received[stream] += int64(n)
+		c.mu.Unlock()
+	}
+	return max(n, 0), err
+}
+
+func (c *sctpConn) SubstreamBytes() (sent, received map[int]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sent = make(map[int]int64, len(c.sent))
+	for id, n := range c.sent {
+		sent[id] = n
+	}
+	received = make(map[int]int64, len(c.received))
+	for id, n := range c.received {
+		received[id] = n
+	}
+	return sent, received
+}
+
+// sctpStatus holds the fields of struct sctp_status that we report
+type sctpStatus struct {
+	InStreams  uint16
+	OutStreams uint16
+	// The primary path's address, congestion window in bytes, smoothed
+	// RTT in milliseconds and MTU
+	Primary *net.IPAddr
+	Cwnd    uint32
+	SRTT    uint32
+	MTU     uint32
+}
+
+// sctpStatusSize is the size of struct sctp_status: 24 bytes of association
+// status followed by the packed struct sctp_paddrinfo of the primary path,
+// whose address is a 128-byte sockaddr_storage
+const sctpStatusSize = 24 + 4 + 128 + 5*4
+
+// status reads the association's SCTP_STATUS
+func (c *sctpConn) status() (*sctpStatus, error) {
+	buf := make([]byte, sctpStatusSize)
+	size := uint32(len(buf))
+	if _, _, err := c.Getsockopt(sctp.SCTP_STATUS, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); err != nil {
+		return nil, fmt.Errorf("failed to read SCTP status: %w", err)
+	}
+	return parseSCTPStatus(buf)
+}
+
+// parseSCTPStatus decodes a struct sctp_status
+func parseSCTPStatus(b []byte) (*sctpStatus, error) {
+	if len(b) < sctpStatusSize {
+		return nil, fmt.Errorf("short SCTP status: %d bytes", len(b))
+	}
+
+	ne := binary.NativeEndian
+	status := &sctpStatus{
+		InStreams:  ne.Uint16(b[16:18]),
+		OutStreams: ne.Uint16(b[18:20]),
+	}
+
+	paddr := b[24:]
+	status.Primary = parseSockaddr(paddr[4:132])
+	status.Cwnd = ne.Uint32(paddr[136:140])
+	status.SRTT = ne.Uint32(paddr[140:144])
+	status.MTU = ne.Uint32(paddr[148:152])
+	return status, nil
+}
+
+// parseSockaddr decodes the address of a sockaddr_in or sockaddr_in6
+func parseSockaddr(b []byte) *net.IPAddr {
+	switch binary.NativeEndian.Uint16(b[0:2]) {
+	case afInet:
+		return &net.IPAddr{IP: net.IP(append([]byte(nil), b[4:8]...))}
+	case afInet6:
+		return &net.IPAddr{IP: net.IP(append([]byte(nil), b[8:24]...))}
+	}
+	return nil
+}
+
+// Address families as found in Linux sockaddrs
+const (
+	afInet  = 2
+	afInet6 = 10
+)
@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"iperf3-go/internal/sysstat"
+)
+
+// TCP carries tests over TCP: the control connection and each data stream
+// are TCP connections. Data streams may use Multipath TCP instead, see
+// DialOptions.MPTCP.
+type TCP struct{}
+
+func (TCP) Name() string { return "tcp" }
+
+func (TCP) Datagram() bool { return false }
+
+func (TCP) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	lc := net.ListenConfig{Control: opts.Control}
+	lc.SetMultipathTCP(opts.MPTCP)
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return ln, nil
+}
+
+func (TCP) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	opts.MPTCP = false
+	return dial(ctx, "tcp", addr, opts)
+}
+
+func (TCP) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return dial(ctx, "tcp", addr, opts)
+}
+
+func (TCP) SetOptions(conn net.Conn, opts SocketOptions) error {
+	if err := setBuffers(conn, opts.Window); err != nil {
+		return err
+	}
+
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	// Go disables Nagle's algorithm on every TCP connection; iperf3 only
+	// does with -N
+	if err := c.SetNoDelay(opts.NoDelay); err != nil {
+		return fmt.Errorf("failed to set TCP_NODELAY: %w", err)
+	}
+	if opts.MSS > 0 {
+		if err := setMaxSeg(c, opts.MSS); err != nil {
+			return fmt.Errorf("failed to set TCP_MAXSEG: %w", err)
+		}
+	}
+	return nil
+}
+
+func (TCP) Stats(conn net.Conn) (*Stats, error) {
+	return tcpStats(conn)
+}
+
+// tcpStats reads TCP_INFO and the congestion control algorithm of conn
+func tcpStats(conn net.Conn) (*Stats, error) {
+	info, err := sysstat.GetTCPInfo(conn)
+	if errors.Is(err, sysstat.ErrUnsupported) {
+		return nil, ErrNoStats
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{TCPInfo: *info}
+	stats.Congestion, _ = sysstat.TCPCongestion(conn)
+	return stats, nil
+}
+
+// UsingMPTCP reports whether conn is a TCP connection that runs Multipath
+// TCP rather than having fallen back to plain TCP
+func UsingMPTCP(conn net.Conn) bool {
+	tc, ok := Unwrap(conn).(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	used, err := tc.MultipathTCP()
+	return err == nil && used
+}
+
+// dial connects to addr over a network known to net.Dialer
+func dial(ctx context.Context, network, addr string, opts DialOptions) (net.Conn, error) {
+	if opts.Dial != nil {
+		return opts.Dial(ctx, network, addr)
+	}
+
+	dialer := net.Dialer{Control: opts.Control}
+	dialer.SetMultipathTCP(opts.MPTCP)
+	if opts.KeepAlive.Enable {
+		dialer.KeepAliveConfig = opts.KeepAlive
+	}
+	if local := bindAddr(opts.Bind); local != "" {
+		var err error
+		switch network {
+		case "udp":
+			dialer.LocalAddr, err = net.ResolveUDPAddr(network, local)
+		default:
+			dialer.LocalAddr, err = net.ResolveTCPAddr(network, local)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve bind address %s: %w", opts.Bind, err)
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// setMaxSeg sets the maximum segment size of a TCP connection
+func setMaxSeg(conn *net.TCPConn, mss int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package transport
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMaxSeg sets the maximum segment size of a TCP connection
+func setMaxSeg(conn *net.TCPConn, mss int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// WithTLS returns t with its control connections and data streams wrapped
+// in TLS, to measure the cost of encryption next to the plain transport.
+// config is the server's configuration for Listen, and the client's for
+// DialControl and OpenStream. A server configuration without certificates
+// presents a throwaway self-signed one.
+//
+// TLS needs an ordered byte stream, so t must be a stream transport whose
+// data streams have a single substream.
+func WithTLS(t Transport, config *tls.Config) Transport {
+	return &tlsTransport{Transport: t, config: config}
+}
+
+// tlsTransport wraps the connections of a stream transport in TLS
+type tlsTransport struct {
+	Transport
+	config *tls.Config
+}
+
+func (t *tlsTransport) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	ln, err := t.Transport.Listen(ctx, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsLn, err := NewTLSListener(ln, t.config)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tlsLn, nil
+}
+
+func (t *tlsTransport) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	conn, err := t.Transport.DialControl(ctx, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.client(ctx, conn, addr)
+}
+
+func (t *tlsTransport) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	conn, err := t.Transport.OpenStream(ctx, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.client(ctx, conn, addr)
+}
+
+func (t *tlsTransport) SetOptions(conn net.Conn, opts SocketOptions) error {
+	return t.Transport.SetOptions(Unwrap(conn), opts)
+}
+
+func (t *tlsTransport) Stats(conn net.Conn) (*Stats, error) {
+	return t.Transport.Stats(Unwrap(conn))
+}
+
+// client runs the client side of the TLS handshake on conn, a connection
+// to addr
+func (t *tlsTransport) client(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	config := t.config
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	c := &tlsConn{Conn: tls.Client(conn, config)}
+	if err := c.handshake(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return c, nil
+}
+
+// NewTLSListener returns a listener that runs the server side of TLS on the
+// connections ln accepts. A configuration without certificates presents a
+// throwaway self-signed one.
+func NewTLSListener(ln net.Listener, config *tls.Config) (net.Listener, error) {
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &tlsListener{Listener: ln, config: config}, nil
+}
+
+// tlsListener runs the server side of TLS on accepted connections. The
+// handshake is left to Handshake, so a slow client does not hold up others.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{Conn: tls.Server(conn, l.config)}, nil
+}
+
+// tlsConn is a TLS connection that knows how long its handshake took
+type tlsConn struct {
+	*tls.Conn
+	handshakeTime time.Duration
+}
+
+// handshake runs the TLS handshake, timing it
+func (c *tlsConn) handshake(ctx context.Context) error {
+	start := time.Now()
+	if err := c.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.handshakeTime = time.Since(start)
+	return nil
+}
+
+// Handshake completes the TLS handshake of a connection accepted over TLS,
+// so that TLSInfo can report it; it does nothing for other connections
+func Handshake(ctx context.Context, conn net.Conn) error {
+	c, ok := conn.(*tlsConn)
+	if !ok || c.handshakeTime > 0 {
+		return nil
+	}
+	if err := c.handshake(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return nil
+}
+
+// TLSInfo describes the TLS session of conn, or returns nil if conn does
+// not run over TLS
+func TLSInfo(conn net.Conn) *protocol.TLSInfo {
+	c, ok := conn.(*tlsConn)
+	if !ok {
+		return nil
+	}
+	state := c.ConnectionState()
+	return &protocol.TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		HandshakeMS: float64(c.handshakeTime) / float64(time.Millisecond),
+	}
+}
+
+// Unwrap returns the connection TLS runs over, for socket-level calls; other
+// connections are returned as they are
+func Unwrap(conn net.Conn) net.Conn {
+	if c, ok := conn.(*tlsConn); ok {
+		return c.NetConn()
+	}
+	return conn
+}
+
+// selfSignedCertificate creates a throwaway certificate for a server
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "iperf3-go"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,189 @@
+// Package transport carries tests over the supported protocols. Each
+// transport provides the control connection for the framed protocol messages
+// and the data streams the test is measured on, and is registered by name so
+// the client and the server can pick one from the test configuration.
+// Additional transports can be plugged in with Register.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+
+	"iperf3-go/internal/sysstat"
+)
+
+// Transport carries a test over one protocol
+type Transport interface {
+	// Name is the protocol name used in the test configuration
+	Name() string
+	// Datagram reports whether data streams carry individual datagrams,
+	// which are paced and measured for jitter and loss as in UDP tests
+	Datagram() bool
+	// Listen opens the server side at addr. The listener accepts control
+	// connections and data streams alike.
+	Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error)
+	// DialControl opens the client's control connection to the server at addr
+	DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error)
+	// OpenStream opens a data stream to the server at addr
+	OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error)
+	// SetOptions applies per-socket options to a data stream
+	SetOptions(conn net.Conn, opts SocketOptions) error
+	// Stats reads the kernel's statistics for a data stream, or returns
+	// ErrNoStats if the transport has none
+	Stats(conn net.Conn) (*Stats, error)
+}
+
+// ListenOptions configures the server side of a transport
+type ListenOptions struct {
+	// Control, if set, is called on listening sockets before they are bound
+	Control func(network, address string, c syscall.RawConn) error
+	// XBind lists further local hosts to listen on, for multi-homed
+	// transports, as with iperf3's -X
+	XBind []string
+	// MPTCP accepts Multipath TCP connections on TCP listeners, as with
+	// iperf3's -m; plain TCP connections are still accepted
+	MPTCP bool
+	// Filter, if set, is asked about the sender of every datagram a
+	// datagram transport receives, and datagrams from senders it rejects
+	// are dropped. Connections are left for the caller to check.
+	Filter func(remote net.Addr) bool
+}
+
+// DialOptions configures the client side of a transport
+type DialOptions struct {
+	// Bind is the local host to connect from, as with iperf3's -B
+	Bind string
+	// XBind lists further local hosts to connect from, for multi-homed
+	// transports, as with iperf3's -X
+	XBind []string
+	// Control, if set, is called on sockets before they connect
+	Control func(network, address string, c syscall.RawConn) error
+	// Dial, if set, opens connections instead of the transport's own
+	// dialer; network is "tcp", "udp", "sctp", "unix" or "unixpacket". QUIC
+	// manages its own UDP sockets and cannot use it.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Streams is the number of substreams a data stream spreads its data
+	// over, for transports that have them; zero means the default
+	Streams int
+	// MPTCP opens TCP data streams with Multipath TCP, as with iperf3's -m.
+	// The kernel falls back to TCP if either end lacks MPTCP.
+	MPTCP bool
+	// KeepAlive, if enabled, tunes TCP keepalive on the built-in dialers'
+	// TCP connections, as with iperf3's --cntl-ka
+	KeepAlive net.KeepAliveConfig
+}
+
+// SocketOptions are the per-socket settings of a data stream
+type SocketOptions struct {
+	// Window is the socket buffer size in bytes; zero keeps the default
+	Window int
+	// NoDelay disables Nagle's algorithm, as with iperf3's -N
+	NoDelay bool
+	// MSS is the maximum segment size in bytes, as with iperf3's -M; zero
+	// keeps the default
+	MSS int
+}
+
+// Stats holds a data stream's kernel statistics
+type Stats struct {
+	sysstat.TCPInfo
+	// Congestion is the congestion control algorithm, if any
+	Congestion string
+	// Path is the remote address of the path data is currently sent on,
+	// for multi-homed transports
+	Path string
+}
+
+// Substreams is implemented by data streams that spread their data over
+// several substreams, such as the SCTP streams of an association
+type Substreams interface {
+	// SubstreamBytes returns the bytes sent and received so far, keyed by
+	// substream ID
+	SubstreamBytes() (sent, received map[int]int64)
+}
+
+// ErrNoStats is returned by Stats for streams without kernel statistics
+var ErrNoStats = errors.New("no socket statistics for this transport")
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"tcp":        TCP{},
+		"udp":        UDP{},
+		"sctp":       SCTP{},
+		"unix":       Unix{},
+		"unixpacket": Unix{SeqPacket: true},
+		"quic":       QUIC{},
+	}
+)
+
+// Register makes a transport available by its name, replacing any existing
+// transport of the same name
+func Register(t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[t.Name()] = t
+}
+
+// Lookup returns the named transport; an empty name means TCP
+func Lookup(name string) (Transport, error) {
+	if name == "" {
+		name = "tcp"
+	}
+
+	transportsMu.RLock()
+	t, ok := transports[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol: %s", name)
+	}
+	return t, nil
+}
+
+// Names returns the names of the registered transports
+func Names() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setBuffers sets a socket's send and receive buffers to window bytes
+func setBuffers(conn net.Conn, window int) error {
+	if window <= 0 {
+		return nil
+	}
+
+	bc, ok := conn.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		return nil
+	}
+	if err := bc.SetReadBuffer(window); err != nil {
+		return fmt.Errorf("failed to set receive buffer: %w", err)
+	}
+	if err := bc.SetWriteBuffer(window); err != nil {
+		return fmt.Errorf("failed to set send buffer: %w", err)
+	}
+	return nil
+}
+
+// bindAddr returns the local address to dial from, or "" for any
+func bindAddr(bind string) string {
+	if bind == "" {
+		return ""
+	}
+	return net.JoinHostPort(bind, "0")
+}
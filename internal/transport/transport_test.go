@@ -0,0 +1,381 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"tcp", "udp", "sctp"} {
+		tr, err := Lookup(name)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", name, err)
+		}
+		if tr.Name() != name {
+			t.Errorf("Lookup(%q) returned %s", name, tr.Name())
+		}
+	}
+
+	if tr, err := Lookup(""); err != nil || tr.Name() != "tcp" {
+		t.Errorf("Expected TCP by default, got %v, %v", tr, err)
+	}
+	if _, err := Lookup("no-such-protocol"); err == nil {
+		t.Error("Expected error for unknown protocol")
+	}
+
+	names := Names()
+	if len(names) < 3 || names[0] != "quic" {
+		t.Errorf("Expected sorted transport names, got %v", names)
+	}
+}
+
+func TestMPTCP(t *testing.T) {
+	ctx := context.Background()
+	ln, err := TCP{}.Listen(ctx, "127.0.0.1:0", ListenOptions{MPTCP: true})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	// The control connection stays plain TCP
+	ctrl, err := TCP{}.DialControl(ctx, addr, DialOptions{MPTCP: true})
+	if err != nil {
+		t.Fatalf("DialControl failed: %v", err)
+	}
+	defer ctrl.Close()
+	if UsingMPTCP(ctrl) {
+		t.Error("Expected a plain TCP control connection")
+	}
+	if conn, err := ln.Accept(); err == nil {
+		conn.Close()
+	}
+
+	conn, err := TCP{}.OpenStream(ctx, addr, DialOptions{MPTCP: true})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+
+	if !UsingMPTCP(conn) {
+		t.Skip("MPTCP is not available on this host")
+	}
+	if !UsingMPTCP(accepted) {
+		t.Error("Expected the server end to use MPTCP")
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	ctx := context.Background()
+	ln, err := TCP{}.Listen(ctx, "127.0.0.1:0", ListenOptions{})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	conn, err := TCP{}.OpenStream(ctx, ln.Addr().String(), DialOptions{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer conn.Close()
+	if err := (TCP{}).SetOptions(conn, SocketOptions{NoDelay: true, MSS: 1200}); err != nil {
+		t.Errorf("SetOptions failed: %v", err)
+	}
+	if err := (TCP{}).SetOptions(conn, SocketOptions{}); err != nil {
+		t.Errorf("SetOptions with the defaults failed: %v", err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	for _, tr := range []Unix{{}, {SeqPacket: true}} {
+		t.Run(tr.Name(), func(t *testing.T) {
+			ctx := context.Background()
+			addr := net.JoinHostPort(filepath.Join(t.TempDir(), "iperf3.sock"), "5201")
+			ln, err := tr.Listen(ctx, addr, ListenOptions{})
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			defer ln.Close()
+
+			conn, err := tr.OpenStream(ctx, addr, DialOptions{})
+			if err != nil {
+				t.Fatalf("OpenStream failed: %v", err)
+			}
+			defer conn.Close()
+			accepted, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+			defer accepted.Close()
+
+			// Messages are read a few bytes at a time, which must not lose
+			// the rest of a seqpacket record
+			msg := &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: []byte(`{"id":1}`)}
+			if err := protocol.WriteMessage(conn, msg); err != nil {
+				t.Fatalf("WriteMessage failed: %v", err)
+			}
+			got, err := protocol.ReadMessage(accepted)
+			if err != nil {
+				t.Fatalf("ReadMessage failed: %v", err)
+			}
+			if got.Type != msg.Type || string(got.Data) != string(msg.Data) {
+				t.Errorf("Expected %+v, got %+v", msg, got)
+			}
+
+			if err := tr.SetOptions(conn, SocketOptions{Window: 256 * 1024}); err != nil {
+				t.Errorf("SetOptions failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	ctx := context.Background()
+	ln, err := UDP{}.Listen(ctx, "127.0.0.1:0", ListenOptions{})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	// The control connection is TCP
+	ctrl, err := UDP{}.DialControl(ctx, addr, DialOptions{})
+	if err != nil {
+		t.Fatalf("DialControl failed: %v", err)
+	}
+	defer ctrl.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if _, ok := accepted.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("Expected a TCP control connection, got %T", accepted.RemoteAddr())
+	}
+	accepted.Close()
+
+	// A UDP flow is accepted once it sends a stream start message, and
+	// messages can be exchanged in both directions
+	st, err := UDP{}.OpenStream(ctx, addr, DialOptions{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer st.Close()
+	if _, err := st.Write([]byte("not a stream start")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	start := &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: []byte(`{"id":1}`)}
+	if err := protocol.WriteMessage(st, start); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+	msg, err := protocol.ReadMessage(server)
+	if err != nil || msg.Type != protocol.MessageTypeStreamStart || string(msg.Data) != `{"id":1}` {
+		t.Fatalf("Expected the stream start message, got %+v, %v", msg, err)
+	}
+
+	ack := &protocol.Message{Type: protocol.MessageTypeStreamStartAck}
+	if err := protocol.WriteMessage(server, ack); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	if msg, err := protocol.ReadMessage(st); err != nil || msg.Type != protocol.MessageTypeStreamStartAck {
+		t.Fatalf("Expected the ack, got %+v, %v", msg, err)
+	}
+
+	// Afterwards each read returns one datagram
+	st.Write([]byte("datagram"))
+	buf := make([]byte, 64)
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "datagram" {
+		t.Errorf("Expected one datagram, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestParseSCTPStatus(t *testing.T) {
+	b := make([]byte, sctpStatusSize)
+	ne := binary.NativeEndian
+	ne.PutUint16(b[16:18], 10) // inbound streams
+	ne.PutUint16(b[18:20], 4)  // outbound streams
+
+	// Primary path: an IPv4 sockaddr_in followed by its state and figures
+	paddr := b[24:]
+	ne.PutUint16(paddr[4:6], afInet)
+	copy(paddr[8:12], net.IPv4(192, 0, 2, 7).To4())
+	ne.PutUint32(paddr[136:140], 43800) // cwnd
+	ne.PutUint32(paddr[140:144], 12)    // srtt
+	ne.PutUint32(paddr[148:152], 1500)  // mtu
+
+	status, err := parseSCTPStatus(b)
+	if err != nil {
+		t.Fatalf("parseSCTPStatus failed: %v", err)
+	}
+	if status.InStreams != 10 || status.OutStreams != 4 {
+		t.Errorf("Unexpected streams: %d in, %d out", status.InStreams, status.OutStreams)
+	}
+	if status.Primary == nil || status.Primary.String() != "192.0.2.7" {
+		t.Errorf("Unexpected primary path: %v", status.Primary)
+	}
+	if status.Cwnd != 43800 || status.SRTT != 12 || status.MTU != 1500 {
+		t.Errorf("Unexpected path figures: %+v", status)
+	}
+
+	if _, err := parseSCTPStatus(b[:100]); err == nil {
+		t.Error("Expected error for a short status")
+	}
+}
+
+func TestResolveSCTPAddr(t *testing.T) {
+	addr, err := resolveSCTPAddr(splitHosts("192.0.2.1/2001:db8::1"), "5201")
+	if err != nil {
+		t.Fatalf("resolveSCTPAddr failed: %v", err)
+	}
+	if len(addr.IPAddrs) != 2 || addr.Port != 5201 {
+		t.Fatalf("Unexpected address: %v", addr)
+	}
+	if addr.IPAddrs[0].String() != "192.0.2.1" || addr.IPAddrs[1].String() != "2001:db8::1" {
+		t.Errorf("Unexpected addresses: %v", addr.IPAddrs)
+	}
+
+	// No hosts is the wildcard address
+	if addr, err := resolveSCTPAddr(splitHosts(""), "0"); err != nil || len(addr.IPAddrs) != 0 {
+		t.Errorf("Expected wildcard address, got %v, %v", addr, err)
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	ctx := context.Background()
+	ln, err := QUIC{}.Listen(ctx, "127.0.0.1:0", ListenOptions{})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	conn, err := QUIC{}.OpenStream(ctx, addr, DialOptions{Streams: 3})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+
+	msg := &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: []byte(`{"id":1}`)}
+	if err := protocol.WriteMessage(conn, msg); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	got, err := protocol.ReadMessage(accepted)
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if got.Type != msg.Type || string(got.Data) != string(msg.Data) {
+		t.Errorf("Expected %+v, got %+v", msg, got)
+	}
+
+	// Further writes go round-robin over the QUIC streams, and the server
+	// reads everything until the client ends them all
+	block := make([]byte, 1000)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(block); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite failed: %v", err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(io.Discard, accepted)
+	if err != nil || n != 5000 {
+		t.Errorf("Expected 5000 bytes, got %d, %v", n, err)
+	}
+
+	sent, _ := conn.(Substreams).SubstreamBytes()
+	_, received := accepted.(Substreams).SubstreamBytes()
+	wantSent := map[int]int64{0: int64(8+len(msg.Data)) + 1000, 1: 2000, 2: 2000}
+	for id, want := range wantSent {
+		if sent[id] != want || received[id] != want {
+			t.Errorf("Substream %d: expected %d bytes, sent %d, received %d", id, want, sent[id], received[id])
+		}
+	}
+
+	if _, err := (QUIC{}).Stats(conn); err != nil {
+		t.Errorf("Stats failed: %v", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ctx := context.Background()
+	server := WithTLS(TCP{}, &tls.Config{})
+	ln, err := server.Listen(ctx, "127.0.0.1:0", ListenOptions{})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		if err := Handshake(ctx, conn); err != nil {
+			t.Errorf("server Handshake failed: %v", err)
+		}
+		accepted <- conn
+	}()
+
+	client := WithTLS(TCP{}, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	conn, err := client.OpenStream(ctx, ln.Addr().String(), DialOptions{})
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	defer conn.Close()
+	sconn := <-accepted
+	if sconn == nil {
+		t.Fatal("Accept failed")
+	}
+	defer sconn.Close()
+
+	for _, c := range []net.Conn{conn, sconn} {
+		info := TLSInfo(c)
+		if info == nil || info.Version != "TLS 1.2" || info.CipherSuite == "" || info.HandshakeMS <= 0 {
+			t.Errorf("unexpected TLS info %+v", info)
+		}
+		if _, ok := Unwrap(c).(*net.TCPConn); !ok {
+			t.Errorf("Expected TLS over a TCP connection, got %T", Unwrap(c))
+		}
+	}
+	if TLSInfo(Unwrap(conn)) != nil {
+		t.Error("Expected no TLS info for a plain connection")
+	}
+
+	msg := &protocol.Message{Type: protocol.MessageTypeStreamStart, Data: []byte(`{"id":1}`)}
+	if err := protocol.WriteMessage(conn, msg); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	if got, err := protocol.ReadMessage(sconn); err != nil || string(got.Data) != string(msg.Data) {
+		t.Errorf("Expected %+v, got %+v, %v", msg, got, err)
+	}
+	if err := client.SetOptions(conn, SocketOptions{Window: 256 * 1024}); err != nil {
+		t.Errorf("SetOptions failed: %v", err)
+	}
+}
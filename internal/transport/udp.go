@@ -0,0 +1,330 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"iperf3-go/internal/protocol"
+)
+
+// UDP carries tests over UDP. As in iperf3 the control connection is TCP;
+// each data stream is a UDP flow from its own client port, which the server
+// tells apart by the peer address.
+type UDP struct{}
+
+// maxDatagram is the largest UDP payload
+const maxDatagram = 65535
+
+// udpQueueLen is the number of datagrams buffered per stream on the server
+// before further ones are dropped
+const udpQueueLen = 1024
+
+func (UDP) Name() string { return "udp" }
+
+func (UDP) Datagram() bool { return true }
+
+// Listen listens for control connections on TCP and for data streams on UDP,
+// both on addr. A UDP flow is accepted as a stream when its first datagram
+// is a MessageTypeStreamStart message.
+func (UDP) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	lc := net.ListenConfig{Control: opts.Control}
+	tcp, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	// Use the TCP port for UDP too, in case addr asked for any port
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	udpAddr := net.JoinHostPort(host, strconv.Itoa(tcp.Addr().(*net.TCPAddr).Port))
+	pc, err := lc.ListenPacket(ctx, "udp", udpAddr)
+	if err != nil {
+		tcp.Close()
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", udpAddr, err)
+	}
+
+	l := &udpListener{
+		tcp:      tcp,
+		udp:      pc.(*net.UDPConn),
+		filter:   opts.Filter,
+		accepted: make(chan acceptResult, 16),
+		done:     make(chan struct{}),
+		peers:    make(map[string]*udpStream),
+	}
+	go l.acceptTCP()
+	go l.readUDP()
+	return l, nil
+}
+
+func (UDP) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return dial(ctx, "tcp", addr, opts)
+}
+
+func (UDP) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	conn, err := dial(ctx, "udp", addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{Conn: conn, buf: make([]byte, maxDatagram)}, nil
+}
+
+func (UDP) SetOptions(conn net.Conn, opts SocketOptions) error {
+	if dc, ok := conn.(*datagramConn); ok {
+		conn = dc.Conn
+	}
+	return setBuffers(conn, opts.Window)
+}
+
+func (UDP) Stats(conn net.Conn) (*Stats, error) {
+	return nil, ErrNoStats
+}
+
+// datagramConn lets a client's UDP socket, or a SOCK_SEQPACKET socket, be
+// read like a stream, so that protocol messages can be read from a datagram
+// a few bytes at a time
+type datagramConn struct {
+	net.Conn
+	buf     []byte
+	pending []byte
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.buf[:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// CloseWrite shuts down the writing side of sockets that have one
+func (c *datagramConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SyscallConn exposes the socket for reading its options
+func (c *datagramConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return sc.SyscallConn()
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// udpListener accepts TCP control connections and UDP data streams
+type udpListener struct {
+	tcp       net.Listener
+	udp       *net.UDPConn
+	filter    func(net.Addr) bool
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	peers map[string]*udpStream
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.tcp.Close()
+		l.udp.Close()
+
+		l.mu.Lock()
+		peers := l.peers
+		l.peers = map[string]*udpStream{}
+		l.mu.Unlock()
+		for _, st := range peers {
+			st.Close()
+		}
+	})
+	return nil
+}
+
+func (l *udpListener) Addr() net.Addr { return l.tcp.Addr() }
+
+// acceptTCP passes on control connections
+func (l *udpListener) acceptTCP() {
+	for {
+		conn, err := l.tcp.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			l.Close()
+			return
+		}
+		select {
+		case l.accepted <- acceptResult{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// readUDP hands each datagram to the stream of its sender, accepting a new
+// stream for senders that open with a stream start message
+func (l *udpListener) readUDP() {
+	defer l.Close()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if l.filter != nil && !l.filter(addr) {
+			continue
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+
+		key := addr.String()
+		l.mu.Lock()
+		st, ok := l.peers[key]
+		if !ok {
+			if !isStreamStart(datagram) {
+				// Stray or late packets from a finished stream
+				l.mu.Unlock()
+				continue
+			}
+			st = &udpStream{
+				l:       l,
+				addr:    addr,
+				packets: make(chan []byte, udpQueueLen),
+				done:    make(chan struct{}),
+			}
+			l.peers[key] = st
+		}
+		l.mu.Unlock()
+
+		st.deliver(datagram)
+		if !ok {
+			select {
+			case l.accepted <- acceptResult{conn: st}:
+			case <-l.done:
+				return
+			}
+		}
+	}
+}
+
+// isStreamStart reports whether a datagram holds a stream start message
+func isStreamStart(b []byte) bool {
+	return len(b) >= 8 &&
+		int(binary.BigEndian.Uint32(b[0:4])) == len(b)-4 &&
+		binary.BigEndian.Uint32(b[4:8]) == protocol.MessageTypeStreamStart
+}
+
+// udpStream is the server's end of one UDP data stream. A read returns at
+// most one datagram; datagrams that arrive while the queue is full are
+// dropped, as a socket's would be when its receive buffer is full.
+type udpStream struct {
+	l         *udpListener
+	addr      *net.UDPAddr
+	packets   chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	pending []byte
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (st *udpStream) deliver(datagram []byte) {
+	select {
+	case st.packets <- datagram:
+	default:
+	}
+}
+
+func (st *udpStream) Read(b []byte) (int, error) {
+	if len(st.pending) == 0 {
+		st.mu.Lock()
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case st.pending = <-st.packets:
+		case <-st.done:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, st.pending)
+	st.pending = st.pending[n:]
+	return n, nil
+}
+
+func (st *udpStream) Write(b []byte) (int, error) {
+	return st.l.udp.WriteToUDP(b, st.addr)
+}
+
+func (st *udpStream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.done)
+		st.l.mu.Lock()
+		if st.l.peers[st.addr.String()] == st {
+			delete(st.l.peers, st.addr.String())
+		}
+		st.l.mu.Unlock()
+	})
+	return nil
+}
+
+func (st *udpStream) LocalAddr() net.Addr  { return st.l.udp.LocalAddr() }
+func (st *udpStream) RemoteAddr() net.Addr { return st.addr }
+
+// SetDeadline sets the read deadline; writes do not block. A new deadline
+// applies from the next read.
+func (st *udpStream) SetDeadline(t time.Time) error { return st.SetReadDeadline(t) }
+
+func (st *udpStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *udpStream) SetWriteDeadline(t time.Time) error { return nil }
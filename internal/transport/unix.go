@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Unix carries tests over Unix domain sockets, to measure host-local IPC
+// without the TCP/IP stack. The server listens on a socket path, given as
+// the host part of its address; the port is ignored. The control connection
+// and each data stream are connections to that path.
+type Unix struct {
+	// SeqPacket uses SOCK_SEQPACKET sockets, which keep write boundaries,
+	// rather than SOCK_STREAM ones
+	SeqPacket bool
+}
+
+// maxSeqPacket is the largest SOCK_SEQPACKET record read in full; the
+// kernel already caps records at the sender's socket buffer size
+const maxSeqPacket = 1 << 20
+
+func (t Unix) Name() string { return t.network() }
+
+func (Unix) Datagram() bool { return false }
+
+// network is the Go network name of the socket type
+func (t Unix) network() string {
+	if t.SeqPacket {
+		return "unixpacket"
+	}
+	return "unix"
+}
+
+func (t Unix) Listen(ctx context.Context, addr string, opts ListenOptions) (net.Listener, error) {
+	path, err := socketPath(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: opts.Control}
+	ln, err := lc.Listen(ctx, t.network(), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if t.SeqPacket {
+		return &seqPacketListener{ln}, nil
+	}
+	return ln, nil
+}
+
+func (t Unix) DialControl(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return t.dial(ctx, addr, opts)
+}
+
+func (t Unix) OpenStream(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	return t.dial(ctx, addr, opts)
+}
+
+func (Unix) SetOptions(conn net.Conn, opts SocketOptions) error {
+	if dc, ok := conn.(*datagramConn); ok {
+		conn = dc.Conn
+	}
+	return setBuffers(conn, opts.Window)
+}
+
+func (Unix) Stats(conn net.Conn) (*Stats, error) {
+	return nil, ErrNoStats
+}
+
+// dial connects to the socket path in addr
+func (t Unix) dial(ctx context.Context, addr string, opts DialOptions) (net.Conn, error) {
+	path, err := socketPath(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if opts.Dial != nil {
+		conn, err = opts.Dial(ctx, t.network(), path)
+	} else {
+		dialer := net.Dialer{Control: opts.Control}
+		conn, err = dialer.DialContext(ctx, t.network(), path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.SeqPacket {
+		return newSeqPacketConn(conn), nil
+	}
+	return conn, nil
+}
+
+// socketPath returns the socket path of a "path:port" address
+func socketPath(addr string) (string, error) {
+	path, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	if path == "" {
+		return "", fmt.Errorf("no socket path given")
+	}
+	return path, nil
+}
+
+// seqPacketListener accepts SOCK_SEQPACKET connections that can be read
+// like streams
+type seqPacketListener struct {
+	net.Listener
+}
+
+func (l *seqPacketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newSeqPacketConn(conn), nil
+}
+
+// newSeqPacketConn buffers each record of a SOCK_SEQPACKET connection, whose
+// remainder would otherwise be dropped by a short read
+func newSeqPacketConn(conn net.Conn) net.Conn {
+	return &datagramConn{Conn: conn, buf: make([]byte, maxSeqPacket)}
+}
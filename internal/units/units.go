@@ -0,0 +1,149 @@
+// Package units parses and formats quantities the way iperf3 does: sizes
+// use binary multiples (1K = 1024 bytes), rates use decimal multiples
+// (1M = 1,000,000 bits/sec).
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	kiloSize = 1024
+	kiloRate = 1000
+)
+
+// multiplier returns the power of the unit for a K/M/G/T suffix, or 0 for none
+func multiplier(suffix byte) (int, bool) {
+	switch suffix {
+	case 'k', 'K':
+		return 1, true
+	case 'm', 'M':
+		return 2, true
+	case 'g', 'G':
+		return 3, true
+	case 't', 'T':
+		return 4, true
+	}
+	return 0, false
+}
+
+// parse parses a number with an optional K/M/G/T suffix scaled by kilo
+func parse(s string, kilo float64) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty value")
+	}
+
+	power := 0
+	if p, ok := multiplier(s[len(s)-1]); ok {
+		power = p
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid number: %q", s)
+	}
+
+	value *= math.Pow(kilo, float64(power))
+	if value > math.MaxInt64 {
+		return 0, fmt.Errorf("value out of range: %q", s)
+	}
+	return int64(value), nil
+}
+
+// ParseSize parses a byte count such as "128K" or "1.5M", where the
+// suffixes are binary multiples (K = 1024)
+func ParseSize(s string) (int64, error) {
+	n, err := parse(s, kiloSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// ParseRate parses a rate in bits per second such as "100M" or "1G",
+// where the suffixes are decimal multiples (K = 1000)
+func ParseRate(s string) (int64, error) {
+	n, err := parse(s, kiloRate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// ParseRateBurst parses iperf3's "rate[/burst]" form of -b, where burst is
+// the number of packets sent back to back
+func ParseRateBurst(s string) (rate int64, burst int, err error) {
+	rateStr, burstStr, hasBurst := strings.Cut(s, "/")
+
+	rate, err = ParseRate(rateStr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return 0, 0, fmt.Errorf("invalid burst %q", burstStr)
+		}
+	}
+	return rate, burst, nil
+}
+
+// ValidFormat reports whether f is a valid -f report format: one of
+// k/m/g/t (bits), K/M/G/T (bytes), a (adaptive bits) or A (adaptive bytes)
+func ValidFormat(f byte) bool {
+	return strings.IndexByte("kmgtKMGTaA", f) >= 0
+}
+
+var (
+	byteLabels = []string{"Byte", "KByte", "MByte", "GByte", "TByte"}
+	bitLabels  = []string{"bit", "Kbit", "Mbit", "Gbit", "Tbit"}
+)
+
+// Format formats a byte quantity in the unit selected by format, like
+// iperf3's unit_snprintf. Lower-case formats convert to bits and scale by
+// 1000, upper-case formats stay in bytes and scale by 1024; 'a' and 'A'
+// pick the largest unit that keeps the value at or above 1. The label is
+// singular, callers append "s" or "s/sec".
+func Format(bytes float64, format byte) string {
+	if format == 0 {
+		format = 'a'
+	}
+
+	value := bytes
+	kilo := float64(kiloSize)
+	labels := byteLabels
+	if format >= 'a' && format <= 'z' {
+		value *= 8
+		kilo = kiloRate
+		labels = bitLabels
+	}
+
+	power := 0
+	switch format {
+	case 'a', 'A':
+		for value >= kilo && power < len(labels)-1 {
+			value /= kilo
+			power++
+		}
+	default:
+		if p, ok := multiplier(format); ok {
+			power = p
+		}
+		value /= math.Pow(kilo, float64(power))
+	}
+
+	switch {
+	case value < 9.995:
+		return fmt.Sprintf("%4.2f %s", value, labels[power])
+	case value < 99.95:
+		return fmt.Sprintf("%4.1f %s", value, labels[power])
+	default:
+		return fmt.Sprintf("%4.0f %s", value, labels[power])
+	}
+}
@@ -0,0 +1,78 @@
+package units
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"1470", 1470},
+		{"128K", 128 * 1024},
+		{"256k", 256 * 1024},
+		{"1.5M", 3 * 512 * 1024},
+		{"1G", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "K", "-1K", "12X"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) expected error", in)
+		}
+	}
+}
+
+func TestParseRateBurst(t *testing.T) {
+	tests := []struct {
+		in    string
+		rate  int64
+		burst int
+	}{
+		{"100M", 100000000, 0},
+		{"1g", 1000000000, 0},
+		{"2.5K", 2500, 0},
+		{"10M/20", 10000000, 20},
+	}
+
+	for _, tt := range tests {
+		rate, burst, err := ParseRateBurst(tt.in)
+		if err != nil || rate != tt.rate || burst != tt.burst {
+			t.Errorf("ParseRateBurst(%q) = %d, %d, %v; want %d, %d", tt.in, rate, burst, err, tt.rate, tt.burst)
+		}
+	}
+
+	for _, in := range []string{"10M/", "10M/0", "fast"} {
+		if _, _, err := ParseRateBurst(in); err == nil {
+			t.Errorf("ParseRateBurst(%q) expected error", in)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		bytes  float64
+		format byte
+		want   string
+	}{
+		{1.2 * (1 << 30), 'A', "1.20 GByte"},
+		{1206190000, 'a', "9.65 Gbit"},
+		{1250000, 'a', "10.0 Mbit"},
+		{125000, 'k', "1000 Kbit"},
+		{125000, 'm', "1.00 Mbit"},
+		{1 << 20, 'K', "1024 KByte"},
+		{512, 'A', " 512 Byte"},
+		{0, 'a', "0.00 bit"},
+	}
+
+	for _, tt := range tests {
+		if got := Format(tt.bytes, tt.format); got != tt.want {
+			t.Errorf("Format(%v, %c) = %q, want %q", tt.bytes, tt.format, got, tt.want)
+		}
+	}
+}
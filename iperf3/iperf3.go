@@ -0,0 +1,375 @@
+// Package iperf3 runs iperf3 tests from Go programs. Run connects to an
+// iperf3 server, runs a test and returns the same results the iperf3-go
+// command prints, without writing anything to stdout:
+//
+//	results, err := iperf3.Run(ctx, iperf3.Config{Host: "192.0.2.1", Duration: 5 * time.Second})
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Println(results.End.SumReceived.BitsPerSecond)
+package iperf3
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"iperf3-go/internal/auth"
+	"iperf3-go/internal/client"
+	"iperf3-go/internal/protocol"
+	"iperf3-go/internal/report"
+	"iperf3-go/internal/server"
+	"iperf3-go/internal/stream"
+)
+
+// Result types, laid out as in iperf3's JSON output
+type (
+	TestResults    = protocol.TestResults
+	TestStart      = protocol.TestStart
+	IntervalReport = protocol.IntervalReport
+	Interval       = protocol.Interval
+	TestEnd        = protocol.TestEnd
+	StreamEnd      = protocol.StreamEnd
+	StreamResult   = protocol.StreamResult
+	PathResult     = protocol.PathResult
+)
+
+// Reporter receives the events of a test as it runs, see Config.Reporter. A
+// reporter may also implement ErrorReporter to render failures, and
+// WaitReporter to show the client waiting for a busy server.
+type (
+	Reporter      = report.Reporter
+	ErrorReporter = report.ErrorReporter
+	WaitReporter  = report.WaitReporter
+	// ReportOptions configures the reporters created by a ReporterFactory
+	ReportOptions = report.Options
+	// ReporterFactory creates a reporter writing to w
+	ReporterFactory = report.Factory
+)
+
+// RegisterFormat makes an output format available by name to NewReporter,
+// replacing any existing format of the same name
+func RegisterFormat(name string, factory ReporterFactory) {
+	report.Register(name, factory)
+}
+
+// NewReporter creates a reporter for a registered output format: "text",
+// "json", "json-stream", "csv", "influx" or one added with RegisterFormat
+func NewReporter(name string, w io.Writer, opts ReportOptions) (Reporter, error) {
+	return report.New(name, w, opts)
+}
+
+// ServerError is returned by Run when the server refuses or stops the test.
+// Its Code says why, and Retryable whether trying again later may succeed;
+// for a test over one of the server's limits, Parameter and Limit name it.
+type ServerError = client.ServerError
+
+// ErrorCode classifies a ServerError
+type ErrorCode = protocol.ErrorCode
+
+// Error codes of ServerError
+const (
+	ErrorCodeProtocol         = protocol.ErrorCodeProtocol
+	ErrorCodeBusy             = protocol.ErrorCodeBusy
+	ErrorCodeAccessDenied     = protocol.ErrorCodeAccessDenied
+	ErrorCodeInvalidParameter = protocol.ErrorCodeInvalidParameter
+	ErrorCodeAborted          = protocol.ErrorCodeAborted
+	ErrorCodeInternal         = protocol.ErrorCodeInternal
+)
+
+// Default settings, as in iperf3
+const (
+	DefaultPort     = 5201
+	DefaultDuration = 10 * time.Second
+)
+
+// Config describes a client test
+type Config struct {
+	// Host is the server; for SCTP it may list several of the server's
+	// addresses as "host1/host2", and for Unix sockets it is the socket path
+	Host string
+	// Port defaults to DefaultPort
+	Port int
+	// Protocol is "tcp" (the default), "udp", "sctp", "unix", "unixpacket" or "quic"
+	Protocol string
+	// Duration defaults to DefaultDuration and is rounded up to whole seconds
+	Duration time.Duration
+	Parallel int
+	// Reverse has the server send and the client receive
+	Reverse bool
+	// Bidir sends both ways at once, on Parallel streams in each direction
+	Bidir bool
+	// Window is the socket buffer size in bytes
+	Window int
+	// Length is the read/write buffer size (the UDP payload size for UDP),
+	// 128 KB by default, or 1460 bytes for UDP
+	Length int
+	// Bitrate is the target rate in bits per second, 0 for unlimited
+	Bitrate int64
+	// Burst is the number of UDP packets sent back to back
+	Burst int
+	// NStreams is the number of SCTP or QUIC streams each SCTP association
+	// or QUIC connection spreads its data over; results then break the bytes
+	// down by stream
+	NStreams int
+	// NoDelay disables Nagle's algorithm and MSS sets the maximum segment
+	// size, for TCP and SCTP
+	NoDelay bool
+	MSS     int
+	// Bind is the local address to send from
+	Bind string
+	// XBind lists further local addresses SCTP associations are bound to,
+	// making them multi-homed
+	XBind []string
+	// MPTCP opens TCP data streams with Multipath TCP where both ends
+	// support it; TestStart.Connected says which streams used it
+	MPTCP bool
+	// TLS, if set, wraps the control connection and data streams in TLS
+	// with this configuration; TestStart.Connected gives each stream's TLS
+	// version, cipher suite and handshake time
+	TLS *tls.Config
+	// Username and Password authenticate to a server that requires it,
+	// encrypted with the server's RSAPublicKey
+	Username     string
+	Password     string
+	RSAPublicKey *rsa.PublicKey
+	Title        string
+	ExtraData    string
+	// GetServerOutput asks the server for its own JSON report, returned in
+	// TestResults.ServerOutputJSON
+	GetServerOutput bool
+	// Retry, if positive, is how long to keep trying again, waiting longer
+	// each time, when the server refuses the test as busy
+	Retry time.Duration
+	// KeepAlive, if enabled, tunes TCP keepalive on the control connection
+	// of TCP and UDP tests
+	KeepAlive net.KeepAliveConfig
+	// PeerTimeout is how long the test goes without hearing from the server
+	// before it is aborted; zero means 10 seconds, negative never
+	PeerTimeout time.Duration
+
+	// OnInterval, if set, is called with each interval report as the test runs
+	OnInterval func(*IntervalReport)
+	// Reporter, if set, receives every event of the test as it runs, e.g.
+	// to render it in one of the formats of NewReporter
+	Reporter Reporter
+
+	// Dial, if set, opens the connections to the server, the control
+	// connection and each data stream, instead of the built-in dialers;
+	// network is "tcp", "udp", "sctp", "unix" or "unixpacket" and address
+	// is Host:Port, or the socket path for Unix sockets. It cannot be used
+	// with QUIC.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Control, if set, is called on the built-in dialers' sockets before
+	// they connect, e.g. to set socket options
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// ServerConfig describes a server
+type ServerConfig struct {
+	// Port defaults to DefaultPort
+	Port int
+	// Bind is the local address to listen on; empty means all addresses.
+	// Unix socket servers listen on the socket path given here.
+	Bind string
+	// XBind lists further local addresses SCTP tests are accepted on
+	XBind []string
+	// MPTCP accepts Multipath TCP data streams as well as plain TCP ones
+	MPTCP bool
+	// TLS, if set, wraps every connection in TLS with this configuration,
+	// including those accepted by Serve. Without certificates, the server
+	// presents a self-signed one.
+	TLS *tls.Config
+	// RSAPrivateKey, if set, makes clients authenticate with a username
+	// and password listed in the AuthorizedUsersPath file, one
+	// "username,hash" line each, where hash is the hex SHA256 of
+	// "{username}password"
+	RSAPrivateKey       *rsa.PrivateKey
+	AuthorizedUsersPath string
+	// TimeSkewThreshold is how far a client's clock may be off, 10 seconds
+	// by default
+	TimeSkewThreshold time.Duration
+	// Allow and Deny restrict the networks tests are accepted from: a
+	// denied source is rejected, and so is any source outside Allow unless
+	// Allow is empty. ACLFile adds the "allow <cidr>" and "deny <cidr>"
+	// lines of a file, read at start and again by ReloadACL.
+	Allow   []netip.Prefix
+	Deny    []netip.Prefix
+	ACLFile string
+	// MaxDuration, MaxParallel, MaxBitrate and MaxLength limit the tests
+	// clients may run; zero means no limit. Tests over a limit are refused,
+	// and tests whose total bitrate averaged over BitrateInterval (5
+	// seconds by default) goes over MaxBitrate are stopped.
+	MaxDuration     time.Duration
+	MaxParallel     int
+	MaxBitrate      int64
+	BitrateInterval time.Duration
+	MaxLength       int
+	// MaxTests, if positive, is the most tests run at once. Up to
+	// QueueLength more wait their turn in order; others are refused with a
+	// retryable ServerError.
+	MaxTests    int
+	QueueLength int
+	// PeerTimeout is how long a test goes without hearing from its client
+	// before it is aborted; zero means 10 seconds, negative never
+	PeerTimeout time.Duration
+	// Protocol is "tcp" (the default), "udp", "sctp", "unix", "unixpacket" or "quic"
+	Protocol string
+}
+
+// Server runs tests for iperf3 clients without writing to stdout
+type Server struct {
+	srv *server.Server
+}
+
+// NewServer creates a server; it does nothing until Start is called
+func NewServer(config ServerConfig) *Server {
+	port := config.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	var authenticator *auth.Authenticator
+	if config.RSAPrivateKey != nil {
+		authenticator = &auth.Authenticator{
+			Key:           config.RSAPrivateKey,
+			UsersPath:     config.AuthorizedUsersPath,
+			SkewThreshold: config.TimeSkewThreshold,
+		}
+	}
+
+	return &Server{srv: server.New(&server.Config{
+		Port:    port,
+		Bind:    config.Bind,
+		XBind:   config.XBind,
+		MPTCP:   config.MPTCP,
+		TLS:     config.TLS,
+		Auth:    authenticator,
+		Allow:   config.Allow,
+		Deny:    config.Deny,
+		ACLFile: config.ACLFile,
+		Limits: server.Limits{
+			Duration:        config.MaxDuration,
+			Parallel:        config.MaxParallel,
+			Bitrate:         config.MaxBitrate,
+			BitrateInterval: config.BitrateInterval,
+			Length:          config.MaxLength,
+		},
+		MaxTests:    config.MaxTests,
+		QueueLength: config.QueueLength,
+		PeerTimeout: config.PeerTimeout,
+		Protocol:    config.Protocol,
+		Output:      io.Discard,
+	})}
+}
+
+// Start serves tests until ctx is done or Shutdown is called. When ctx is
+// done, running tests are stopped early and their clients get the partial
+// results.
+func (s *Server) Start(ctx context.Context) error {
+	return s.srv.Start(ctx)
+}
+
+// Serve is like Start but accepts tests on ln, which is closed when Serve
+// returns. Any stream listener works, including systemd-activated sockets
+// and in-memory listeners.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return s.srv.Serve(ctx, ln)
+}
+
+// ReloadACL reads ACLFile again and applies its rules to new connections
+// and datagrams; on error, the rules in force are kept
+func (s *Server) ReloadACL() error {
+	return s.srv.ReloadACL()
+}
+
+// Shutdown stops accepting tests and waits for the running ones to finish.
+// If ctx is done first, the remaining tests are aborted with an error sent to
+// their clients, and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// Run runs a client test and returns its results. Cancelling ctx stops the
+// test early: the results for the elapsed portion are still returned, marked
+// Interrupted, along with an error wrapping the context's error.
+func Run(ctx context.Context, config Config) (*TestResults, error) {
+	port := config.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	duration := config.Duration
+	if duration <= 0 {
+		duration = DefaultDuration
+	}
+	length := config.Length
+	if length == 0 {
+		length = stream.DefaultLength(config.Protocol)
+	}
+	var rep Reporter = &callbackReporter{onInterval: config.OnInterval}
+	if config.Reporter != nil {
+		rep = report.Multi(rep, config.Reporter)
+	}
+
+	c := client.New(&client.Config{
+		Host:      config.Host,
+		Port:      port,
+		Time:      int(math.Ceil(duration.Seconds())),
+		Parallel:  config.Parallel,
+		Reverse:   config.Reverse,
+		Bidir:     config.Bidir,
+		Window:    config.Window,
+		Length:    length,
+		Bandwidth: config.Bitrate,
+		Protocol:  config.Protocol,
+		Title:     config.Title,
+		ExtraData: config.ExtraData,
+		Burst:     config.Burst,
+		NStreams:  config.NStreams,
+		NoDelay:   config.NoDelay,
+		MSS:       config.MSS,
+		Bind:      config.Bind,
+		XBind:     config.XBind,
+		MPTCP:     config.MPTCP,
+		TLS:       config.TLS,
+
+		Username:     config.Username,
+		Password:     config.Password,
+		RSAPublicKey: config.RSAPublicKey,
+
+		GetServerOutput: config.GetServerOutput,
+		Retry:           config.Retry,
+		KeepAlive:       config.KeepAlive,
+		PeerTimeout:     config.PeerTimeout,
+		// The server's output is requested in JSON, which callers can decode
+		JSON:     true,
+		Reporter: rep,
+		Dial:     config.Dial,
+		Control:  config.Control,
+	})
+	return c.RunTest(ctx)
+}
+
+// callbackReporter forwards interval reports to the caller and discards the
+// other events, whose data ends up in the returned results
+type callbackReporter struct {
+	onInterval func(*IntervalReport)
+}
+
+func (r *callbackReporter) Start(*TestResults) {}
+
+func (r *callbackReporter) Interval(interval *IntervalReport) {
+	if r.onInterval != nil {
+		r.onInterval(interval)
+	}
+}
+
+func (r *callbackReporter) StreamEnd(*StreamEnd) {}
+
+func (r *callbackReporter) Summary(*TestResults) {}
@@ -0,0 +1,378 @@
+package iperf3
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"iperf3-go/internal/auth"
+	"iperf3-go/internal/transport"
+)
+
+// startServer runs an in-process server on a free port and returns the port
+func startServer(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv := NewServer(ServerConfig{Port: port, Bind: "127.0.0.1"})
+	go srv.Start(ctx)
+
+	// Wait for the server to listen
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+			return port
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("server did not start")
+	return 0
+}
+
+func TestRun(t *testing.T) {
+	port := startServer(t)
+
+	var intervals int
+	results, err := Run(context.Background(), Config{
+		Host:            "127.0.0.1",
+		Port:            port,
+		Duration:        time.Second,
+		Title:           "library",
+		GetServerOutput: true,
+		OnInterval:      func(*IntervalReport) { intervals++ },
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if intervals == 0 || intervals != len(results.Intervals) {
+		t.Errorf("OnInterval called %d times for %d intervals", intervals, len(results.Intervals))
+	}
+	if results.Title != "library" || results.Start.TestStart.Duration != 1 || results.Start.TestStart.Blksize != 128*1024 {
+		t.Errorf("unexpected start section: title %q, duration %d, blksize %d", results.Title, results.Start.TestStart.Duration, results.Start.TestStart.Blksize)
+	}
+	if results.End.SumSent.Bytes == 0 || len(results.End.Streams) != 1 {
+		t.Errorf("unexpected end section: %+v", results.End)
+	}
+	if results.End.SumSent.Retransmits == nil || results.End.Streams[0].Sender.Retransmits == nil {
+		t.Error("expected TCP retransmits reported, even if none")
+	}
+	if len(results.ServerOutputJSON) == 0 {
+		t.Error("expected the server's JSON output")
+	}
+}
+
+func TestRunSCTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	// The server is multi-homed on two loopback addresses
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	probe, err := transport.SCTP{}.Listen(ctx, addr, transport.ListenOptions{XBind: []string{"127.0.0.2"}})
+	if err != nil {
+		t.Skipf("SCTP is not available on this host: %v", err)
+	}
+	probe.Close()
+	srv := NewServer(ServerConfig{Port: port, Bind: "127.0.0.1", XBind: []string{"127.0.0.2"}, Protocol: "sctp"})
+	go srv.Start(ctx)
+	for i := 0; ; i++ {
+		conn, err := transport.SCTP{}.DialControl(ctx, addr, transport.DialOptions{})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// So is the client, which knows both of the server's addresses
+	results, err := Run(context.Background(), Config{
+		Host:     "127.0.0.1/127.0.0.2",
+		Port:     port,
+		Protocol: "sctp",
+		Duration: time.Second,
+		NStreams: 4,
+		Bind:     "127.0.0.1",
+		XBind:    []string{"127.0.0.3"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(results.End.Streams) != 1 {
+		t.Fatalf("expected one stream, got %+v", results.End)
+	}
+
+	// Each side accounts for every byte on one of the association's streams
+	sender, receiver := results.End.Streams[0].Sender, results.End.Streams[0].Receiver
+	for _, res := range []*StreamResult{sender, receiver} {
+		var bytes int64
+		for _, ss := range res.Substreams {
+			bytes += ss.Bytes
+		}
+		if res.Bytes == 0 || bytes != res.Bytes {
+			t.Errorf("substreams carried %d of %d bytes: %+v", bytes, res.Bytes, res.Substreams)
+		}
+	}
+	if len(sender.Substreams) != 4 {
+		t.Errorf("expected data on 4 substreams, got %+v", sender.Substreams)
+	}
+	if len(sender.Paths) == 0 || !strings.HasPrefix(sender.Paths[0].Address, "127.0.0.") {
+		t.Errorf("expected the path over one of the server's addresses, got %+v", sender.Paths)
+	}
+}
+
+// lineReporter is an in-house format: one line per event, with the title
+type lineReporter struct {
+	w     io.Writer
+	title string
+}
+
+func (r *lineReporter) Start(*TestResults) { fmt.Fprintf(r.w, "%s start\n", r.title) }
+
+func (r *lineReporter) Interval(interval *IntervalReport) {
+	fmt.Fprintf(r.w, "%s interval %.0f\n", r.title, interval.Sum.BitsPerSecond)
+}
+
+func (r *lineReporter) StreamEnd(*StreamEnd) {}
+
+func (r *lineReporter) Summary(*TestResults) { fmt.Fprintf(r.w, "%s end\n", r.title) }
+
+func TestRunReporter(t *testing.T) {
+	port := startServer(t)
+
+	RegisterFormat("lines", func(w io.Writer, opts ReportOptions) Reporter {
+		return &lineReporter{w: w, title: opts.Title}
+	})
+	var out strings.Builder
+	rep, err := NewReporter("lines", &out, ReportOptions{Title: "lab"})
+	if err != nil {
+		t.Fatalf("NewReporter failed: %v", err)
+	}
+
+	var intervals int
+	_, err = Run(context.Background(), Config{
+		Host:       "127.0.0.1",
+		Port:       port,
+		Duration:   time.Second,
+		OnInterval: func(*IntervalReport) { intervals++ },
+		Reporter:   rep,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != intervals+2 || lines[0] != "lab start" || lines[len(lines)-1] != "lab end" {
+		t.Errorf("unexpected report for %d intervals:\n%s", intervals, out.String())
+	}
+	if _, err := NewReporter("no-such-format", &out, ReportOptions{}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestRunReverse(t *testing.T) {
+	port := startServer(t)
+
+	// The server sends, so the client's end of the stream is the receiver
+	results, err := Run(context.Background(), Config{Host: "127.0.0.1", Port: port, Duration: time.Second, Reverse: true})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results.Start.TestStart.Reverse != 1 || len(results.End.Streams) != 1 {
+		t.Fatalf("unexpected test: reverse %d, %d streams", results.Start.TestStart.Reverse, len(results.End.Streams))
+	}
+	end := results.End.Streams[0]
+	if end.Sender.Bytes == 0 || end.Receiver.Bytes == 0 || end.Sender.Retransmits == nil {
+		t.Errorf("expected the server's sender and our receiver results, got %+v and %+v", end.Sender, end.Receiver)
+	}
+	if results.End.SumReceived.Bytes != end.Receiver.Bytes || results.End.SumSent.Bytes != end.Sender.Bytes {
+		t.Errorf("unexpected sums: sent %d, received %d", results.End.SumSent.Bytes, results.End.SumReceived.Bytes)
+	}
+	if iv := results.Intervals[0].Streams[0]; iv.Sender || iv.Bytes == 0 {
+		t.Errorf("expected our intervals to count the data received, got %+v", iv)
+	}
+}
+
+func TestRunBidir(t *testing.T) {
+	port := startServer(t)
+
+	// Two streams go each way, the last two from the server to us
+	results, err := Run(context.Background(), Config{Host: "127.0.0.1", Port: port, Duration: time.Second, Parallel: 2, Bidir: true})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results.Start.TestStart.Bidir != 1 || len(results.End.Streams) != 4 {
+		t.Fatalf("unexpected test: bidir %d, %d streams", results.Start.TestStart.Bidir, len(results.End.Streams))
+	}
+	for i, end := range results.End.Streams {
+		if end.Sender.Bytes == 0 || end.Receiver.Bytes == 0 {
+			t.Errorf("stream %d: expected data both sent and received, got %+v and %+v", i+1, end.Sender, end.Receiver)
+		}
+	}
+	end := results.End
+	if end.SumSentBidirReverse == nil || end.SumReceivedBidirReverse == nil {
+		t.Fatal("expected the sums of the server's streams")
+	}
+	if end.SumSent.Bytes != end.Streams[0].Sender.Bytes+end.Streams[1].Sender.Bytes ||
+		end.SumSentBidirReverse.Bytes != end.Streams[2].Sender.Bytes+end.Streams[3].Sender.Bytes {
+		t.Errorf("unexpected sums: %d and %d sent", end.SumSent.Bytes, end.SumSentBidirReverse.Bytes)
+	}
+	if iv := results.Intervals[0]; iv.SumBidirReverse == nil || iv.Sum.Sender == iv.SumBidirReverse.Sender {
+		t.Errorf("expected interval sums for each direction, got %+v", iv)
+	}
+
+	if _, err := Run(context.Background(), Config{Host: "127.0.0.1", Port: port, Reverse: true, Bidir: true}); err == nil {
+		t.Error("expected a test both reverse and bidirectional to be refused")
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	port := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	results, err := Run(ctx, Config{Host: "127.0.0.1", Port: port, Duration: 5 * time.Second})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancelled test took %v to return", elapsed)
+	}
+
+	// The elapsed portion is still measured, by both sides
+	if results == nil || !results.Interrupted {
+		t.Fatalf("expected interrupted results, got %+v", results)
+	}
+	if len(results.Intervals) != 1 || results.End.SumSent.Bytes == 0 || results.End.SumReceived.Bytes == 0 {
+		t.Errorf("expected one partial interval with data, got %d intervals, end %+v", len(results.Intervals), results.End)
+	}
+}
+
+// pipeListener is an in-memory listener whose connections are net.Pipes
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestRunInMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln := newPipeListener()
+	srv := NewServer(ServerConfig{})
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, ln) }()
+
+	results, err := Run(ctx, Config{Host: "in-memory", Duration: time.Second, Dial: ln.dial})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results.End.SumReceived.Bytes == 0 {
+		t.Errorf("expected the server to receive data, got %+v", results.End)
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestRunAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	users := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(users, []byte("mario,"+auth.Hash("mario", "rossi")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ln := newPipeListener()
+	srv := NewServer(ServerConfig{RSAPrivateKey: key, AuthorizedUsersPath: users})
+	go srv.Serve(ctx, ln)
+
+	config := Config{Host: "in-memory", Duration: time.Second, Dial: ln.dial, Username: "mario", Password: "rossi", RSAPublicKey: &key.PublicKey}
+	if _, err := Run(ctx, config); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	config.Password = "bianchi"
+	if _, err := Run(ctx, config); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Expected access denied, got %v", err)
+	}
+	config.Username = ""
+	if _, err := Run(ctx, config); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Expected access denied without credentials, got %v", err)
+	}
+}